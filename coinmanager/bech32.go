@@ -0,0 +1,198 @@
+package coinmanager
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//bech32编码，隔离见证v0地址使用bech32(BIP173)，v1及以上使用bech32m(BIP350)
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+var bech32Gen = []int{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func bech32Polymod(values []int) int {
+	chk := 1
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ v
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= bech32Gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HrpExpand(hrp string) []int {
+	ret := make([]int, 0, len(hrp)*2+1)
+	for _, c := range hrp {
+		ret = append(ret, int(c>>5))
+	}
+	ret = append(ret, 0)
+	for _, c := range hrp {
+		ret = append(ret, int(c&31))
+	}
+	return ret
+}
+
+func bech32CreateChecksum(hrp string, data []int, checksumConst int) []int {
+	values := append(bech32HrpExpand(hrp), data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+	polymod := bech32Polymod(values) ^ checksumConst
+	ret := make([]int, 6)
+	for i := 0; i < 6; i++ {
+		ret[i] = (polymod >> uint(5*(5-i))) & 31
+	}
+	return ret
+}
+
+func bech32Encode(hrp string, data []int, checksumConst int) string {
+	combined := append(data, bech32CreateChecksum(hrp, data, checksumConst)...)
+	var ret strings.Builder
+	ret.WriteString(hrp)
+	ret.WriteString("1")
+	for _, p := range combined {
+		ret.WriteByte(bech32Charset[p])
+	}
+	return ret.String()
+}
+
+//bech32Decode 解析bech32/bech32m字符串，返回hrp、数据和校验常量
+func bech32Decode(bech string) (string, []int, int, error) {
+	if len(bech) > 90 {
+		return "", nil, 0, errors.New("bech32 string too long")
+	}
+	if strings.ToLower(bech) != bech && strings.ToUpper(bech) != bech {
+		return "", nil, 0, errors.New("bech32 string mixed case")
+	}
+	bech = strings.ToLower(bech)
+
+	pos := strings.LastIndex(bech, "1")
+	if pos < 1 || pos+7 > len(bech) {
+		return "", nil, 0, errors.New("invalid bech32 separator position")
+	}
+
+	hrp := bech[:pos]
+	for _, c := range hrp {
+		if c < 33 || c > 126 {
+			return "", nil, 0, fmt.Errorf("invalid bech32 hrp character %q", c)
+		}
+	}
+
+	var data []int
+	for _, c := range bech[pos+1:] {
+		d := strings.IndexRune(bech32Charset, c)
+		if d == -1 {
+			return "", nil, 0, fmt.Errorf("invalid bech32 data character %q", c)
+		}
+		data = append(data, d)
+	}
+
+	checksumConst := bech32Polymod(append(bech32HrpExpand(hrp), data...))
+	if checksumConst != bech32Const && checksumConst != bech32mConst {
+		return "", nil, 0, errors.New("invalid bech32 checksum")
+	}
+	return hrp, data[:len(data)-6], checksumConst, nil
+}
+
+func convertBits(data []int, fromBits, toBits uint, pad bool) ([]int, error) {
+	acc := 0
+	bits := uint(0)
+	maxv := (1 << toBits) - 1
+	var ret []int
+	for _, value := range data {
+		if value < 0 || value>>fromBits != 0 {
+			return nil, errors.New("invalid data range")
+		}
+		acc = acc<<fromBits | value
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			ret = append(ret, (acc>>bits)&maxv)
+		}
+	}
+	if pad {
+		if bits > 0 {
+			ret = append(ret, (acc<<(toBits-bits))&maxv)
+		}
+	} else if bits >= fromBits || (acc<<(toBits-bits))&maxv != 0 {
+		return nil, errors.New("invalid padding")
+	}
+	return ret, nil
+}
+
+//EncodeSegWitAddress 生成隔离见证地址，v0使用bech32，v1及以上使用bech32m
+func EncodeSegWitAddress(hrp string, version byte, program []byte) (string, error) {
+	if err := checkWitnessProgram(version, program); err != nil {
+		return "", err
+	}
+
+	values := make([]int, len(program))
+	for i, b := range program {
+		values[i] = int(b)
+	}
+	data, err := convertBits(values, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+
+	checksumConst := bech32mConst
+	if version == 0 {
+		checksumConst = bech32Const
+	}
+	return bech32Encode(hrp, append([]int{int(version)}, data...), checksumConst), nil
+}
+
+//DecodeSegWitAddress 解析隔离见证地址，返回见证版本和见证程序
+func DecodeSegWitAddress(hrp string, addr string) (byte, []byte, error) {
+	hrpGot, data, checksumConst, err := bech32Decode(addr)
+	if err != nil {
+		return 0, nil, err
+	}
+	if hrpGot != hrp {
+		return 0, nil, fmt.Errorf("invalid hrp %s, expect %s", hrpGot, hrp)
+	}
+	if len(data) < 1 || data[0] > 16 {
+		return 0, nil, errors.New("invalid witness version")
+	}
+
+	version := byte(data[0])
+	if (version == 0 && checksumConst != bech32Const) || (version != 0 && checksumConst != bech32mConst) {
+		return 0, nil, errors.New("invalid checksum for witness version")
+	}
+
+	values, err := convertBits(data[1:], 5, 8, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	program := make([]byte, len(values))
+	for i, v := range values {
+		program[i] = byte(v)
+	}
+
+	if err := checkWitnessProgram(version, program); err != nil {
+		return 0, nil, err
+	}
+	return version, program, nil
+}
+
+func checkWitnessProgram(version byte, program []byte) error {
+	if version > 16 {
+		return errors.New("invalid witness version")
+	}
+	if len(program) < 2 || len(program) > 40 {
+		return errors.New("invalid witness program length")
+	}
+	if version == 0 && len(program) != 20 && len(program) != 32 {
+		return errors.New("invalid witness v0 program length")
+	}
+	return nil
+}
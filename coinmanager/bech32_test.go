@@ -0,0 +1,180 @@
+package coinmanager
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestBech32DecodeChecksum(t *testing.T) {
+	tests := []struct {
+		str           string
+		checksumConst int
+	}{
+		//BIP173
+		{"A12UEL5L", bech32Const},
+		{"a12uel5l", bech32Const},
+		{"an83characterlonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1tt5tgs", bech32Const},
+		{"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw", bech32Const},
+		{"11qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqc8247j", bech32Const},
+		{"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w", bech32Const},
+		{"?1ezyfcl", bech32Const},
+		//BIP350
+		{"A1LQFN3A", bech32mConst},
+		{"a1lqfn3a", bech32mConst},
+		{"an83characterlonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11sg7hg6", bech32mConst},
+		{"abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx", bech32mConst},
+		{"11llllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllludsr8", bech32mConst},
+		{"split1checkupstagehandshakeupstreamerranterredcaperredlc445v", bech32mConst},
+		{"?1v759aa", bech32mConst},
+	}
+
+	for _, test := range tests {
+		_, _, checksumConst, err := bech32Decode(test.str)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.str, err)
+			continue
+		}
+		if checksumConst != test.checksumConst {
+			t.Errorf("%s: got checksum const %x, want %x", test.str, checksumConst, test.checksumConst)
+		}
+	}
+}
+
+func TestBech32DecodeInvalid(t *testing.T) {
+	tests := []string{
+		"an84characterslonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1569pvx", //超过90个字符
+		"pzry9x0s0muk",  //没有分隔符
+		"1pzry9x0s0muk", //hrp为空
+		"x1b4n0q5v",     //数据中包含非法字符
+		"li1dgmt3",      //校验和太短
+		"A1G7SGD8",      //校验和按大写hrp计算
+		"10a06t8",       //hrp为空
+		"1qzzfhee",      //hrp为空
+		"M1VUXWEZ",      //bech32m校验和按大写hrp计算
+		"qyrz8wqd2c9m",  //没有分隔符
+		"1qyrz8wqd2c9m", //hrp为空
+		"y1b0jsk6g",     //数据中包含非法字符
+		"lt1igcx5c0",    //数据中包含非法字符
+		"in1muywd",      //校验和太短
+		"mm1crxm3i",     //校验和中包含非法字符
+		"au1s5cgom",     //校验和中包含非法字符
+		"16plkw9",       //hrp为空
+		"1p2gdwpf",      //hrp为空
+		"a1lqfn3A",      //大小写混合
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxx", //校验和错误
+	}
+
+	for _, str := range tests {
+		if _, _, _, err := bech32Decode(str); err == nil {
+			t.Errorf("%s: expected error", str)
+		}
+	}
+}
+
+//parseWitnessScript 从见证输出脚本中解析见证版本和见证程序
+func parseWitnessScript(t *testing.T, scriptHex string) (byte, []byte) {
+	script, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		t.Fatalf("decode script %s: %v", scriptHex, err)
+	}
+	version := script[0]
+	if version != 0 {
+		version -= 0x50
+	}
+	return version, script[2:]
+}
+
+func TestSegWitAddressValid(t *testing.T) {
+	tests := []struct {
+		address string
+		script  string
+	}{
+		//BIP173/BIP350
+		{"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", "0014751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7", "00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262"},
+		{"bc1pw508d6qejxtdg4y5r3zarvary0c5xw7kw508d6qejxtdg4y5r3zarvary0c5xw7kt5nd6y", "5128751e76e8199196d454941c45d1b3a323f1433bd6751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"BC1SW50QGDZ25J", "6002751e"},
+		{"bc1zw508d6qejxtdg4y5r3zarvaryvaxxpcs", "5210751e76e8199196d454941c45d1b3a323"},
+		{"tb1qqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesrxh6hy", "0020000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433"},
+		{"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c", "5120000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433"},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", "512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+	}
+
+	for _, test := range tests {
+		hrp := strings.ToLower(test.address[:2])
+		expectVersion, expectProgram := parseWitnessScript(t, test.script)
+
+		version, program, err := DecodeSegWitAddress(hrp, test.address)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.address, err)
+			continue
+		}
+		if version != expectVersion || hex.EncodeToString(program) != hex.EncodeToString(expectProgram) {
+			t.Errorf("%s: got version %d program %x, want version %d program %x", test.address, version, program,
+				expectVersion, expectProgram)
+		}
+
+		address, err := EncodeSegWitAddress(hrp, version, program)
+		if err != nil {
+			t.Errorf("%s: encode error: %v", test.address, err)
+			continue
+		}
+		if address != strings.ToLower(test.address) {
+			t.Errorf("%s: encode got %s", test.address, address)
+		}
+	}
+}
+
+func TestSegWitAddressInvalid(t *testing.T) {
+	tests := []struct {
+		hrp     string
+		address string
+	}{
+		//BIP350
+		{"bc", "tc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq5zuyut"}, //hrp错误
+		{"bc", "bc1p38j9r5y49hruaue7wxjce0updqjuyyx0kh56v8s25huc6995vvpql3jow4"}, //数据中包含非法字符
+		{"bc", "BC130XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ7ZWS8R"}, //见证版本大于16
+		{"bc", "bc1pw5dgrnzv"}, //见证程序长度为1
+		{"bc", "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v8n0nx0muaewav253zgeav"}, //见证程序长度为41
+		{"bc", "BC1QR508D6QEJXTDG4Y5R3ZARVARYV98GJ9P"},                                         //v0见证程序长度为16
+		{"tb", "tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq47Zagq"},               //大小写混合
+		{"bc", "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v07qwwzcrf"},             //补零超过4位
+		{"tb", "tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vpggkg4j"},               //补位不为0
+		{"bc", "bc1gmk9yu"}, //数据为空
+	}
+
+	for _, test := range tests {
+		if _, _, err := DecodeSegWitAddress(test.hrp, test.address); err == nil {
+			t.Errorf("%s: expected error", test.address)
+		}
+	}
+}
+
+func TestSegWitAddressWrongChecksumVariant(t *testing.T) {
+	tests := []struct {
+		hrp           string
+		address       string
+		checksumConst int
+	}{
+		//v0地址使用bech32m校验和
+		{"bc", "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh", bech32mConst},
+		{"tb", "tb1q0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq24jc47", bech32mConst},
+		//v1及以上地址使用bech32校验和
+		{"bc", "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd", bech32Const},
+		{"tb", "tb1z0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqglt7rf", bech32Const},
+		{"bc", "BC1S0XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ54WELL", bech32Const},
+	}
+
+	for _, test := range tests {
+		//校验和本身有效，只是与见证版本不匹配
+		_, _, checksumConst, err := bech32Decode(test.address)
+		if err != nil || checksumConst != test.checksumConst {
+			t.Errorf("%s: got checksum const %x err %v, want %x", test.address, checksumConst, err, test.checksumConst)
+			continue
+		}
+		if _, _, err := DecodeSegWitAddress(test.hrp, test.address); err == nil {
+			t.Errorf("%s: expected error", test.address)
+		}
+	}
+}
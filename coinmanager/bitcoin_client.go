@@ -1,6 +1,7 @@
 package coinmanager
 
 import (
+	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcutil"
@@ -26,6 +27,15 @@ func (b *BitCoinClient) GetRawMempool() ([]*chainhash.Hash, error) {
 }
 
 
+//Close 关闭RPC连接
+func (b *BitCoinClient) Close() {
+	if b.rpcClient == nil {
+		return
+	}
+	b.rpcClient.Shutdown()
+	b.rpcClient.WaitForShutdown()
+}
+
 //NewBitCoinClient 创建一个bitcoin操作客户端
 func NewBitCoinClient(coinType string) (*BitCoinClient, error) {
 	connCfg := &rpcclient.ConnConfig{
@@ -74,6 +84,43 @@ func (b *BitCoinClient) GetRawTransaction(txHash string) (*btcutil.Tx, error) {
 	return txRaw, nil
 }
 
+//GetMempoolFee 查询内存池中交易的手续费(聪)，不需要查询输入引用的交易
+func (b *BitCoinClient) GetMempoolFee(txHash string) (int64, error) {
+	entry, err := b.rpcClient.GetMempoolEntry(txHash)
+	if err != nil {
+		return 0, err
+	}
+	fee, err := btcutil.NewAmount(entry.Fee)
+	if err != nil {
+		return 0, err
+	}
+	return int64(fee), nil
+}
+
+//GetTxBlockHash 查询交易所在的区块hash，交易在内存池中时返回空字符串，查不到交易时found为false
+//查询已上链交易需要全节点开启txindex
+func (b *BitCoinClient) GetTxBlockHash(txHash *chainhash.Hash) (blockHash string, found bool, err error) {
+	result, err := b.rpcClient.GetRawTransactionVerbose(txHash)
+	if err != nil {
+		if rpcErr, ok := err.(*btcjson.RPCError); ok && rpcErr.Code == btcjson.ErrRPCNoTxInfo {
+			return "", false, nil
+		}
+		log.Warn("GetRawTransactionVerbose FAILED:", "err", err.Error(), "hash", txHash.String())
+		return "", false, err
+	}
+	return result.BlockHash, true, nil
+}
+
+//IsTxOutInChain 查询交易输出是否在链上的utxo集合中(不包含内存池)
+func (b *BitCoinClient) IsTxOutInChain(txHash *chainhash.Hash, index uint32) (bool, error) {
+	result, err := b.rpcClient.GetTxOut(txHash, index, false)
+	if err != nil {
+		log.Warn("GetTxOut FAILED:", "err", err.Error(), "hash", txHash.String(), "index", index)
+		return false, err
+	}
+	return result != nil, nil
+}
+
 //GetBlockCount 获取当前区块链高度
 func (b *BitCoinClient) GetBlockCount() int64 {
 	blockHeight, err := b.rpcClient.GetBlockCount()
@@ -84,6 +131,16 @@ func (b *BitCoinClient) GetBlockCount() int64 {
 	return blockHeight
 }
 
+//GetBlockHash 获取主链上指定高度的区块hash
+func (b *BitCoinClient) GetBlockHash(height int64) (string, error) {
+	blockHash, err := b.rpcClient.GetBlockHash(height)
+	if err != nil {
+		log.Warn("GET_BLOCK_HASH FAIL:", "err", err.Error(), "height", height)
+		return "", err
+	}
+	return blockHash.String(), nil
+}
+
 //GetBlockInfoByHeight 根据区块高度获取区块信息
 func (b *BitCoinClient) GetBlockInfoByHeight(height int64) *BlockData {
 	blockHash, err := b.rpcClient.GetBlockHash(height)
@@ -91,7 +148,20 @@ func (b *BitCoinClient) GetBlockInfoByHeight(height int64) *BlockData {
 		log.Warn("GET_BLOCK_HASH FAIL:", "err", err.Error())
 		return nil
 	}
+	return b.getBlockInfo(blockHash)
+}
+
+//GetBlockInfoByHash 根据区块hash获取区块信息
+func (b *BitCoinClient) GetBlockInfoByHash(hash string) *BlockData {
+	blockHash, err := chainhash.NewHashFromStr(hash)
+	if err != nil {
+		log.Warn("NEW_HASH_FAILED:", "err", err.Error(), "hash", hash)
+		return nil
+	}
+	return b.getBlockInfo(blockHash)
+}
 
+func (b *BitCoinClient) getBlockInfo(blockHash *chainhash.Hash) *BlockData {
 	blockVerbose, err := b.rpcClient.GetBlockVerbose(blockHash)
 	if err != nil {
 		log.Warn("GET_BLOCK_VERBOSE FAIL:", "err", err.Error())
@@ -1,8 +1,11 @@
 package coinmanager
 
 import (
+	"errors"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/cpacia/bchutil"
 	"github.com/spf13/viper"
@@ -33,7 +36,20 @@ func getNetParams() *chaincfg.Params {
 func DecodeAddress(addr string, coinType string) (btcutil.Address, error) {
 	switch coinType {
 	case "btc":
-		return btcutil.DecodeAddress(addr, getNetParams())
+		address, err := btcutil.DecodeAddress(addr, getNetParams())
+		if err != nil {
+			//btcutil只支持v0隔离见证地址，v1地址使用bech32m单独解析
+			taprootAddr, taprootErr := decodeTaprootAddress(addr, getNetParams())
+			if taprootErr == nil {
+				return taprootAddr, nil
+			}
+			return nil, err
+		}
+		//btcutil不检查隔离见证地址的hrp，其他网络的地址同样能解析成功
+		if !address.IsForNet(getNetParams()) {
+			return nil, errors.New("address " + addr + " is not for " + getNetParams().Name)
+		}
+		return address, nil
 	case "bch":
 		return bchutil.DecodeAddress(addr, getNetParams())
 	default:
@@ -42,8 +58,41 @@ func DecodeAddress(addr string, coinType string) (btcutil.Address, error) {
 
 }
 
+//PayToAddrScript 根据地址字符串生成输出脚本
+func PayToAddrScript(addr string, coinType string) ([]byte, error) {
+	address, err := DecodeAddress(addr, coinType)
+	if err != nil {
+		return nil, err
+	}
+	if address == nil {
+		return nil, errors.New("unsupported coin type: " + coinType)
+	}
+
+	switch coinType {
+	case "bch":
+		return bchutil.PayToAddrScript(address)
+	default:
+		if taprootAddr, ok := address.(*AddressTaproot); ok {
+			return txscript.NewScriptBuilder().AddOp(txscript.OP_1).AddData(taprootAddr.ScriptAddress()).Script()
+		}
+		return txscript.PayToAddrScript(address)
+	}
+}
+
 //ExtractPkScriptAddr 从输出脚本中提取地址
+//btc支持P2PKH/P2SH/P2WPKH/P2WSH/P2TR，隔离见证地址使用bech32/bech32m编码
 func ExtractPkScriptAddr(PkScript []byte, coinType string) string {
+	if coinType == "btc" {
+		if program := extractWitnessV1Program(PkScript); program != nil {
+			addr, err := NewAddressTaproot(program, getNetParams())
+			if err != nil {
+				log.Warn("NewAddressTaproot failed:", "err", err.Error())
+				return ""
+			}
+			return addr.EncodeAddress()
+		}
+	}
+
 	scriptClass, addresses, _, err := txscript.ExtractPkScriptAddrs(
 		PkScript, getNetParams())
 
@@ -122,3 +171,17 @@ func ExtractPkScriptAddr(PkScript []byte, coinType string) string {
 	return ""
 }
 
+//IsCoinBaseTx 判断是否为coinbase交易，coinbase只有一个输入且引用空的outpoint
+func IsCoinBaseTx(tx *wire.MsgTx) bool {
+	if len(tx.TxIn) != 1 {
+		return false
+	}
+	prevOut := tx.TxIn[0].PreviousOutPoint
+	return prevOut.Index == wire.MaxPrevOutIndex && prevOut.Hash == (chainhash.Hash{})
+}
+
+//GetTxVSize 计算交易的vsize，bch交易没有见证数据，vsize等于交易大小
+func GetTxVSize(tx *wire.MsgTx) int64 {
+	weight := int64(tx.SerializeSizeStripped()*3 + tx.SerializeSize())
+	return (weight + 3) / 4
+}
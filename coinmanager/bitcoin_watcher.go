@@ -1,27 +1,47 @@
 package coinmanager
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
 	log "github.com/inconshreveable/log15"
 	"github.com/spf13/viper"
+	"runtime/debug"
+	"sync"
 	"time"
 )
 
 var defaultInterval = 1
 var freshBlockLength = 6
+var defaultReorgDepth = 6
 //BitCoinWatcher BTC/BCH监听类
 type BitCoinWatcher struct {
 	scanConfirmHeight     int64
+	confirmTipHash        string
 	watchHeight           int64
 	coinType              string
 	bitcoinClient         *BitCoinClient
-	confirmBlockChan      chan *BlockData
+	blockEventChan        chan *BlockEvent
 	newUnconfirmBlockChan chan *BlockData
 	newTxChan             chan *wire.MsgTx
 	confirmNeedNum        int64
-	mempoolTxs            map[string]int
-	//zmqClient             *zmq.Socket
+	mempoolTxs            map[string]*mempoolEntry
+	mempoolSpends         map[wire.OutPoint]string
+	removedTxChan         chan *RemovedTx
+	zmqNotifier           *zmqNotifier
+	zmqOnce               sync.Once
+	ctx                   context.Context
+	cancel                context.CancelFunc
+	wg                    sync.WaitGroup
+	stopOnce              sync.Once
+	failOnce              sync.Once
+	failErr               error
+	failChan              chan struct{}
 	freshBlockList []*BlockData
+	//freshBlockList保留的区块数，已确认区块在回退深度内仍保留，以便检测回退
+	freshBlockLimit int
 }
 
 //NewBitCoinWatcher 创建一个BTC/BCH监听实例
@@ -29,25 +49,54 @@ func NewBitCoinWatcher(coinType string, confirmHeight int64) (*BitCoinWatcher, e
 	bw := BitCoinWatcher{
 		scanConfirmHeight:     confirmHeight,
 		coinType:              coinType,
-		confirmBlockChan:      make(chan *BlockData, 32),
+		blockEventChan:        make(chan *BlockEvent, 32),
 		newUnconfirmBlockChan: make(chan *BlockData, 32),
 		newTxChan:             make(chan *wire.MsgTx, 100),
-		mempoolTxs:            make(map[string]int),
+		mempoolTxs:            make(map[string]*mempoolEntry),
+		mempoolSpends:         make(map[wire.OutPoint]string),
+		removedTxChan:         make(chan *RemovedTx, 100),
 		watchHeight:           -1,
 		freshBlockList:        nil,
+		failChan:              make(chan struct{}),
 	}
+	bw.ctx, bw.cancel = context.WithCancel(context.Background())
 
-	//bw.zmqClient, _ = zmq.NewSocket(zmq.SUB)
+	reorgDepth := defaultReorgDepth
+	var notifyMode, zmqServer string
+	var zmqSilentTimeout int
 	switch coinType {
 	case "btc":
 		bw.confirmNeedNum = viper.GetInt64("BTC.confirm_block_num")
-		//bw.zmqClient.Connect(viper.GetString("BTC.zmq_server"))
+		if viper.IsSet("BTC.max_reorg_depth") {
+			reorgDepth = viper.GetInt("BTC.max_reorg_depth")
+		}
+		notifyMode = viper.GetString("BTC.notify_mode")
+		zmqServer = viper.GetString("BTC.zmq_server")
+		zmqSilentTimeout = viper.GetInt("BTC.zmq_silent_timeout")
 	case "bch":
 		bw.confirmNeedNum = viper.GetInt64("BCH.confirm_block_num")
-		//bw.zmqClient.Connect(viper.GetString("BCH.zmq_server"))
+		if viper.IsSet("BCH.max_reorg_depth") {
+			reorgDepth = viper.GetInt("BCH.max_reorg_depth")
+		}
+		notifyMode = viper.GetString("BCH.notify_mode")
+		zmqServer = viper.GetString("BCH.zmq_server")
+		zmqSilentTimeout = viper.GetInt("BCH.zmq_silent_timeout")
+	}
+	bw.freshBlockLimit = int(bw.confirmNeedNum) + reorgDepth
+	if bw.freshBlockLimit < freshBlockLength {
+		bw.freshBlockLimit = freshBlockLength
+	}
 
+	//notify_mode为zmq时订阅全节点推送，失败时回退到轮询
+	if notifyMode == "zmq" {
+		notifier, err := newZmqNotifier(coinType, zmqServer, zmqSilentTimeout)
+		if err != nil {
+			log.Warn("create zmq notifier failed, fallback to polling", "err", err.Error(), "server", zmqServer, "coinType", coinType)
+		} else {
+			bw.zmqNotifier = notifier
+		}
 	}
-	//bw.zmqClient.SetSubscribe("hashblock")
+
 	bitcoinClient, err := NewBitCoinClient(coinType)
 	if err != nil {
 		log.Error("Create btc Client failed:", "err", err.Error())
@@ -58,36 +107,41 @@ func NewBitCoinWatcher(coinType string, confirmHeight int64) (*BitCoinWatcher, e
 	return &bw, nil
 }
 
-//WatchNewTxFromNodeMempool 启动监听全节点内存中的新交易
+//WatchNewTxFromNodeMempool 启动监听全节点内存中的新交易，以及被替换、双花或移出内存池的交易
 func (bw *BitCoinWatcher) WatchNewTxFromNodeMempool() {
 	cnt := bw.bitcoinClient.GetBlockCount();
 	log.Debug("GetBlockCount", "cnt", cnt)
+	bw.startZmqNotifier()
+	bw.wg.Add(1)
 	go func() {
-		for {
+		defer bw.wg.Done()
+		defer bw.recoverPanic()
+		for !bw.isStopped() {
 			txList, err := bw.bitcoinClient.GetRawMempool()
 			if err != nil {
 				log.Warn("GetRawMempool failed", "err", err.Error())
-			}
-			if len(txList) > 0 {
+			} else {
 				log.Debug("mempool tx len", "len", len(txList))
-				tempMap := make(map[string]int)
+				tempMap := make(map[string]bool)
 
 				for _, txID := range txList {
-					tempMap[txID.String()] = 0
+					tempMap[txID.String()] = true
 
 					_, ok := bw.mempoolTxs[txID.String()]
 					if !ok {
 						txEntity, err := bw.bitcoinClient.GetRawTransaction(txID.String())
-						if err == nil {
-							bw.newTxChan <- txEntity.MsgTx()
+						if err == nil && bw.addMempoolTx(txEntity.MsgTx()) && !bw.sendTx(txEntity.MsgTx()) {
+							return
 						}
 					}
 				}
 
-				bw.mempoolTxs = tempMap
+				if !bw.syncMempool(tempMap) {
+					return
+				}
 			}
 
-			time.Sleep(time.Duration(defaultInterval) * time.Second)
+			bw.waitMempoolNotify()
 		}
 	}()
 
@@ -95,10 +149,14 @@ func (bw *BitCoinWatcher) WatchNewTxFromNodeMempool() {
 
 //WatchNewBlock 启动监听新区块
 func (bw *BitCoinWatcher) WatchNewBlock() {
+	bw.startZmqNotifier()
+	bw.wg.Add(1)
 	go func() {
-		confirmIndex := 0
+		defer bw.wg.Done()
+		defer bw.recoverPanic()
+		confirmIndex := bw.seedFreshBlockList()
 
-		for {
+		for !bw.isStopped() {
 			blockHeight := bw.bitcoinClient.GetBlockCount()
 			log.Debug("Check block count", "block_height", blockHeight)
 
@@ -110,11 +168,11 @@ func (bw *BitCoinWatcher) WatchNewBlock() {
 			}
 
 			if blockHeight <= lastHeight {
-				time.Sleep(time.Duration(defaultInterval) * time.Second)
+				bw.waitBlockNotify()
 				continue
 			}
 
-			for {
+			for !bw.isStopped() {
 				blockData := bw.bitcoinClient.GetBlockInfoByHeight(lastHeight + 1)
 				log.Debug("get block index", "index", lastHeight+1)
 
@@ -126,10 +184,18 @@ func (bw *BitCoinWatcher) WatchNewBlock() {
 					preHash := bw.freshBlockList[len(bw.freshBlockList)-1].BlockInfo.Hash
 					if blockData.BlockInfo.PreviousHash != preHash {
 						log.Info("hash not equal", "prehash", preHash, "newblockprehash", blockData.BlockInfo.PreviousHash)
+						disconnectBlock := bw.freshBlockList[len(bw.freshBlockList)-1]
 						bw.freshBlockList = bw.freshBlockList[:len(bw.freshBlockList)-1]
 						if len(bw.freshBlockList) < confirmIndex {
 							confirmIndex--
 						}
+						if len(bw.freshBlockList) == 0 {
+							log.Warn("reorg deeper than fresh block list", "height", disconnectBlock.BlockInfo.Height, "coinType", bw.coinType)
+						}
+
+						if !bw.sendBlockEvent(&BlockEvent{Disconnect: true, Block: disconnectBlock}) {
+							return
+						}
 						lastHeight--
 						continue
 					}
@@ -137,17 +203,21 @@ func (bw *BitCoinWatcher) WatchNewBlock() {
 
 				bw.freshBlockList = append(bw.freshBlockList, blockData)
 				if len(bw.freshBlockList)-confirmIndex >= int(bw.confirmNeedNum) {
-					bw.confirmBlockChan <- bw.freshBlockList[confirmIndex]
+					if !bw.sendBlockEvent(&BlockEvent{Block: bw.freshBlockList[confirmIndex]}) {
+						return
+					}
 					confirmIndex++
 				}
 
 				if int(blockData.BlockInfo.Confirmations) < int(bw.confirmNeedNum) {
-					bw.newUnconfirmBlockChan <- blockData
+					if !bw.sendBlock(bw.newUnconfirmBlockChan, blockData) {
+						return
+					}
 				}
 
 				lastHeight = bw.freshBlockList[len(bw.freshBlockList)-1].BlockInfo.Height
 
-				if len(bw.freshBlockList) >= freshBlockLength {
+				if len(bw.freshBlockList) >= bw.freshBlockLimit && confirmIndex > 0 {
 					bw.freshBlockList = bw.freshBlockList[1:]
 					confirmIndex--
 				}
@@ -162,9 +232,9 @@ func (bw *BitCoinWatcher) WatchNewBlock() {
 
 }
 
-//GetConfirmChan 获取已确认区块chan
-func (bw *BitCoinWatcher) GetConfirmChan() <-chan *BlockData {
-	return bw.confirmBlockChan
+//GetBlockEventChan 获取已确认区块和回退区块事件chan，事件按发生顺序推送，回退区块按从高到低的顺序推送
+func (bw *BitCoinWatcher) GetBlockEventChan() <-chan *BlockEvent {
+	return bw.blockEventChan
 }
 
 //GetNewTxChan 获取交易CHAN
@@ -177,3 +247,205 @@ func (bw *BitCoinWatcher) GetNewUnconfirmBlockChan() <-chan *BlockData {
 	return bw.newUnconfirmBlockChan
 }
 
+//GetRawTransaction 根据txhash从区块链上查询交易数据
+func (bw *BitCoinWatcher) GetRawTransaction(txHash string) (*btcutil.Tx, error) {
+	return bw.bitcoinClient.GetRawTransaction(txHash)
+}
+
+//GetBlockHash 获取主链上指定高度的区块hash
+func (bw *BitCoinWatcher) GetBlockHash(height int64) (string, error) {
+	return bw.bitcoinClient.GetBlockHash(height)
+}
+
+//GetBlockInfoByHeight 根据区块高度获取区块信息，失败时返回nil
+func (bw *BitCoinWatcher) GetBlockInfoByHeight(height int64) *BlockData {
+	return bw.bitcoinClient.GetBlockInfoByHeight(height)
+}
+
+//GetBlockCount 获取当前区块链高度，失败时返回-1
+func (bw *BitCoinWatcher) GetBlockCount() int64 {
+	return bw.bitcoinClient.GetBlockCount()
+}
+
+//SetConfirmTip 设置开始扫描的确认高度和上一个已确认区块的hash，需在Start前调用
+//hash不为空时从该区块开始检测回退，hash为空时从confirmHeight开始扫描，不检测之前区块的回退
+func (bw *BitCoinWatcher) SetConfirmTip(confirmHeight int64, hash string) {
+	bw.scanConfirmHeight = confirmHeight
+	bw.confirmTipHash = hash
+}
+
+//seedFreshBlockList 从上一个已确认区块向前加载回退深度内的已确认区块，用于检测停止期间和启动时的回退
+//返回已确认区块的数量，即freshBlockList中下一个待确认区块的位置
+func (bw *BitCoinWatcher) seedFreshBlockList() int {
+	if bw.confirmTipHash == "" {
+		return 0
+	}
+
+	seedNum := bw.freshBlockLimit - int(bw.confirmNeedNum)
+	if seedNum < 1 {
+		seedNum = 1
+	}
+
+	hash := bw.confirmTipHash
+	var seeded []*BlockData
+	for len(seeded) < seedNum && !bw.isStopped() {
+		blockData := bw.bitcoinClient.GetBlockInfoByHash(hash)
+		if blockData == nil {
+			if len(seeded) == 0 {
+				//上一个已确认区块必须加载成功，否则无法检测回退
+				bw.sleep(time.Duration(defaultInterval) * time.Second)
+				continue
+			}
+			break
+		}
+		seeded = append([]*BlockData{blockData}, seeded...)
+		if blockData.BlockInfo.Height == 0 {
+			break
+		}
+		hash = blockData.BlockInfo.PreviousHash
+	}
+
+	bw.freshBlockList = seeded
+	log.Info("seed fresh block list", "hash", bw.confirmTipHash, "len", len(seeded), "coinType", bw.coinType)
+	return len(seeded)
+}
+
+//GetMempoolFee 查询内存池中交易的手续费
+func (bw *BitCoinWatcher) GetMempoolFee(txHash string) (int64, error) {
+	return bw.bitcoinClient.GetMempoolFee(txHash)
+}
+
+//GetTxFee 查询交易输入引用的输出金额，计算交易手续费，每个被花费的交易一次RPC查询
+//被花费的交易已上链时需要全节点开启txindex，查询失败时直接返回错误，由调用方决定是否记录
+func (bw *BitCoinWatcher) GetTxFee(tx *wire.MsgTx) (int64, error) {
+	prevTxs := make(map[string]*wire.MsgTx)
+	var inputValue int64
+	for _, txIn := range tx.TxIn {
+		prevHash := txIn.PreviousOutPoint.Hash
+		prevTx, ok := prevTxs[prevHash.String()]
+		if !ok {
+			txEntity, err := bw.bitcoinClient.rpcClient.GetRawTransaction(&prevHash)
+			if err != nil {
+				return 0, err
+			}
+			prevTx = txEntity.MsgTx()
+			prevTxs[prevHash.String()] = prevTx
+		}
+		if int(txIn.PreviousOutPoint.Index) >= len(prevTx.TxOut) {
+			return 0, errors.New("previous output index out of range")
+		}
+		inputValue += prevTx.TxOut[txIn.PreviousOutPoint.Index].Value
+	}
+
+	var outputValue int64
+	for _, txOut := range tx.TxOut {
+		outputValue += txOut.Value
+	}
+	return inputValue - outputValue, nil
+}
+
+//Start 启动监听新区块和内存池新交易，ctx取消或调用Stop时退出
+func (bw *BitCoinWatcher) Start(ctx context.Context) {
+	bw.ctx, bw.cancel = context.WithCancel(ctx)
+	bw.WatchNewTxFromNodeMempool()
+	bw.WatchNewBlock()
+}
+
+//Stop 停止监听，等待监听goroutine退出后关闭ZMQ连接
+//RPC连接仍可使用，处理完已推送的区块后调用Close关闭
+func (bw *BitCoinWatcher) Stop() {
+	bw.stopOnce.Do(func() {
+		bw.cancel()
+		bw.wg.Wait()
+		if bw.zmqNotifier != nil {
+			bw.zmqNotifier.socket.Close()
+		}
+		log.Info("bitcoin watcher stopped", "coinType", bw.coinType)
+	})
+}
+
+//Close 关闭RPC连接，在Stop之后调用
+func (bw *BitCoinWatcher) Close() {
+	if bw.bitcoinClient != nil {
+		bw.bitcoinClient.Close()
+	}
+}
+
+//recoverPanic 将监听goroutine中的panic转为错误，停止监听并关闭Done
+func (bw *BitCoinWatcher) recoverPanic() {
+	if r := recover(); r != nil {
+		bw.fail(fmt.Errorf("bitcoin watcher panic: %v\n%s", r, debug.Stack()))
+	}
+}
+
+func (bw *BitCoinWatcher) fail(err error) {
+	bw.failOnce.Do(func() {
+		log.Error("bitcoin watcher failed", "err", err.Error(), "coinType", bw.coinType)
+		bw.failErr = err
+		close(bw.failChan)
+		bw.cancel()
+	})
+}
+
+//Done 监听出错停止时关闭，之后Err返回出错原因
+func (bw *BitCoinWatcher) Done() <-chan struct{} {
+	return bw.failChan
+}
+
+//Err 返回监听出错停止的原因，正常运行时返回nil
+func (bw *BitCoinWatcher) Err() error {
+	select {
+	case <-bw.failChan:
+		return bw.failErr
+	default:
+		return nil
+	}
+}
+
+func (bw *BitCoinWatcher) isStopped() bool {
+	select {
+	case <-bw.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+//sleep 等待一段时间，监听停止时立即返回
+func (bw *BitCoinWatcher) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-bw.ctx.Done():
+	}
+}
+
+//sendBlock 推送区块，监听停止时返回false
+func (bw *BitCoinWatcher) sendBlock(ch chan *BlockData, blockData *BlockData) bool {
+	select {
+	case ch <- blockData:
+		return true
+	case <-bw.ctx.Done():
+		return false
+	}
+}
+
+//sendBlockEvent 推送已确认区块或回退区块，监听停止时返回false
+func (bw *BitCoinWatcher) sendBlockEvent(event *BlockEvent) bool {
+	select {
+	case bw.blockEventChan <- event:
+		return true
+	case <-bw.ctx.Done():
+		return false
+	}
+}
+
+//sendTx 推送新交易，监听停止时返回false
+func (bw *BitCoinWatcher) sendTx(tx *wire.MsgTx) bool {
+	select {
+	case bw.newTxChan <- tx:
+		return true
+	case <-bw.ctx.Done():
+		return false
+	}
+}
+
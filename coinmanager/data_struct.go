@@ -11,7 +11,13 @@ type BlockData struct {
 	MsgBolck  *wire.MsgBlock
 }
 
-//SpendType -1:已移除 0:未确认 1:已确认 2:使用中 3:已使用
+//BlockEvent 已确认区块或回退区块，确认和回退按发生顺序在同一个chan中推送
+type BlockEvent struct {
+	Disconnect bool
+	Block      *BlockData
+}
+
+//SpendType -1:已移除 0:未确认 1:已确认 2:使用中 3:已使用 4:未成熟的coinbase
 type UtxoInfo struct {
 	Address       string `json:"address"`
 	Txid          string `json:"vout_txid"`
@@ -20,4 +26,7 @@ type UtxoInfo struct {
 	Confirmations int64  `json:"confirmations"`
 	SpendType     int    `json:"spend_type"`
 	BlockHeight   int64  `json:"block_height"`
+	IsDust        bool   `json:"is_dust"` //金额低于粉尘阈值，花费成本高于其价值
+	Coinbase      bool   `json:"coinbase"`
+	SpendTxid     string `json:"spend_txid"` //花费该utxo的交易
 }
@@ -0,0 +1,157 @@
+package coinmanager
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	log "github.com/inconshreveable/log15"
+)
+
+//交易移出内存池的原因
+const (
+	RemoveReasonReplaced = "replaced" //被BIP125替换
+	RemoveReasonConflict = "conflict" //与内存池中其他交易双花
+	RemoveReasonEvicted  = "evicted"  //未上链被移出内存池，包括过期、被区块中的双花交易挤出等
+)
+
+//RemovedTx 未上链被移出内存池的交易
+type RemovedTx struct {
+	Txid       string `json:"txid"`
+	Reason     string `json:"reason"`
+	ReplacedBy string `json:"replaced_by"` //替换或双花的交易，evicted时为空
+}
+
+//mempoolEntry 内存池交易花费的outpoint，用于检测双花
+type mempoolEntry struct {
+	spends []wire.OutPoint
+	//可花费输出的序号，查不到交易时据此判断交易是否已上链
+	spendableVouts []uint32
+	rbf            bool
+}
+
+func newMempoolEntry(tx *wire.MsgTx) *mempoolEntry {
+	entry := &mempoolEntry{}
+	for _, txIn := range tx.TxIn {
+		entry.spends = append(entry.spends, txIn.PreviousOutPoint)
+		//BIP125: 任一输入的sequence小于0xfffffffe即表示可替换
+		if txIn.Sequence < wire.MaxTxInSequenceNum-1 {
+			entry.rbf = true
+		}
+	}
+	for i, txOut := range tx.TxOut {
+		if !txscript.IsUnspendable(txOut.PkScript) {
+			entry.spendableVouts = append(entry.spendableVouts, uint32(i))
+		}
+	}
+	return entry
+}
+
+//addMempoolTx 记录内存池新交易，与已记录交易花费相同outpoint时推送旧交易的移除事件
+//交易已记录时返回false
+func (bw *BitCoinWatcher) addMempoolTx(tx *wire.MsgTx) bool {
+	txID := tx.TxHash().String()
+	if _, ok := bw.mempoolTxs[txID]; ok {
+		return false
+	}
+
+	entry := newMempoolEntry(tx)
+	for _, outPoint := range entry.spends {
+		oldTxID, ok := bw.mempoolSpends[outPoint]
+		if !ok || oldTxID == txID {
+			continue
+		}
+		reason := RemoveReasonConflict
+		if old := bw.mempoolTxs[oldTxID]; old != nil && old.rbf {
+			reason = RemoveReasonReplaced
+		}
+		bw.removeMempoolTx(oldTxID)
+		log.Info("mempool tx double spent", "txid", oldTxID, "by", txID, "reason", reason, "coinType", bw.coinType)
+		if !bw.sendRemovedTx(&RemovedTx{Txid: oldTxID, Reason: reason, ReplacedBy: txID}) {
+			return false
+		}
+	}
+
+	bw.mempoolTxs[txID] = entry
+	for _, outPoint := range entry.spends {
+		bw.mempoolSpends[outPoint] = txID
+	}
+	return true
+}
+
+func (bw *BitCoinWatcher) removeMempoolTx(txID string) {
+	entry, ok := bw.mempoolTxs[txID]
+	if !ok {
+		return
+	}
+	delete(bw.mempoolTxs, txID)
+	if entry == nil {
+		return
+	}
+	for _, outPoint := range entry.spends {
+		if bw.mempoolSpends[outPoint] == txID {
+			delete(bw.mempoolSpends, outPoint)
+		}
+	}
+}
+
+//syncMempool 与全节点内存池同步，不在内存池中且未上链的交易推送移除事件
+func (bw *BitCoinWatcher) syncMempool(current map[string]bool) bool {
+	for txID, entry := range bw.mempoolTxs {
+		if current[txID] {
+			continue
+		}
+		bw.removeMempoolTx(txID)
+		if entry == nil || bw.isTxMined(txID, entry) {
+			continue
+		}
+		log.Info("mempool tx evicted", "txid", txID, "coinType", bw.coinType)
+		if !bw.sendRemovedTx(&RemovedTx{Txid: txID, Reason: RemoveReasonEvicted}) {
+			return false
+		}
+	}
+	return true
+}
+
+//isTxMined 判断移出内存池的交易是否已上链，查询失败时视为已上链，不推送移除事件
+//优先根据交易所在区块判断；全节点未开启txindex查不到交易时，任一可花费输出在链上的utxo集合中即视为已上链
+func (bw *BitCoinWatcher) isTxMined(txID string, entry *mempoolEntry) bool {
+	hash, err := chainhash.NewHashFromStr(txID)
+	if err != nil {
+		return true
+	}
+
+	blockHash, found, err := bw.bitcoinClient.GetTxBlockHash(hash)
+	if err != nil {
+		return true
+	}
+	if found {
+		//交易不在区块中时已重新进入内存池，同样不推送移除事件
+		if blockHash == "" {
+			log.Info("removed tx back in mempool", "txid", txID, "coinType", bw.coinType)
+		}
+		return true
+	}
+
+	for _, vout := range entry.spendableVouts {
+		inChain, err := bw.bitcoinClient.IsTxOutInChain(hash, vout)
+		if err != nil || inChain {
+			return true
+		}
+	}
+	return false
+}
+
+//sendRemovedTx 推送移除的交易，监听停止时返回false
+func (bw *BitCoinWatcher) sendRemovedTx(removed *RemovedTx) bool {
+	select {
+	case bw.removedTxChan <- removed:
+		return true
+	case <-bw.ctx.Done():
+		return false
+	}
+}
+
+//GetRemovedTxChan 获取未上链被移出内存池的交易CHAN
+func (bw *BitCoinWatcher) GetRemovedTxChan() <-chan *RemovedTx {
+	return bw.removedTxChan
+}
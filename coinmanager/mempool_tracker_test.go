@@ -0,0 +1,210 @@
+package coinmanager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+)
+
+//testRPCServer 代替全节点的JSON-RPC服务，只支持查询交易所在区块和链上utxo
+type testRPCServer struct {
+	//blockHashes 已知交易所在的区块hash，在内存池中时为空字符串，不在其中的交易视为查不到
+	blockHashes map[string]string
+	//txOuts 链上utxo集合，key为txid_vout
+	txOuts map[string]bool
+	//fail 为true时所有请求返回错误
+	fail bool
+}
+
+func (s *testRPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     interface{}       `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result interface{}
+	var rpcErr *btcjson.RPCError
+	var txid string
+	if len(req.Params) > 0 {
+		json.Unmarshal(req.Params[0], &txid)
+	}
+	switch {
+	case s.fail:
+		rpcErr = &btcjson.RPCError{Code: btcjson.ErrRPCMisc, Message: "node error"}
+	case req.Method == "getrawtransaction":
+		blockHash, ok := s.blockHashes[txid]
+		if !ok {
+			rpcErr = &btcjson.RPCError{Code: btcjson.ErrRPCNoTxInfo, Message: "No such mempool or blockchain transaction"}
+			break
+		}
+		result = &btcjson.TxRawResult{Txid: txid, BlockHash: blockHash}
+	case req.Method == "gettxout":
+		var vout uint32
+		json.Unmarshal(req.Params[1], &vout)
+		if s.txOuts[txid+"_"+strconv.Itoa(int(vout))] {
+			result = &btcjson.GetTxOutResult{Confirmations: 1}
+		}
+	default:
+		rpcErr = &btcjson.RPCError{Code: btcjson.ErrRPCMethodNotFound.Code, Message: "Method not found"}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"result": result, "error": rpcErr, "id": req.ID})
+}
+
+//newTestMempoolWatcher 创建连接testRPCServer的监听实例
+func newTestMempoolWatcher(t *testing.T, server *testRPCServer) *BitCoinWatcher {
+	httpServer := httptest.NewServer(server)
+	client, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(httpServer.URL, "http://"),
+		User:         "user",
+		Pass:         "pass",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatalf("new rpc client: %v", err)
+	}
+
+	bw := &BitCoinWatcher{
+		coinType:      "btc",
+		bitcoinClient: &BitCoinClient{rpcClient: client, coinType: "btc"},
+		mempoolTxs:    make(map[string]*mempoolEntry),
+		mempoolSpends: make(map[wire.OutPoint]string),
+		removedTxChan: make(chan *RemovedTx, 100),
+	}
+	bw.ctx, bw.cancel = context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		bw.cancel()
+		bw.bitcoinClient.Close()
+		httpServer.Close()
+	})
+	return bw
+}
+
+//newTestMempoolTx 生成花费spends的交易，rbf为true时通过sequence标记为可替换
+func newTestMempoolTx(rbf bool, spends ...wire.OutPoint) *wire.MsgTx {
+	sequence := wire.MaxTxInSequenceNum
+	if rbf {
+		sequence = wire.MaxTxInSequenceNum - 2
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	for i := range spends {
+		txIn := wire.NewTxIn(&spends[i], nil, nil)
+		txIn.Sequence = sequence
+		tx.AddTxIn(txIn)
+	}
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+	return tx
+}
+
+func TestAddMempoolTxDoubleSpend(t *testing.T) {
+	outPointA := wire.OutPoint{Hash: chainhash.Hash{1}}
+	outPointB := wire.OutPoint{Hash: chainhash.Hash{2}}
+
+	tests := []struct {
+		name   string
+		rbf    bool
+		reason string
+	}{
+		{"replaced", true, RemoveReasonReplaced},
+		{"conflict", false, RemoveReasonConflict},
+	}
+	for _, test := range tests {
+		bw := newTestMempoolWatcher(t, &testRPCServer{})
+		old := newTestMempoolTx(test.rbf, outPointA, outPointB)
+		if !bw.addMempoolTx(old) || bw.addMempoolTx(old) {
+			t.Fatalf("%s: add mempool tx twice should only succeed once", test.name)
+		}
+
+		//新交易与旧交易花费相同outpoint，旧交易推送一次移除事件
+		replacement := newTestMempoolTx(false, outPointA, outPointB)
+		replacement.TxOut[0].Value = 900
+		if !bw.addMempoolTx(replacement) {
+			t.Fatalf("%s: add replacement failed", test.name)
+		}
+		select {
+		case removed := <-bw.GetRemovedTxChan():
+			if removed.Txid != old.TxHash().String() || removed.Reason != test.reason ||
+				removed.ReplacedBy != replacement.TxHash().String() {
+				t.Errorf("%s: got removed tx %+v", test.name, removed)
+			}
+		default:
+			t.Fatalf("%s: no removed tx", test.name)
+		}
+		select {
+		case removed := <-bw.GetRemovedTxChan():
+			t.Errorf("%s: got duplicate removed tx %+v", test.name, removed)
+		default:
+		}
+
+		if _, ok := bw.mempoolTxs[old.TxHash().String()]; ok {
+			t.Errorf("%s: replaced tx still tracked", test.name)
+		}
+		for _, outPoint := range []wire.OutPoint{outPointA, outPointB} {
+			if bw.mempoolSpends[outPoint] != replacement.TxHash().String() {
+				t.Errorf("%s: outpoint %v spent by %s, want replacement", test.name, outPoint, bw.mempoolSpends[outPoint])
+			}
+		}
+	}
+}
+
+func TestSyncMempoolEviction(t *testing.T) {
+	tx := newTestMempoolTx(false, wire.OutPoint{Hash: chainhash.Hash{1}})
+	txid := tx.TxHash().String()
+
+	//移出内存池的交易只有确认未上链时才推送evicted
+	tests := []struct {
+		name    string
+		server  *testRPCServer
+		evicted bool
+	}{
+		{"evicted", &testRPCServer{}, true},
+		{"mined", &testRPCServer{blockHashes: map[string]string{txid: "blockhash"}}, false},
+		{"back in mempool", &testRPCServer{blockHashes: map[string]string{txid: ""}}, false},
+		{"mined without txindex", &testRPCServer{txOuts: map[string]bool{txid + "_0": true}}, false},
+		{"rpc error", &testRPCServer{fail: true}, false},
+	}
+	for _, test := range tests {
+		bw := newTestMempoolWatcher(t, test.server)
+		bw.addMempoolTx(tx)
+		if !bw.syncMempool(map[string]bool{}) {
+			t.Fatalf("%s: sync mempool stopped", test.name)
+		}
+		if len(bw.mempoolTxs) != 0 || len(bw.mempoolSpends) != 0 {
+			t.Errorf("%s: removed tx still tracked", test.name)
+		}
+
+		select {
+		case removed := <-bw.GetRemovedTxChan():
+			if !test.evicted || removed.Txid != txid || removed.Reason != RemoveReasonEvicted || removed.ReplacedBy != "" {
+				t.Errorf("%s: got removed tx %+v", test.name, removed)
+			}
+		default:
+			if test.evicted {
+				t.Errorf("%s: no removed tx", test.name)
+			}
+		}
+	}
+
+	//仍在内存池中的交易不处理
+	bw := newTestMempoolWatcher(t, &testRPCServer{})
+	bw.addMempoolTx(tx)
+	bw.syncMempool(map[string]bool{txid: true})
+	if _, ok := bw.mempoolTxs[txid]; !ok {
+		t.Error("mempool tx removed while still in mempool")
+	}
+}
@@ -0,0 +1,114 @@
+package coinmanager
+
+import (
+	"crypto/sha256"
+	"errors"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/bchutil"
+)
+
+//多签地址类型
+const (
+	FederationAddressP2SH  = "p2sh"
+	FederationAddressP2WSH = "p2wsh"
+)
+
+//AddressTaproot 隔离见证v1(taproot)地址，btcutil尚不支持，使用bech32m编码
+type AddressTaproot struct {
+	hrp            string
+	witnessProgram [32]byte
+}
+
+//NewAddressTaproot 根据32字节的见证程序创建taproot地址
+func NewAddressTaproot(witnessProgram []byte, net *chaincfg.Params) (*AddressTaproot, error) {
+	if len(witnessProgram) != 32 {
+		return nil, errors.New("witness program must be 32 bytes for taproot")
+	}
+
+	addr := &AddressTaproot{hrp: net.Bech32HRPSegwit}
+	copy(addr.witnessProgram[:], witnessProgram)
+	return addr, nil
+}
+
+//EncodeAddress 返回bech32m编码的地址
+func (a *AddressTaproot) EncodeAddress() string {
+	str, err := EncodeSegWitAddress(a.hrp, 1, a.witnessProgram[:])
+	if err != nil {
+		return ""
+	}
+	return str
+}
+
+//ScriptAddress 返回见证程序
+func (a *AddressTaproot) ScriptAddress() []byte {
+	return a.witnessProgram[:]
+}
+
+//IsForNet 地址是否属于指定网络
+func (a *AddressTaproot) IsForNet(net *chaincfg.Params) bool {
+	return a.hrp == net.Bech32HRPSegwit
+}
+
+//String 同EncodeAddress
+func (a *AddressTaproot) String() string {
+	return a.EncodeAddress()
+}
+
+//decodeTaprootAddress 解析bech32m编码的taproot地址
+func decodeTaprootAddress(addr string, net *chaincfg.Params) (*AddressTaproot, error) {
+	version, program, err := DecodeSegWitAddress(net.Bech32HRPSegwit, addr)
+	if err != nil {
+		return nil, err
+	}
+	if version != 1 {
+		return nil, errors.New("unsupported witness version")
+	}
+	return NewAddressTaproot(program, net)
+}
+
+//extractWitnessV1Program 输出脚本为 OP_1 <32字节> 时返回见证程序
+func extractWitnessV1Program(pkScript []byte) []byte {
+	if len(pkScript) == 34 && pkScript[0] == txscript.OP_1 && pkScript[1] == txscript.OP_DATA_32 {
+		return pkScript[2:]
+	}
+	return nil
+}
+
+//NewFederationAddress 根据兑现脚本生成多签地址，addressType为p2sh或p2wsh，bch只支持p2sh
+func NewFederationAddress(redeemScript []byte, coinType string, addressType string) (string, error) {
+	net := getNetParams()
+	if net == nil {
+		return "", errors.New("invalid net_param")
+	}
+
+	switch addressType {
+	case "", FederationAddressP2SH:
+		switch coinType {
+		case "btc":
+			addr, err := btcutil.NewAddressScriptHash(redeemScript, net)
+			if err != nil {
+				return "", err
+			}
+			return addr.EncodeAddress(), nil
+		case "bch":
+			addr, err := bchutil.NewCashAddressScriptHash(redeemScript, net)
+			if err != nil {
+				return "", err
+			}
+			return addr.String(), nil
+		}
+	case FederationAddressP2WSH:
+		if coinType == "btc" {
+			scriptHash := sha256.Sum256(redeemScript)
+			addr, err := btcutil.NewAddressWitnessScriptHash(scriptHash[:], net)
+			if err != nil {
+				return "", err
+			}
+			return addr.EncodeAddress(), nil
+		}
+	}
+	return "", errors.New("unsupported federation address type " + addressType + " for " + coinType)
+}
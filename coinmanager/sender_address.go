@@ -0,0 +1,73 @@
+package coinmanager
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/cpacia/bchutil"
+	log "github.com/inconshreveable/log15"
+)
+
+//ExtractSenderAddress 从输入的签名脚本或见证数据推导被花费输出的地址
+//支持P2PKH、P2SH多签、P2WPKH和P2SH-P2WPKH，无法推导时返回空字符串
+func ExtractSenderAddress(txIn *wire.TxIn, coinType string) string {
+	net := getNetParams()
+	if net == nil {
+		return ""
+	}
+
+	pushes, err := txscript.PushedData(txIn.SignatureScript)
+	if err != nil {
+		return ""
+	}
+
+	var addr btcutil.Address
+	switch {
+	case coinType == "btc" && len(txIn.Witness) == 2 && isPubKey(txIn.Witness[1]):
+		if len(pushes) == 0 {
+			addr, err = btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(txIn.Witness[1]), net)
+		} else if len(pushes) == 1 {
+			//P2SH-P2WPKH，签名脚本为见证程序
+			addr, err = btcutil.NewAddressScriptHash(pushes[0], net)
+		}
+	case len(pushes) == 2 && isPubKey(pushes[1]):
+		addr, err = btcutil.NewAddressPubKeyHash(btcutil.Hash160(pushes[1]), net)
+	case len(pushes) >= 2 && txscript.GetScriptClass(pushes[len(pushes)-1]) == txscript.MultiSigTy:
+		addr, err = btcutil.NewAddressScriptHash(pushes[len(pushes)-1], net)
+	}
+	if err != nil {
+		log.Warn("extract sender address failed", "err", err.Error(), "coinType", coinType)
+		return ""
+	}
+	if addr == nil {
+		return ""
+	}
+
+	if coinType == "bch" {
+		return toCashAddress(addr)
+	}
+	return addr.EncodeAddress()
+}
+
+func isPubKey(data []byte) bool {
+	return (len(data) == 33 && (data[0] == 0x02 || data[0] == 0x03)) || (len(data) == 65 && data[0] == 0x04)
+}
+
+//toCashAddress 将P2PKH/P2SH地址转换为bch cashaddr格式
+func toCashAddress(addr btcutil.Address) string {
+	switch addr.(type) {
+	case *btcutil.AddressPubKeyHash:
+		cashAddr, err := bchutil.NewCashAddressPubKeyHash(addr.ScriptAddress(), getNetParams())
+		if err != nil {
+			return ""
+		}
+		return cashAddr.String()
+	case *btcutil.AddressScriptHash:
+		cashAddr, err := bchutil.NewCashAddressScriptHashFromHash(addr.ScriptAddress(), getNetParams())
+		if err != nil {
+			return ""
+		}
+		return cashAddr.String()
+	}
+	return ""
+}
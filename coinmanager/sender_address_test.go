@@ -0,0 +1,67 @@
+package coinmanager
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/spf13/viper"
+)
+
+func TestExtractSenderAddress(t *testing.T) {
+	oldNetParam := viper.GetString("net_param")
+	viper.Set("net_param", "mainnet")
+	defer viper.Set("net_param", oldNetParam)
+
+	//secp256k1的G和2G，期望地址按hash160独立计算
+	pubKey := decodeTestHex(t, "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	multisig := decodeTestHex(t, "52210279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f817982102c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee552ae")
+	witnessProgram := decodeTestHex(t, "0014751e76e8199196d454941c45d1b3a323f1433bd6")
+	sig := make([]byte, 71)
+
+	buildScript := func(data ...[]byte) []byte {
+		builder := txscript.NewScriptBuilder()
+		for _, d := range data {
+			builder.AddData(d)
+		}
+		script, err := builder.Script()
+		if err != nil {
+			t.Fatalf("build script: %v", err)
+		}
+		return script
+	}
+	multisigScript, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(sig).AddData(sig).AddData(multisig).Script()
+
+	tests := []struct {
+		name      string
+		sigScript []byte
+		witness   wire.TxWitness
+		expected  string
+	}{
+		{"p2pkh", buildScript(sig, pubKey), nil, "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"},
+		{"p2wpkh", nil, wire.TxWitness{sig, pubKey}, "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"},
+		{"p2sh-p2wpkh", buildScript(witnessProgram), wire.TxWitness{sig, pubKey}, "3JvL6Ymt8MVWiCNHC7oWU6nLeHNJKLZGLN"},
+		{"p2sh multisig", multisigScript, nil, "33RQmypKhD6f4tMquiR5a3C6dRT7eBpaiG"},
+		{"p2pk", buildScript(sig), nil, ""},
+		{"invalid pubkey", buildScript(sig, sig), nil, ""},
+		{"invalid script", []byte{txscript.OP_DATA_20}, nil, ""},
+	}
+
+	for _, test := range tests {
+		txIn := wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, 0), test.sigScript, test.witness)
+		if address := ExtractSenderAddress(txIn, "btc"); address != test.expected {
+			t.Errorf("%s: got %s, want %s", test.name, address, test.expected)
+		}
+	}
+}
+
+func TestExtractSenderAddressWitnessOnlyBtc(t *testing.T) {
+	//bch没有隔离见证，见证数据不用于推导地址
+	pubKey, _ := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	txIn := wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, 0), nil, wire.TxWitness{make([]byte, 71), pubKey})
+	if address := ExtractSenderAddress(txIn, "bch"); address != "" {
+		t.Errorf("got %s for bch witness input, want empty", address)
+	}
+}
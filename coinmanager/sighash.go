@@ -0,0 +1,143 @@
+package coinmanager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+//SigHashForkID bch签名类型标识，bch的签名hash必须包含该标识
+const SigHashForkID txscript.SigHashType = 0x40
+
+const sigHashMask = 0x1f
+
+//GetSigHashType 获取币种默认的签名类型，bch为SIGHASH_ALL|SIGHASH_FORKID，btc为SIGHASH_ALL
+func GetSigHashType(coinType string) txscript.SigHashType {
+	switch coinType {
+	case "bch":
+		return txscript.SigHashAll | SigHashForkID
+	default:
+		return txscript.SigHashAll
+	}
+}
+
+//CalcSignatureHash 计算输入idx的签名hash，bch使用BIP143格式(包含FORKID)，btc使用原始格式
+//script为被签名的脚本，P2SH多签时为兑现脚本；amount为该输入utxo的金额，bch签名必须提供
+func CalcSignatureHash(script []byte, hashType txscript.SigHashType, tx *wire.MsgTx, idx int, amount int64, coinType string) ([]byte, error) {
+	if idx < 0 || idx >= len(tx.TxIn) {
+		return nil, errors.New("invalid input index")
+	}
+
+	switch coinType {
+	case "bch":
+		if hashType&SigHashForkID == 0 {
+			return nil, errors.New("bch signature hash type must contain forkid")
+		}
+		return calcForkIDSignatureHash(script, hashType, tx, idx, amount), nil
+	default:
+		if hashType&SigHashForkID != 0 {
+			return nil, errors.New("btc signature hash type must not contain forkid")
+		}
+		return txscript.CalcSignatureHash(script, hashType, tx, idx)
+	}
+}
+
+//RawTxInSignature 对输入idx签名，返回DER格式签名加一个字节的签名类型
+func RawTxInSignature(tx *wire.MsgTx, idx int, script []byte, hashType txscript.SigHashType, key *btcec.PrivateKey, amount int64, coinType string) ([]byte, error) {
+	hash, err := CalcSignatureHash(script, hashType, tx, idx, amount, coinType)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := key.Sign(hash)
+	if err != nil {
+		return nil, err
+	}
+	return append(signature.Serialize(), byte(hashType)), nil
+}
+
+//CalcWitnessSignatureHash 计算btc隔离见证v0输入的签名hash(BIP143)，P2WSH多签时script为见证脚本
+func CalcWitnessSignatureHash(script []byte, hashType txscript.SigHashType, tx *wire.MsgTx, idx int, amount int64) ([]byte, error) {
+	if idx < 0 || idx >= len(tx.TxIn) {
+		return nil, errors.New("invalid input index")
+	}
+	if hashType&SigHashForkID != 0 {
+		return nil, errors.New("witness signature hash type must not contain forkid")
+	}
+	return txscript.CalcWitnessSigHash(script, txscript.NewTxSigHashes(tx), hashType, tx, idx, amount)
+}
+
+//RawTxInWitnessSignature 对btc隔离见证v0输入签名，返回DER格式签名加一个字节的签名类型
+func RawTxInWitnessSignature(tx *wire.MsgTx, idx int, script []byte, hashType txscript.SigHashType, key *btcec.PrivateKey, amount int64) ([]byte, error) {
+	hash, err := CalcWitnessSignatureHash(script, hashType, tx, idx, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := key.Sign(hash)
+	if err != nil {
+		return nil, err
+	}
+	return append(signature.Serialize(), byte(hashType)), nil
+}
+
+//calcForkIDSignatureHash 按bch的FORKID规则计算签名hash，格式与BIP143相同，hashType包含FORKID标识
+//double-sha256(version | hashPrevouts | hashSequence | outpoint | scriptCode | amount | sequence | hashOutputs | locktime | hashType)
+func calcForkIDSignatureHash(script []byte, hashType txscript.SigHashType, tx *wire.MsgTx, idx int, amount int64) []byte {
+	var zeroHash chainhash.Hash
+	anyoneCanPay := hashType&txscript.SigHashAnyOneCanPay != 0
+	baseType := hashType & sigHashMask
+
+	hashPrevouts := zeroHash
+	if !anyoneCanPay {
+		var buf bytes.Buffer
+		for _, in := range tx.TxIn {
+			buf.Write(in.PreviousOutPoint.Hash[:])
+			binary.Write(&buf, binary.LittleEndian, in.PreviousOutPoint.Index)
+		}
+		hashPrevouts = chainhash.DoubleHashH(buf.Bytes())
+	}
+
+	hashSequence := zeroHash
+	if !anyoneCanPay && baseType != txscript.SigHashSingle && baseType != txscript.SigHashNone {
+		var buf bytes.Buffer
+		for _, in := range tx.TxIn {
+			binary.Write(&buf, binary.LittleEndian, in.Sequence)
+		}
+		hashSequence = chainhash.DoubleHashH(buf.Bytes())
+	}
+
+	hashOutputs := zeroHash
+	if baseType != txscript.SigHashSingle && baseType != txscript.SigHashNone {
+		var buf bytes.Buffer
+		for _, out := range tx.TxOut {
+			wire.WriteTxOut(&buf, 0, 0, out)
+		}
+		hashOutputs = chainhash.DoubleHashH(buf.Bytes())
+	} else if baseType == txscript.SigHashSingle && idx < len(tx.TxOut) {
+		var buf bytes.Buffer
+		wire.WriteTxOut(&buf, 0, 0, tx.TxOut[idx])
+		hashOutputs = chainhash.DoubleHashH(buf.Bytes())
+	}
+
+	txIn := tx.TxIn[idx]
+	var preimage bytes.Buffer
+	binary.Write(&preimage, binary.LittleEndian, tx.Version)
+	preimage.Write(hashPrevouts[:])
+	preimage.Write(hashSequence[:])
+	preimage.Write(txIn.PreviousOutPoint.Hash[:])
+	binary.Write(&preimage, binary.LittleEndian, txIn.PreviousOutPoint.Index)
+	wire.WriteVarBytes(&preimage, 0, script)
+	binary.Write(&preimage, binary.LittleEndian, amount)
+	binary.Write(&preimage, binary.LittleEndian, txIn.Sequence)
+	preimage.Write(hashOutputs[:])
+	binary.Write(&preimage, binary.LittleEndian, tx.LockTime)
+	binary.Write(&preimage, binary.LittleEndian, uint32(hashType))
+
+	return chainhash.DoubleHashB(preimage.Bytes())
+}
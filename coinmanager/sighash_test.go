@@ -0,0 +1,209 @@
+package coinmanager
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+//BIP143 Native P2WPKH 示例交易，签名第二个输入
+const bip143P2wpkhTx = "0100000002fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f0000000000eeffffffef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000ffffffff02202cb206000000001976a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac11000000"
+
+//BIP143 P2SH-P2WPKH 示例交易
+const bip143P2shP2wpkhTx = "0100000001db6b1b20aa0fd7b23880be2ecbd4a98130974cf4748fb66092ac4d3ceb1a54770100000000feffffff02b8b4eb0b000000001976a914a457b684d7f0d539a46a45bbc043f35b59d0d96388ac0008af2f000000001976a914fd270b1ee6abcaea97fea7ad0402e8bd8ad6d77c88ac92040000"
+
+//Bitcoin Core tx_valid.json中"Correct signature order"的主网交易，花费2-of-3 P2SH多签
+const p2shMultisigTx = "01000000012312503f2491a2a97fcd775f11e108a540a5528b5d4dee7a3c68ae4add01dab300000000fdfe0000483045022100f6649b0eddfdfd4ad55426663385090d51ee86c3481bdc6b0c18ea6c0ece2c0b0220561c315b07cffa6f7dd9df96dbae9200c2dee09bf93cc35ca05e6cdf613340aa0148304502207aacee820e08b0b174e248abd8d7a34ed63b5da3abedb99934df9fddd65c05c4022100dfe87896ab5ee3df476c2655f9fbe5bd089dccbef3e4ea05b5d121169fe7f5f4014c695221031d11db38972b712a9fe1fc023577c7ae3ddb4a3004187d41c45121eecfdbb5b7210207ec36911b6ad2382860d32989c7b8728e9489d7bbc94a6b5509ef0029be128821024ea9fac06f666a4adc3fc1357b7bec1fd0bdece2b9d08579226a8ebde53058e453aeffffffff0180380100000000001976a914c9b99cddf847d10685a4fabaa0baf505f7c3dfab88ac00000000"
+
+func decodeTestTx(t *testing.T, txHex string) *wire.MsgTx {
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		t.Fatalf("decode tx hex: %v", err)
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	if err := tx.Deserialize(bytes.NewReader(data)); err != nil {
+		t.Fatalf("deserialize tx: %v", err)
+	}
+	return tx
+}
+
+func decodeTestHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decode hex %s: %v", s, err)
+	}
+	return data
+}
+
+func TestCalcWitnessSignatureHashBip143(t *testing.T) {
+	tests := []struct {
+		name     string
+		tx       string
+		idx      int
+		script   string
+		amount   int64
+		expected string
+	}{
+		{
+			name:     "native p2wpkh",
+			tx:       bip143P2wpkhTx,
+			idx:      1,
+			script:   "00141d0f172a0ecb48aee1be1f2687d2963ae33f71a1",
+			amount:   600000000,
+			expected: "c37af31116d1b27caf68aae9e3ac82f1477929014d5b917657d0eb49478cb670",
+		},
+		{
+			name:     "p2sh-p2wpkh",
+			tx:       bip143P2shP2wpkhTx,
+			idx:      0,
+			script:   "001479091972186c449eb1ded22b78e40d009bdf0089",
+			amount:   1000000000,
+			expected: "64f3b0f4dd2bb3aa1ce8566d220cc74dda9df97d8490cc81d89d735c92e59fb6",
+		},
+	}
+
+	for _, test := range tests {
+		tx := decodeTestTx(t, test.tx)
+		hash, err := CalcWitnessSignatureHash(decodeTestHex(t, test.script), txscript.SigHashAll, tx, test.idx, test.amount)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if hex.EncodeToString(hash) != test.expected {
+			t.Errorf("%s: got %x, want %s", test.name, hash, test.expected)
+		}
+	}
+}
+
+func TestCalcSignatureHashForkID(t *testing.T) {
+	//签名脚本为BIP143 Native P2WPKH示例中的scriptCode，期望值按BIP143格式独立计算，hashType包含FORKID
+	script := "76a9141d0f172a0ecb48aee1be1f2687d2963ae33f71a188ac"
+	tests := []struct {
+		name     string
+		hashType txscript.SigHashType
+		expected string
+	}{
+		{"all", txscript.SigHashAll | SigHashForkID, "467f411d178762db122a6aced76370a1c8324355bf0796502bf82eeaeda86a35"},
+		{"all anyonecanpay", txscript.SigHashAll | SigHashForkID | txscript.SigHashAnyOneCanPay, "a5890ce40dc95a89717ae6fa3c9d60bcf9372539058c7e9a0cd8ff7909723326"},
+		{"none", txscript.SigHashNone | SigHashForkID, "c0876aa9dfd131ac207be062e389741416a87a5d1b28e4857c178990454dd498"},
+		{"single", txscript.SigHashSingle | SigHashForkID, "abb61ba86e14313425d25846ed3a30904de1f081e013d80c385e165c2af1e020"},
+		{"single anyonecanpay", txscript.SigHashSingle | SigHashForkID | txscript.SigHashAnyOneCanPay, "4e303851715b6ee36582740f43cc288c969e88afc641f14e3e8e68d32c406c1b"},
+	}
+
+	tx := decodeTestTx(t, bip143P2wpkhTx)
+	for _, test := range tests {
+		hash, err := CalcSignatureHash(decodeTestHex(t, script), test.hashType, tx, 1, 600000000, "bch")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if hex.EncodeToString(hash) != test.expected {
+			t.Errorf("%s: got %x, want %s", test.name, hash, test.expected)
+		}
+	}
+}
+
+func TestCalcSignatureHashPublishedVectors(t *testing.T) {
+	//btc为Bitcoin Core的sighash.json，bch为bchd的sighash_bip143.json，输入金额为0
+	//期望值按uint256显示，字节顺序与签名hash相反
+	tests := []struct {
+		name     string
+		coinType string
+		tx       string
+		script   string
+		idx      int
+		hashType int32
+		expected string
+	}{
+		{
+			name:     "btc legacy all",
+			coinType: "btc",
+			tx:       "c6a72ed403313b7d027f6864e705ec6b5fa52eb99169f8ea7cd884f5cdb830a150cebade870100000009ac63ab516565ab6a51ffffffff398d5838735ff43c390ca418593dbe43f3445ba69394a6d665b5dc3b4769b5d700000000075265acab515365ffffffff7ee5616a1ee105fd18189806a477300e2a9cf836bf8035464e8192a0d785eea3030000000700ac6a51516a52ffffffff018075fd0000000000015100000000",
+			script:   "005251acac5252",
+			idx:      2,
+			hashType: -656067295,
+			expected: "2cc1c7514fdc512fd45ca7ba4f7be8a9fe6d3318328bc1a61ae6e7675047e654",
+		},
+		{
+			name:     "bch forkid all",
+			coinType: "bch",
+			tx:       "2fe513a301a6d2cd80c95cbed7c58f016fcfdd712a92b382e008b86b7aaa1ea0f50a4754f801000000050000526a6a22c338ce02e228b3010000000009ab52ab00ab656a636ac5bb480400000000045365516500000000",
+			script:   "51acac636aac5200",
+			idx:      0,
+			hashType: -1981214367,
+			expected: "7fa81037d95fe1b7744029e242cdc4753095e67ea71821e7729a32f3ebaea7d9",
+		},
+	}
+
+	for _, test := range tests {
+		tx := decodeTestTx(t, test.tx)
+		hash, err := CalcSignatureHash(decodeTestHex(t, test.script), txscript.SigHashType(uint32(test.hashType)), tx, test.idx, 0, test.coinType)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		expected, _ := chainhash.NewHashFromStr(test.expected)
+		if !bytes.Equal(hash, expected[:]) {
+			t.Errorf("%s: got %x, want %x", test.name, hash, expected[:])
+		}
+	}
+}
+
+func TestCalcSignatureHashP2shMultisig(t *testing.T) {
+	tx := decodeTestTx(t, p2shMultisigTx)
+	pushes, err := txscript.PushedData(tx.TxIn[0].SignatureScript)
+	if err != nil || len(pushes) != 4 {
+		t.Fatalf("got %d pushes err %v, want OP_0 sig sig redeemScript", len(pushes), err)
+	}
+	redeemScript := pushes[3]
+	if hex.EncodeToString(btcutil.Hash160(redeemScript)) != "b1ce99298d5f07364b57b1e5c9cc00be0b04a954" {
+		t.Fatalf("redeem script hash mismatch with the spent P2SH output")
+	}
+	pubKeys, _ := txscript.PushedData(redeemScript)
+
+	//主网交易中的签名按兑现脚本中公钥的顺序对应前两个公钥
+	hash, err := CalcSignatureHash(redeemScript, txscript.SigHashAll, tx, 0, 0, "btc")
+	if err != nil {
+		t.Fatalf("calc signature hash: %v", err)
+	}
+	for i, sigData := range pushes[1:3] {
+		if txscript.SigHashType(sigData[len(sigData)-1]) != txscript.SigHashAll {
+			t.Fatalf("signature %d: unexpected hash type %x", i, sigData[len(sigData)-1])
+		}
+		sig, err := btcec.ParseDERSignature(sigData[:len(sigData)-1], btcec.S256())
+		if err != nil {
+			t.Fatalf("signature %d: %v", i, err)
+		}
+		pubKey, err := btcec.ParsePubKey(pubKeys[i], btcec.S256())
+		if err != nil {
+			t.Fatalf("pubkey %d: %v", i, err)
+		}
+		if !sig.Verify(hash, pubKey) {
+			t.Errorf("signature %d does not verify against signature hash %x", i, hash)
+		}
+	}
+}
+
+func TestCalcSignatureHashInvalid(t *testing.T) {
+	tx := decodeTestTx(t, bip143P2wpkhTx)
+	script := decodeTestHex(t, "76a9141d0f172a0ecb48aee1be1f2687d2963ae33f71a188ac")
+
+	if _, err := CalcSignatureHash(script, txscript.SigHashAll, tx, 1, 600000000, "bch"); err == nil {
+		t.Error("bch hash type without forkid should fail")
+	}
+	if _, err := CalcSignatureHash(script, txscript.SigHashAll|SigHashForkID, tx, 1, 600000000, "btc"); err == nil {
+		t.Error("btc hash type with forkid should fail")
+	}
+	if _, err := CalcWitnessSignatureHash(script, txscript.SigHashAll|SigHashForkID, tx, 1, 600000000); err == nil {
+		t.Error("witness hash type with forkid should fail")
+	}
+	if _, err := CalcSignatureHash(script, txscript.SigHashAll|SigHashForkID, tx, 2, 600000000, "bch"); err == nil {
+		t.Error("input index out of range should fail")
+	}
+}
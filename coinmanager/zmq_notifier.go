@@ -0,0 +1,202 @@
+package coinmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	log "github.com/inconshreveable/log15"
+	zmq "github.com/pebbe/zmq4"
+)
+
+var defaultZmqSilentTimeout = 60
+
+//zmqSocket 接收ZMQ消息的socket，便于替换为测试用的发布端
+type zmqSocket interface {
+	RecvMessageBytes(flags zmq.Flag) ([][]byte, error)
+	Close() error
+}
+
+//zmqNotifier 订阅全节点ZMQ推送的hashblock/rawtx/sequence消息
+type zmqNotifier struct {
+	socket        zmqSocket
+	coinType      string
+	silentTimeout time.Duration
+	//lastMsgTime 最近一次收到消息的时间(纳秒)，启动时为0，收到第一条消息前视为静默
+	lastMsgTime   int64
+	blockNotify   chan struct{}
+	mempoolNotify chan struct{}
+	txChan        chan *wire.MsgTx
+}
+
+func newZmqNotifier(coinType string, server string, silentTimeout int) (*zmqNotifier, error) {
+	socket, err := zmq.NewSocket(zmq.SUB)
+	if err != nil {
+		return nil, err
+	}
+
+	err = socket.Connect(server)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+
+	for _, topic := range []string{"hashblock", "rawtx", "sequence"} {
+		err = socket.SetSubscribe(topic)
+		if err != nil {
+			socket.Close()
+			return nil, err
+		}
+	}
+
+	//设置接收超时，避免接收循环永久阻塞
+	err = socket.SetRcvtimeo(time.Duration(defaultInterval) * time.Second)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+
+	if silentTimeout <= 0 {
+		silentTimeout = defaultZmqSilentTimeout
+	}
+
+	return newZmqNotifierWithSocket(socket, coinType, time.Duration(silentTimeout)*time.Second), nil
+}
+
+func newZmqNotifierWithSocket(socket zmqSocket, coinType string, silentTimeout time.Duration) *zmqNotifier {
+	return &zmqNotifier{
+		socket:        socket,
+		coinType:      coinType,
+		silentTimeout: silentTimeout,
+		blockNotify:   make(chan struct{}, 1),
+		mempoolNotify: make(chan struct{}, 1),
+		txChan:        make(chan *wire.MsgTx, 100),
+	}
+}
+
+//isSilent 超过silentTimeout没有收到消息时认为ZMQ不可用，回退到轮询
+//启动后收到第一条消息前同样视为不可用，ZMQ地址配置错误或全节点未开启推送时不会等待silentTimeout才开始轮询
+func (z *zmqNotifier) isSilent() bool {
+	lastMsgTime := atomic.LoadInt64(&z.lastMsgTime)
+	return time.Since(time.Unix(0, lastMsgTime)) > z.silentTimeout
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+//start 启动ZMQ消息接收，ctx取消后退出，recoverPanic处理接收goroutine中的panic
+func (z *zmqNotifier) start(ctx context.Context, wg *sync.WaitGroup, recoverPanic func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer recoverPanic()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			msg, err := z.socket.RecvMessageBytes(0)
+			if err != nil {
+				continue
+			}
+			if len(msg) < 2 {
+				log.Warn("invalid zmq message", "parts", len(msg), "coinType", z.coinType)
+				continue
+			}
+			atomic.StoreInt64(&z.lastMsgTime, time.Now().UnixNano())
+			z.processMessage(string(msg[0]), msg[1])
+		}
+	}()
+}
+
+func (z *zmqNotifier) processMessage(topic string, body []byte) {
+	switch topic {
+	case "hashblock":
+		log.Debug("zmq hashblock", "hash", hex.EncodeToString(body), "coinType", z.coinType)
+		notify(z.blockNotify)
+	case "rawtx":
+		tx := wire.NewMsgTx(wire.TxVersion)
+		err := tx.Deserialize(bytes.NewReader(body))
+		if err != nil {
+			log.Warn("deserialize zmq rawtx failed", "err", err.Error(), "coinType", z.coinType)
+			return
+		}
+		select {
+		case z.txChan <- tx:
+		default:
+			//队列已满时交给mempool轮询补齐
+			notify(z.mempoolNotify)
+		}
+	case "sequence":
+		//<32字节hash><1字节类型> C:区块连接 D:区块断开 A:交易进入内存池 R:交易移出内存池
+		if len(body) < 33 {
+			log.Warn("invalid zmq sequence message", "len", len(body), "coinType", z.coinType)
+			return
+		}
+		switch body[32] {
+		case 'C', 'D':
+			notify(z.blockNotify)
+		case 'R':
+			notify(z.mempoolNotify)
+		}
+	}
+}
+
+//startZmqNotifier 启动ZMQ消息接收，只启动一次
+func (bw *BitCoinWatcher) startZmqNotifier() {
+	if bw.zmqNotifier == nil {
+		return
+	}
+	bw.zmqOnce.Do(func() {
+		bw.zmqNotifier.start(bw.ctx, &bw.wg, bw.recoverPanic)
+	})
+}
+
+//waitBlockNotify 等待新区块通知，ZMQ不可用时按defaultInterval轮询
+func (bw *BitCoinWatcher) waitBlockNotify() {
+	if bw.zmqNotifier == nil || bw.zmqNotifier.isSilent() {
+		bw.sleep(time.Duration(defaultInterval) * time.Second)
+		return
+	}
+
+	select {
+	case <-bw.zmqNotifier.blockNotify:
+	case <-time.After(bw.zmqNotifier.silentTimeout):
+	case <-bw.ctx.Done():
+	}
+}
+
+//waitMempoolNotify 等待内存池变化，期间处理ZMQ推送的新交易
+//ZMQ不可用时按defaultInterval轮询，可用时每silentTimeout与全节点内存池同步一次
+func (bw *BitCoinWatcher) waitMempoolNotify() {
+	if bw.zmqNotifier == nil || bw.zmqNotifier.isSilent() {
+		bw.sleep(time.Duration(defaultInterval) * time.Second)
+		return
+	}
+
+	timeout := time.After(bw.zmqNotifier.silentTimeout)
+	for {
+		select {
+		case tx := <-bw.zmqNotifier.txChan:
+			if bw.addMempoolTx(tx) && !bw.sendTx(tx) {
+				return
+			}
+		case <-bw.zmqNotifier.mempoolNotify:
+			return
+		case <-timeout:
+			return
+		case <-bw.ctx.Done():
+			return
+		}
+	}
+}
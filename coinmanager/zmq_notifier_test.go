@@ -0,0 +1,204 @@
+package coinmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	zmq "github.com/pebbe/zmq4"
+)
+
+//testZmqPublisher 代替全节点的ZMQ发布端，publish的消息按顺序由RecvMessageBytes返回
+//没有消息时与设置了接收超时的socket一样返回错误
+type testZmqPublisher struct {
+	msgChan   chan [][]byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	seq       uint32
+}
+
+func newTestZmqPublisher() *testZmqPublisher {
+	return &testZmqPublisher{
+		msgChan: make(chan [][]byte, 10),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (p *testZmqPublisher) publish(topic string, body []byte) {
+	seq := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seq, p.seq)
+	p.seq++
+	p.msgChan <- [][]byte{[]byte(topic), body, seq}
+}
+
+func (p *testZmqPublisher) RecvMessageBytes(flags zmq.Flag) ([][]byte, error) {
+	select {
+	case msg := <-p.msgChan:
+		return msg, nil
+	case <-p.closed:
+		return nil, errors.New("socket closed")
+	case <-time.After(10 * time.Millisecond):
+		return nil, errors.New("resource temporarily unavailable")
+	}
+}
+
+func (p *testZmqPublisher) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	return nil
+}
+
+func newTestZmqWatcher(t *testing.T, silentTimeout time.Duration) (*BitCoinWatcher, *testZmqPublisher) {
+	publisher := newTestZmqPublisher()
+	bw := &BitCoinWatcher{
+		coinType:      "btc",
+		newTxChan:     make(chan *wire.MsgTx, 100),
+		mempoolTxs:    make(map[string]*mempoolEntry),
+		mempoolSpends: make(map[wire.OutPoint]string),
+		removedTxChan: make(chan *RemovedTx, 100),
+		zmqNotifier:   newZmqNotifierWithSocket(publisher, "btc", silentTimeout),
+		failChan:      make(chan struct{}),
+	}
+	bw.ctx, bw.cancel = context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		bw.cancel()
+		bw.wg.Wait()
+		publisher.Close()
+	})
+	bw.startZmqNotifier()
+	return bw, publisher
+}
+
+//waitZmqAlive 发布一条消息并等待通知端收到，清空产生的通知
+func waitZmqAlive(t *testing.T, bw *BitCoinWatcher, publisher *testZmqPublisher) {
+	publisher.publish("hashblock", make([]byte, 32))
+	deadline := time.Now().Add(time.Second)
+	for bw.zmqNotifier.isSilent() {
+		if time.Now().After(deadline) {
+			t.Fatal("zmq message not received")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case <-bw.zmqNotifier.blockNotify:
+	case <-time.After(time.Second):
+		t.Fatal("block notify not received")
+	}
+}
+
+func TestZmqSilentBeforeFirstMessage(t *testing.T) {
+	bw, publisher := newTestZmqWatcher(t, 5*time.Second)
+
+	//收到第一条消息前按轮询间隔等待
+	if !bw.zmqNotifier.isSilent() {
+		t.Fatal("notifier should be silent before first message")
+	}
+	start := time.Now()
+	bw.waitBlockNotify()
+	if elapsed := time.Since(start); elapsed < time.Duration(defaultInterval)*time.Second-100*time.Millisecond {
+		t.Errorf("waitBlockNotify returned after %v, expect polling interval", elapsed)
+	}
+
+	waitZmqAlive(t, bw, publisher)
+	if bw.zmqNotifier.isSilent() {
+		t.Error("notifier should not be silent after first message")
+	}
+}
+
+func TestZmqHashBlockNotify(t *testing.T) {
+	bw, publisher := newTestZmqWatcher(t, 5*time.Second)
+	waitZmqAlive(t, bw, publisher)
+
+	done := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		bw.waitBlockNotify()
+		done <- time.Since(start)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	publisher.publish("hashblock", make([]byte, 32))
+
+	select {
+	case elapsed := <-done:
+		//收到hashblock后立即返回，不等待轮询间隔
+		if elapsed >= time.Duration(defaultInterval)*time.Second {
+			t.Errorf("waitBlockNotify returned after %v, expect immediately after hashblock", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waitBlockNotify not returned after hashblock")
+	}
+}
+
+func TestZmqRawTxDelivery(t *testing.T) {
+	bw, publisher := newTestZmqWatcher(t, 5*time.Second)
+	waitZmqAlive(t, bw, publisher)
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		t.Fatalf("serialize tx: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		bw.waitMempoolNotify()
+		close(done)
+	}()
+
+	publisher.publish("rawtx", buf.Bytes())
+	select {
+	case got := <-bw.newTxChan:
+		if got.TxHash() != tx.TxHash() {
+			t.Errorf("got tx %s, want %s", got.TxHash(), tx.TxHash())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("rawtx not delivered")
+	}
+
+	//交易移出内存池的sequence消息结束本次等待，交给内存池同步处理
+	body := append(make([]byte, 32), 'R')
+	publisher.publish("sequence", body)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("waitMempoolNotify not returned after sequence message")
+	}
+
+	if _, ok := bw.mempoolTxs[tx.TxHash().String()]; !ok {
+		t.Error("rawtx not recorded in mempool")
+	}
+}
+
+func TestZmqSilentFallbackToPolling(t *testing.T) {
+	silentTimeout := 100 * time.Millisecond
+	bw, publisher := newTestZmqWatcher(t, silentTimeout)
+	waitZmqAlive(t, bw, publisher)
+
+	time.Sleep(2 * silentTimeout)
+	if !bw.zmqNotifier.isSilent() {
+		t.Fatal("notifier should be silent after zmq_silent_timeout")
+	}
+
+	//静默后按轮询间隔等待，不再依赖ZMQ通知
+	start := time.Now()
+	bw.waitBlockNotify()
+	if elapsed := time.Since(start); elapsed < time.Duration(defaultInterval)*time.Second-100*time.Millisecond {
+		t.Errorf("waitBlockNotify returned after %v, expect polling interval", elapsed)
+	}
+
+	//收到新消息后恢复使用ZMQ通知
+	waitZmqAlive(t, bw, publisher)
+	if bw.zmqNotifier.isSilent() {
+		t.Error("notifier should not be silent after new message")
+	}
+}
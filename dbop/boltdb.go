@@ -0,0 +1,175 @@
+package dbop
+
+import (
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("watcher")
+
+//BoltDatabase bbolt操作类，所有数据存放在同一个bucket中
+//bbolt同时只允许一个写事务，且同一goroutine持有读事务时开写事务会死锁，
+//所以iterator在创建时一次性读出数据，不持有事务
+type BoltDatabase struct {
+	filename string
+	db       *bolt.DB
+}
+
+//NewBoltDatabase 在dir目录下打开或新建bbolt数据文件
+func NewBoltDatabase(dir string) (*BoltDatabase, error) {
+	file := filepath.Join(dir, "watcher.db")
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDatabase{
+		filename: file,
+		db:       db,
+	}, nil
+}
+
+//Get 查询KEY的VALUE
+func (db *BoltDatabase) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		value = copyBytes(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+//Put 存储KEV VALUE
+func (db *BoltDatabase) Put(key []byte, value []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, value)
+	})
+}
+
+//Delete 删除KEY
+func (db *BoltDatabase) Delete(key []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete(key)
+	})
+}
+
+//NewIteratorWithPrefix 根据前缀返回iter，遍历的是创建时的数据
+func (db *BoltDatabase) NewIteratorWithPrefix(prefix []byte) Iterator {
+	iter := &memIterator{index: -1}
+	err := db.db.View(func(tx *bolt.Tx) error {
+		iter.keys, iter.values = boltScan(tx, prefix)
+		return nil
+	})
+	if err != nil {
+		return &errIterator{err: err}
+	}
+	return iter
+}
+
+//NewBatch 创建批量写入，Write时在一个写事务中提交
+func (db *BoltDatabase) NewBatch() Batch {
+	return &boltBatch{db: db.db}
+}
+
+//NewSnapshot 创建只读快照，在一个读事务中复制当前全部数据
+//不持有读事务，否则快照存在期间写入需要扩大mmap时会一直阻塞
+func (db *BoltDatabase) NewSnapshot() (Snapshot, error) {
+	data := make(map[string][]byte)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		keys, values := boltScan(tx, nil)
+		for i, key := range keys {
+			data[key] = values[i]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &memSnapshot{db: data}, nil
+}
+
+//Close 关闭bbolt
+func (db *BoltDatabase) Close() error {
+	return db.db.Close()
+}
+
+func boltScan(tx *bolt.Tx, prefix []byte) ([]string, [][]byte) {
+	var keys []string
+	var values [][]byte
+	c := tx.Bucket(boltBucket).Cursor()
+	for k, v := c.Seek(prefix); k != nil && hasPrefix(k, prefix); k, v = c.Next() {
+		keys = append(keys, string(k))
+		values = append(values, copyBytes(v))
+	}
+	return keys, values
+}
+
+func hasPrefix(b []byte, prefix []byte) bool {
+	return len(b) >= len(prefix) && string(b[:len(prefix)]) == string(prefix)
+}
+
+type boltBatch struct {
+	db  *bolt.DB
+	ops []memOp
+}
+
+func (b *boltBatch) Put(key []byte, value []byte) {
+	b.ops = append(b.ops, memOp{key: string(key), value: copyBytes(value)})
+}
+
+func (b *boltBatch) Delete(key []byte) {
+	b.ops = append(b.ops, memOp{key: string(key), delete: true})
+}
+
+func (b *boltBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *boltBatch) Write() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, op := range b.ops {
+			var err error
+			if op.delete {
+				err = bucket.Delete([]byte(op.key))
+			} else {
+				err = bucket.Put([]byte(op.key), op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+//errIterator 创建失败时返回，Error返回失败原因
+type errIterator struct {
+	err error
+}
+
+func (it *errIterator) Next() bool    { return false }
+func (it *errIterator) Key() []byte   { return nil }
+func (it *errIterator) Value() []byte { return nil }
+func (it *errIterator) Release()      {}
+func (it *errIterator) Error() error  { return it.err }
@@ -0,0 +1,91 @@
+package dbop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+//存储后端类型
+const (
+	BackendLevelDB = "leveldb"
+	BackendMemory  = "memory"
+	BackendBolt    = "bbolt"
+)
+
+//ErrNotFound KEY不存在
+var ErrNotFound = errors.New("not found")
+
+//ErrClosed 存储已关闭
+var ErrClosed = errors.New("database closed")
+
+//Database 存储接口，Get在KEY不存在时返回ErrNotFound
+type Database interface {
+	Get(key []byte) ([]byte, error)
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	//NewIteratorWithPrefix 按KEY的字节序遍历指定前缀的数据，使用完毕后调用Release
+	NewIteratorWithPrefix(prefix []byte) Iterator
+	//NewBatch 创建批量写入，Write时原子写入
+	NewBatch() Batch
+	//NewSnapshot 创建只读快照，使用完毕后调用Release
+	NewSnapshot() (Snapshot, error)
+	Close() error
+}
+
+//Iterator 遍历接口，Key和Value返回的数据在下一次Next后可能失效，需要保存时复制
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+//Batch 批量写入接口
+type Batch interface {
+	Put(key []byte, value []byte)
+	Delete(key []byte)
+	//Len 批量写入中的操作数
+	Len() int
+	Write() error
+	Reset()
+}
+
+//Snapshot 只读快照接口
+type Snapshot interface {
+	Get(key []byte) ([]byte, error)
+	NewIteratorWithPrefix(prefix []byte) Iterator
+	Release()
+}
+
+//OpenDatabase 按backend打开存储，path为数据目录，不存在时创建
+//memory为内存存储，不使用path，关闭后数据丢失
+func OpenDatabase(backend string, path string) (Database, error) {
+	if backend == BackendMemory {
+		return NewMemDatabase(), nil
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return nil, err
+		}
+	} else {
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("database path %s is not a directory", path)
+		}
+	}
+
+	switch backend {
+	case "", BackendLevelDB:
+		return NewLDBDatabase(path, 16, 16)
+	case BackendBolt:
+		return NewBoltDatabase(path)
+	default:
+		return nil, fmt.Errorf("unknown database backend %s", backend)
+	}
+}
@@ -0,0 +1,152 @@
+package dbop
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+var testBackends = []string{BackendLevelDB, BackendMemory, BackendBolt}
+
+func openTestDatabase(t *testing.T, backend string) Database {
+	db, err := OpenDatabase(backend, filepath.Join(t.TempDir(), backend))
+	if err != nil {
+		t.Fatalf("%s: open database: %v", backend, err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+//collectPrefix 遍历前缀下的数据，返回按遍历顺序排列的key=value
+func collectPrefix(it Iterator) ([]string, error) {
+	defer it.Release()
+	var result []string
+	for it.Next() {
+		result = append(result, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+	}
+	return result, it.Error()
+}
+
+func TestDatabaseBackends(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, db Database)
+	}{
+		{"get missing key", func(t *testing.T, db Database) {
+			if _, err := db.Get([]byte("btc_missing")); err != ErrNotFound {
+				t.Errorf("got err %v, want ErrNotFound", err)
+			}
+		}},
+		{"put and get", func(t *testing.T, db Database) {
+			if err := db.Put([]byte("btc_key"), []byte("value")); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if err := db.Put([]byte("btc_key"), []byte("value2")); err != nil {
+				t.Fatalf("overwrite: %v", err)
+			}
+			value, err := db.Get([]byte("btc_key"))
+			if err != nil || !bytes.Equal(value, []byte("value2")) {
+				t.Errorf("got %q err %v, want value2", value, err)
+			}
+		}},
+		{"delete", func(t *testing.T, db Database) {
+			db.Put([]byte("btc_key"), []byte("value"))
+			if err := db.Delete([]byte("btc_key")); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			if _, err := db.Get([]byte("btc_key")); err != ErrNotFound {
+				t.Errorf("got err %v after delete, want ErrNotFound", err)
+			}
+			if err := db.Delete([]byte("btc_missing")); err != nil {
+				t.Errorf("delete missing key: %v", err)
+			}
+		}},
+		{"iterator prefix", func(t *testing.T, db Database) {
+			for _, key := range []string{"btc_utxo_b", "btc_utxo_a", "btc_utxoz", "bch_utxo_a", "btc_utxo_c"} {
+				db.Put([]byte(key), []byte("v"+key[len(key)-1:]))
+			}
+			got, err := collectPrefix(db.NewIteratorWithPrefix([]byte("btc_utxo_")))
+			want := []string{"btc_utxo_a=va", "btc_utxo_b=vb", "btc_utxo_c=vc"}
+			if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got %v err %v, want %v", got, err, want)
+			}
+			got, err = collectPrefix(db.NewIteratorWithPrefix([]byte("eth_")))
+			if err != nil || len(got) != 0 {
+				t.Errorf("got %v err %v for unknown prefix, want empty", got, err)
+			}
+		}},
+		{"batch", func(t *testing.T, db Database) {
+			db.Put([]byte("btc_old"), []byte("old"))
+			batch := db.NewBatch()
+			batch.Put([]byte("btc_a"), []byte("a"))
+			batch.Put([]byte("btc_b"), []byte("b"))
+			batch.Delete([]byte("btc_old"))
+			if batch.Len() != 3 {
+				t.Errorf("got batch len %d, want 3", batch.Len())
+			}
+			//Write前不可见
+			if _, err := db.Get([]byte("btc_a")); err != ErrNotFound {
+				t.Errorf("got err %v before batch write, want ErrNotFound", err)
+			}
+			if err := batch.Write(); err != nil {
+				t.Fatalf("batch write: %v", err)
+			}
+			got, err := collectPrefix(db.NewIteratorWithPrefix([]byte("btc_")))
+			want := []string{"btc_a=a", "btc_b=b"}
+			if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got %v err %v, want %v", got, err, want)
+			}
+
+			batch.Reset()
+			if batch.Len() != 0 {
+				t.Errorf("got batch len %d after reset, want 0", batch.Len())
+			}
+			batch.Put([]byte("btc_c"), []byte("c"))
+			if err := batch.Write(); err != nil {
+				t.Fatalf("batch write after reset: %v", err)
+			}
+			if _, err := db.Get([]byte("btc_c")); err != nil {
+				t.Errorf("get after reset write: %v", err)
+			}
+		}},
+		{"snapshot", func(t *testing.T, db Database) {
+			db.Put([]byte("btc_a"), []byte("a"))
+			snapshot, err := db.NewSnapshot()
+			if err != nil {
+				t.Fatalf("snapshot: %v", err)
+			}
+			defer snapshot.Release()
+			db.Put([]byte("btc_a"), []byte("a2"))
+			db.Put([]byte("btc_b"), []byte("b"))
+
+			value, err := snapshot.Get([]byte("btc_a"))
+			if err != nil || !bytes.Equal(value, []byte("a")) {
+				t.Errorf("got %q err %v from snapshot, want a", value, err)
+			}
+			if _, err := snapshot.Get([]byte("btc_b")); err != ErrNotFound {
+				t.Errorf("got err %v from snapshot, want ErrNotFound", err)
+			}
+			got, err := collectPrefix(snapshot.NewIteratorWithPrefix([]byte("btc_")))
+			if err != nil || fmt.Sprint(got) != fmt.Sprint([]string{"btc_a=a"}) {
+				t.Errorf("got %v err %v from snapshot iterator, want [btc_a=a]", got, err)
+			}
+		}},
+	}
+
+	for _, backend := range testBackends {
+		for _, test := range tests {
+			t.Run(backend+"/"+test.name, func(t *testing.T) {
+				test.run(t, openTestDatabase(t, backend))
+			})
+		}
+	}
+}
+
+func TestOpenDatabaseUnknownBackend(t *testing.T) {
+	if _, err := OpenDatabase("rocksdb", t.TempDir()); err == nil {
+		t.Error("expected error for unknown backend")
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"github.com/btcsuite/goleveldb/leveldb"
 	"github.com/btcsuite/goleveldb/leveldb/errors"
 	"github.com/btcsuite/goleveldb/leveldb/filter"
-	"github.com/btcsuite/goleveldb/leveldb/iterator"
 	"github.com/btcsuite/goleveldb/leveldb/opt"
 	"github.com/btcsuite/goleveldb/leveldb/util"
 	"github.com/inconshreveable/log15"
@@ -55,13 +54,16 @@ func NewLDBDatabase(file string, cache int, handles int) (*LDBDatabase, error) {
 }
 
 //NewIteratorWithPrefix 根据前缀返回iter
-func (db *LDBDatabase) NewIteratorWithPrefix(prefix []byte) iterator.Iterator {
+func (db *LDBDatabase) NewIteratorWithPrefix(prefix []byte) Iterator {
 	return db.db.NewIterator(util.BytesPrefix(prefix), nil)
 }
 
 //Get 查询KEY的VALUE
 func (db *LDBDatabase) Get(key []byte) ([]byte, error) {
 	data, err := db.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -73,3 +75,71 @@ func (db *LDBDatabase) Put(key []byte, value []byte) error {
 	return db.db.Put(key, value, nil)
 }
 
+//Delete 删除KEY
+func (db *LDBDatabase) Delete(key []byte) error {
+	return db.db.Delete(key, nil)
+}
+
+//NewBatch 创建批量写入
+func (db *LDBDatabase) NewBatch() Batch {
+	return &ldbBatch{db: db.db, batch: new(leveldb.Batch)}
+}
+
+//NewSnapshot 创建只读快照
+func (db *LDBDatabase) NewSnapshot() (Snapshot, error) {
+	snapshot, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &ldbSnapshot{snapshot: snapshot}, nil
+}
+
+//Close 关闭leveldb
+func (db *LDBDatabase) Close() error {
+	return db.db.Close()
+}
+
+type ldbBatch struct {
+	db    *leveldb.DB
+	batch *leveldb.Batch
+}
+
+func (b *ldbBatch) Put(key []byte, value []byte) {
+	b.batch.Put(key, value)
+}
+
+func (b *ldbBatch) Delete(key []byte) {
+	b.batch.Delete(key)
+}
+
+func (b *ldbBatch) Len() int {
+	return b.batch.Len()
+}
+
+func (b *ldbBatch) Write() error {
+	return b.db.Write(b.batch, nil)
+}
+
+func (b *ldbBatch) Reset() {
+	b.batch.Reset()
+}
+
+type ldbSnapshot struct {
+	snapshot *leveldb.Snapshot
+}
+
+func (s *ldbSnapshot) Get(key []byte) ([]byte, error) {
+	data, err := s.snapshot.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *ldbSnapshot) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return s.snapshot.NewIterator(util.BytesPrefix(prefix), nil)
+}
+
+func (s *ldbSnapshot) Release() {
+	s.snapshot.Release()
+}
@@ -0,0 +1,224 @@
+package dbop
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+//MemDatabase 内存存储，用于测试
+type MemDatabase struct {
+	lock sync.RWMutex
+	db   map[string][]byte
+}
+
+//NewMemDatabase 新建一个内存存储实例
+func NewMemDatabase() *MemDatabase {
+	return &MemDatabase{
+		db: make(map[string][]byte),
+	}
+}
+
+//Get 查询KEY的VALUE
+func (db *MemDatabase) Get(key []byte) ([]byte, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if db.db == nil {
+		return nil, ErrClosed
+	}
+	value, ok := db.db[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyBytes(value), nil
+}
+
+//Put 存储KEV VALUE
+func (db *MemDatabase) Put(key []byte, value []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.db == nil {
+		return ErrClosed
+	}
+	db.db[string(key)] = copyBytes(value)
+	return nil
+}
+
+//Delete 删除KEY
+func (db *MemDatabase) Delete(key []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.db == nil {
+		return ErrClosed
+	}
+	delete(db.db, string(key))
+	return nil
+}
+
+//NewIteratorWithPrefix 根据前缀返回iter，遍历的是创建时的数据
+func (db *MemDatabase) NewIteratorWithPrefix(prefix []byte) Iterator {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return newMemIterator(db.db, prefix)
+}
+
+//NewBatch 创建批量写入
+func (db *MemDatabase) NewBatch() Batch {
+	return &memBatch{db: db}
+}
+
+//NewSnapshot 创建只读快照，复制当前全部数据
+func (db *MemDatabase) NewSnapshot() (Snapshot, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if db.db == nil {
+		return nil, ErrClosed
+	}
+	data := make(map[string][]byte, len(db.db))
+	for k, v := range db.db {
+		data[k] = v
+	}
+	return &memSnapshot{db: data}, nil
+}
+
+//Close 关闭后数据丢失
+func (db *MemDatabase) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.db = nil
+	return nil
+}
+
+type memOp struct {
+	key    string
+	value  []byte
+	delete bool
+}
+
+type memBatch struct {
+	db  *MemDatabase
+	ops []memOp
+}
+
+func (b *memBatch) Put(key []byte, value []byte) {
+	b.ops = append(b.ops, memOp{key: string(key), value: copyBytes(value)})
+}
+
+func (b *memBatch) Delete(key []byte) {
+	b.ops = append(b.ops, memOp{key: string(key), delete: true})
+}
+
+func (b *memBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *memBatch) Write() error {
+	b.db.lock.Lock()
+	defer b.db.lock.Unlock()
+
+	if b.db.db == nil {
+		return ErrClosed
+	}
+	for _, op := range b.ops {
+		if op.delete {
+			delete(b.db.db, op.key)
+		} else {
+			b.db.db[op.key] = op.value
+		}
+	}
+	return nil
+}
+
+func (b *memBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+//memSnapshot 复制出的只读数据，bbolt快照也使用
+type memSnapshot struct {
+	db map[string][]byte
+}
+
+func (s *memSnapshot) Get(key []byte) ([]byte, error) {
+	value, ok := s.db[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyBytes(value), nil
+}
+
+func (s *memSnapshot) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return newMemIterator(s.db, prefix)
+}
+
+func (s *memSnapshot) Release() {
+	s.db = nil
+}
+
+//memIterator 遍历创建时复制出的有序数据，bbolt也使用
+type memIterator struct {
+	keys   []string
+	values [][]byte
+	index  int
+}
+
+func newMemIterator(data map[string][]byte, prefix []byte) *memIterator {
+	iter := &memIterator{index: -1}
+	p := string(prefix)
+	for k := range data {
+		if strings.HasPrefix(k, p) {
+			iter.keys = append(iter.keys, k)
+		}
+	}
+	sort.Strings(iter.keys)
+	iter.values = make([][]byte, len(iter.keys))
+	for i, k := range iter.keys {
+		iter.values[i] = data[k]
+	}
+	return iter
+}
+
+func (it *memIterator) Next() bool {
+	if it.index >= len(it.keys) {
+		return false
+	}
+	it.index++
+	return it.index < len(it.keys)
+}
+
+func (it *memIterator) Key() []byte {
+	if it.index < 0 || it.index >= len(it.keys) {
+		return nil
+	}
+	return []byte(it.keys[it.index])
+}
+
+func (it *memIterator) Value() []byte {
+	if it.index < 0 || it.index >= len(it.keys) {
+		return nil
+	}
+	return it.values[it.index]
+}
+
+func (it *memIterator) Release() {
+	it.keys = nil
+	it.values = nil
+}
+
+func (it *memIterator) Error() error {
+	return nil
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
@@ -0,0 +1,268 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JimmyHongjichuan/btc_watcher/mortgagewatcher"
+	log "github.com/inconshreveable/log15"
+)
+
+//Server 只读HTTP查询服务，提供多签地址utxo、交易hash映射和抵押交易的查询
+type Server struct {
+	listenAddr string
+	watchers   sync.Map
+	httpServer *http.Server
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type confirmHeightResponse struct {
+	CoinType          string `json:"coin_type"`
+	ScanConfirmHeight int64  `json:"scan_confirm_height"`
+}
+
+type hashMappingResponse struct {
+	HashBeforeSign string `json:"hash_before_sign"`
+	HashAfterSign  string `json:"hash_after_sign"`
+}
+
+//NewServer 创建HTTP查询服务，localOnly为true时只监听127.0.0.1
+func NewServer(listenAddr string, localOnly bool) (*Server, error) {
+	if localOnly {
+		_, port, err := net.SplitHostPort(listenAddr)
+		if err != nil {
+			return nil, err
+		}
+		listenAddr = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	s := &Server{
+		listenAddr: listenAddr,
+	}
+	s.httpServer = &http.Server{
+		Addr:         listenAddr,
+		Handler:      s,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	return s, nil
+}
+
+//AddWatcher 注册一条链的监听，按coinType提供查询
+func (s *Server) AddWatcher(watcher *mortgagewatcher.MortgageWatcher) {
+	s.watchers.Store(watcher.GetCoinType(), watcher)
+}
+
+//RemoveWatcher 移除一条链的监听，监听停止重建期间该链的查询返回unknown coin type
+func (s *Server) RemoveWatcher(coinType string) {
+	s.watchers.Delete(coinType)
+}
+
+//Start 启动HTTP服务
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		return err
+	}
+
+	log.Info("http server listen", "addr", s.listenAddr)
+	go func() {
+		err := s.httpServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("http server stopped", "err", err.Error())
+		}
+	}()
+	return nil
+}
+
+//Stop 停止HTTP服务
+func (s *Server) Stop(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+//ServeHTTP 路由 /{coin_type}/{method}[/{param}]
+//  GET /{coin_type}/utxos?spend_type=1
+//  GET /{coin_type}/utxo/{txid_vout}
+//  GET /{coin_type}/hash_mapping/{hash_before_sign}
+//  GET /{coin_type}/confirm_height
+//  GET /{coin_type}/mortgage_txs
+//  GET /{coin_type}/rejected[/{sc_txid}]
+//  GET /{coin_type}/refunds?status=0
+//  GET /{coin_type}/refund/{sc_txid}
+//  GET /{coin_type}/consolidation
+//  GET /{coin_type}/pending_deposits[/{sc_txid}]
+//  GET /{coin_type}/deposits?state=confirmed
+//  GET /{coin_type}/deposit/{txid}
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	t, ok := s.watchers.Load(parts[0])
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("unknown coin type"))
+		return
+	}
+	watcher := t.(*mortgagewatcher.MortgageWatcher)
+
+	var param string
+	if len(parts) > 2 {
+		param = parts[2]
+	}
+
+	switch parts[1] {
+	case "utxos":
+		s.handleUtxoList(w, r, watcher)
+	case "utxo":
+		s.handleUtxo(w, watcher, param)
+	case "hash_mapping":
+		s.handleHashMapping(w, watcher, param)
+	case "confirm_height":
+		writeJSON(w, &confirmHeightResponse{
+			CoinType:          watcher.GetCoinType(),
+			ScanConfirmHeight: watcher.GetScanConfirmHeight(),
+		})
+	case "mortgage_txs":
+		writeJSON(w, watcher.GetRecentMortgageTxs())
+	case "rejected":
+		s.handleRejected(w, watcher, param)
+	case "refunds":
+		s.handleRefundList(w, r, watcher)
+	case "refund":
+		s.handleRefund(w, watcher, param)
+	case "consolidation":
+		writeJSON(w, watcher.GetConsolidationCandidates())
+	case "pending_deposits":
+		s.handlePendingDeposits(w, watcher, param)
+	case "deposits":
+		writeJSON(w, watcher.GetDepositRecords(r.URL.Query().Get("state")))
+	case "deposit":
+		s.handleDepositRecord(w, watcher, param)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (s *Server) handleUtxoList(w http.ResponseWriter, r *http.Request, watcher *mortgagewatcher.MortgageWatcher) {
+	var spendType *int
+	if value := r.URL.Query().Get("spend_type"); value != "" {
+		t, err := strconv.Atoi(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid spend_type"))
+			return
+		}
+		spendType = &t
+	}
+	writeJSON(w, watcher.GetUtxoList(spendType))
+}
+
+func (s *Server) handleUtxo(w http.ResponseWriter, watcher *mortgagewatcher.MortgageWatcher, utxoID string) {
+	utxoInfo := watcher.GetUtxo(utxoID)
+	if utxoInfo == nil {
+		writeError(w, http.StatusNotFound, errors.New("utxo not found"))
+		return
+	}
+	writeJSON(w, utxoInfo)
+}
+
+func (s *Server) handleHashMapping(w http.ResponseWriter, watcher *mortgagewatcher.MortgageWatcher, hashBeforeSign string) {
+	hashAfterSign, err := watcher.GetHashAfterSign(hashBeforeSign)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errors.New("hash mapping not found"))
+		return
+	}
+	writeJSON(w, &hashMappingResponse{
+		HashBeforeSign: hashBeforeSign,
+		HashAfterSign:  hashAfterSign,
+	})
+}
+
+func (s *Server) handleRejected(w http.ResponseWriter, watcher *mortgagewatcher.MortgageWatcher, scTxid string) {
+	if scTxid == "" {
+		writeJSON(w, watcher.GetRejectedDeposits())
+		return
+	}
+
+	rejected := watcher.GetRejectedDeposit(scTxid)
+	if rejected == nil {
+		writeError(w, http.StatusNotFound, errors.New("rejected deposit not found"))
+		return
+	}
+	writeJSON(w, rejected)
+}
+
+func (s *Server) handleRefundList(w http.ResponseWriter, r *http.Request, watcher *mortgagewatcher.MortgageWatcher) {
+	var status *int
+	if value := r.URL.Query().Get("status"); value != "" {
+		t, err := strconv.Atoi(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+			return
+		}
+		status = &t
+	}
+	writeJSON(w, watcher.GetRefundList(status))
+}
+
+func (s *Server) handleRefund(w http.ResponseWriter, watcher *mortgagewatcher.MortgageWatcher, scTxid string) {
+	refund := watcher.GetRefund(scTxid)
+	if refund == nil {
+		writeError(w, http.StatusNotFound, errors.New("refund not found"))
+		return
+	}
+	writeJSON(w, refund)
+}
+
+func (s *Server) handlePendingDeposits(w http.ResponseWriter, watcher *mortgagewatcher.MortgageWatcher, scTxid string) {
+	if scTxid == "" {
+		writeJSON(w, watcher.GetPendingDeposits())
+		return
+	}
+
+	pending := watcher.GetPendingDeposit(scTxid)
+	if pending == nil {
+		writeError(w, http.StatusNotFound, errors.New("pending deposit not found"))
+		return
+	}
+	writeJSON(w, pending)
+}
+
+func (s *Server) handleDepositRecord(w http.ResponseWriter, watcher *mortgagewatcher.MortgageWatcher, txid string) {
+	record := watcher.GetDepositRecord(txid)
+	if record == nil {
+		writeError(w, http.StatusNotFound, errors.New("deposit not found"))
+		return
+	}
+	writeJSON(w, record)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Warn("write http response failed", "err", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,217 @@
+package httpserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/JimmyHongjichuan/btc_watcher/dbop"
+	"github.com/JimmyHongjichuan/btc_watcher/mortgagewatcher"
+	"github.com/spf13/viper"
+)
+
+const (
+	//testRedeemScript 2-of-2多签兑现脚本，公钥为secp256k1的G和2G
+	testRedeemScript = "52210279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f817982102c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee552ae"
+	//testFederationAddress testRedeemScript对应的主网P2SH地址
+	testFederationAddress = "33RQmypKhD6f4tMquiR5a3C6dRT7eBpaiG"
+)
+
+//newTestServer 创建注册了btc监听的查询服务，监听从临时目录的leveldb中load数据，不连接全节点
+//leveldb中有一个已确认utxo(txid为64个1)、一个已花费utxo(txid为64个2)和一条交易hash映射
+func newTestServer(t *testing.T) (*Server, *mortgagewatcher.MortgageWatcher) {
+	dbPath := t.TempDir()
+	settings := map[string]interface{}{
+		"net_param":           "mainnet",
+		"LEVELDB.db_backend":  dbop.BackendLevelDB,
+		"LEVELDB.btc_db_path": dbPath,
+		"BTC.load_mode":       "leveldb",
+	}
+	for key, value := range settings {
+		old := viper.Get(key)
+		viper.Set(key, value)
+		t.Cleanup(func() {
+			viper.Set(key, old)
+		})
+	}
+
+	db, err := dbop.OpenDatabase(dbop.BackendLevelDB, dbPath)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	for i, spendType := range []int{1, 3} {
+		txid := strings.Repeat(string(rune('1'+i)), 64)
+		data, _ := json.Marshal(&coinmanager.UtxoInfo{
+			Address:     testFederationAddress,
+			Txid:        txid,
+			Value:       100000,
+			SpendType:   spendType,
+			BlockHeight: 100,
+		})
+		db.Put([]byte("btc_utxo_"+txid+"_0"), data)
+	}
+	db.Put([]byte("btc_hash_mapping_"+strings.Repeat("a", 64)), []byte(strings.Repeat("b", 64)))
+	db.Close()
+
+	redeemScript, _ := hex.DecodeString(testRedeemScript)
+	watcher, err := mortgagewatcher.NewMortgageWatcher("btc", 100, testFederationAddress, redeemScript, 60)
+	if err != nil {
+		t.Fatalf("create mortgage watcher: %v", err)
+	}
+	t.Cleanup(watcher.Stop)
+
+	s, err := NewServer("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	s.AddWatcher(watcher)
+	return s, watcher
+}
+
+//doRequest 请求path并返回状态码，状态码为200时将结果解析到v
+func doRequest(t *testing.T, s *Server, method string, path string, v interface{}) int {
+	req := httptest.NewRequest(method, path, nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: unmarshal %s: %v", path, rec.Body.String(), err)
+		}
+	}
+	if rec.Code != http.StatusOK {
+		resp := &errorResponse{}
+		if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil || resp.Error == "" {
+			t.Errorf("%s: got error body %s", path, rec.Body.String())
+		}
+	}
+	return rec.Code
+}
+
+func TestUtxoList(t *testing.T) {
+	s, _ := newTestServer(t)
+	confirmed := strings.Repeat("1", 64)
+	used := strings.Repeat("2", 64)
+
+	tests := []struct {
+		path   string
+		status int
+		txids  []string
+	}{
+		{"/btc/utxos", http.StatusOK, []string{confirmed, used}},
+		{"/btc/utxos?spend_type=1", http.StatusOK, []string{confirmed}},
+		{"/btc/utxos?spend_type=3", http.StatusOK, []string{used}},
+		{"/btc/utxos?spend_type=0", http.StatusOK, nil},
+		{"/btc/utxos?spend_type=x", http.StatusBadRequest, nil},
+		{"/bch/utxos", http.StatusNotFound, nil},
+	}
+	for _, test := range tests {
+		var utxos []*coinmanager.UtxoInfo
+		status := doRequest(t, s, http.MethodGet, test.path, &utxos)
+		if status != test.status {
+			t.Errorf("%s: got status %d, want %d", test.path, status, test.status)
+			continue
+		}
+		var txids []string
+		for _, utxo := range utxos {
+			txids = append(txids, utxo.Txid)
+		}
+		if strings.Join(txids, ",") != strings.Join(test.txids, ",") {
+			t.Errorf("%s: got utxos %v, want %v", test.path, txids, test.txids)
+		}
+	}
+}
+
+func TestUtxo(t *testing.T) {
+	s, _ := newTestServer(t)
+	utxoID := strings.Repeat("1", 64) + "_0"
+
+	var utxo coinmanager.UtxoInfo
+	if status := doRequest(t, s, http.MethodGet, "/btc/utxo/"+utxoID, &utxo); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if utxo.Txid != strings.Repeat("1", 64) || utxo.Value != 100000 || utxo.SpendType != 1 {
+		t.Errorf("got utxo %+v", utxo)
+	}
+
+	for _, path := range []string{"/btc/utxo/" + strings.Repeat("1", 64) + "_1", "/btc/utxo"} {
+		if status := doRequest(t, s, http.MethodGet, path, nil); status != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want 404", path, status)
+		}
+	}
+}
+
+func TestHashMapping(t *testing.T) {
+	s, _ := newTestServer(t)
+	hashBeforeSign := strings.Repeat("a", 64)
+
+	resp := &hashMappingResponse{}
+	if status := doRequest(t, s, http.MethodGet, "/btc/hash_mapping/"+hashBeforeSign, resp); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if resp.HashBeforeSign != hashBeforeSign || resp.HashAfterSign != strings.Repeat("b", 64) {
+		t.Errorf("got hash mapping %+v", resp)
+	}
+
+	if status := doRequest(t, s, http.MethodGet, "/btc/hash_mapping/"+strings.Repeat("c", 64), nil); status != http.StatusNotFound {
+		t.Errorf("got status %d for unknown hash, want 404", status)
+	}
+}
+
+func TestConfirmHeight(t *testing.T) {
+	s, watcher := newTestServer(t)
+
+	resp := &confirmHeightResponse{}
+	if status := doRequest(t, s, http.MethodGet, "/btc/confirm_height", resp); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if resp.CoinType != "btc" || resp.ScanConfirmHeight != watcher.GetScanConfirmHeight() {
+		t.Errorf("got confirm height %+v, want %d", resp, watcher.GetScanConfirmHeight())
+	}
+
+	//监听移除后查询返回unknown coin type
+	s.RemoveWatcher("btc")
+	if status := doRequest(t, s, http.MethodGet, "/btc/confirm_height", nil); status != http.StatusNotFound {
+		t.Errorf("got status %d after watcher removed, want 404", status)
+	}
+}
+
+func TestRecentMortgageTxs(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	//没有推送过抵押交易时返回空数组
+	var txs []*mortgagewatcher.SubTransaction
+	if status := doRequest(t, s, http.MethodGet, "/btc/mortgage_txs", &txs); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if txs == nil || len(txs) != 0 {
+		t.Errorf("got mortgage txs %v, want empty list", txs)
+	}
+}
+
+func TestServeHTTPErrors(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodPost, "/btc/utxos", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/", http.StatusNotFound},
+		{http.MethodGet, "/btc", http.StatusNotFound},
+		{http.MethodGet, "/btc/unknown", http.StatusNotFound},
+		{http.MethodGet, "/eth/utxos", http.StatusNotFound},
+		{http.MethodGet, "/btc/refunds?status=x", http.StatusBadRequest},
+		{http.MethodGet, "/btc/deposit/" + strings.Repeat("1", 64), http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if status := doRequest(t, s, test.method, test.path, nil); status != test.status {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.path, status, test.status)
+		}
+	}
+}
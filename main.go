@@ -1,21 +1,27 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
 
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/JimmyHongjichuan/btc_watcher/httpserver"
 	"github.com/JimmyHongjichuan/btc_watcher/log"
 	"github.com/JimmyHongjichuan/btc_watcher/mortgagewatcher"
 	"github.com/JimmyHongjichuan/btc_watcher/util"
 
 	"github.com/ofgp/ofgp-core/cluster"
 
-	"github.com/JimmyHongjichuan/btc_watcher/dgwdb"
+	"github.com/JimmyHongjichuan/btc_watcher/dbop"
 	"github.com/spf13/viper"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"syscall"
 	"path"
+	"sync"
+	"time"
 )
 var (
 	nodeLogger        = log.New(viper.GetString("loglevel"), "node")
@@ -26,8 +32,12 @@ func init() {
 	viper.SetDefault("LEVELDB.btc_db_path", dbPath)
 	dbPath = path.Join(homeDir, "bch_db")
 	viper.SetDefault("LEVELDB.bch_db_path", dbPath)
+	viper.SetDefault("LEVELDB.db_backend", dbop.BackendLevelDB)
 	viper.SetDefault("BTC.load_mode", "leveldb")
 	viper.SetDefault("BCH.load_mode", "leveldb")
+	viper.SetDefault("HTTP.listen", "127.0.0.1:8089")
+	viper.SetDefault("HTTP.local_only", true)
+	viper.SetDefault("BTC.address_type", coinmanager.FederationAddressP2SH)
 
 }
 
@@ -40,8 +50,14 @@ type MultiSigInfo struct {
 }
 
 var defaultUtxoLockTime = 60
+var watcherRetryInterval = 30
 
-func openDbOrDie(dbPath string) (db *dgwdb.LDBDatabase, newlyCreated bool) {
+//watchers 已启动的各条链监听 coinType -> *mortgagewatcher.MortgageWatcher
+var watchers sync.Map
+var startWg sync.WaitGroup
+var apiServer *httpserver.Server
+
+func openDbOrDie(dbPath string) (db dbop.Database, newlyCreated bool) {
 	if len(dbPath) == 0 {
 		homeDir, err := util.GetHomeDir()
 		if err != nil {
@@ -71,14 +87,14 @@ func openDbOrDie(dbPath string) (db *dgwdb.LDBDatabase, newlyCreated bool) {
 		}
 	}
 
-	db, err = dgwdb.NewLDBDatabase(dbPath, cluster.DbCache, cluster.DbFileHandles)
+	db, err = dbop.NewLDBDatabase(dbPath, cluster.DbCache, cluster.DbFileHandles)
 	if err != nil {
 		panic(fmt.Errorf("Failed to open database at %v", dbPath))
 	}
 	return
 }
 
-//func initWatchHeight(db *dgwdb.LDBDatabase) {
+//func initWatchHeight(db dbop.Database) {
 //	height := primitives.GetCurrentHeight(db, "bch")
 //	if height > 0 {
 //		viper.Set("DGW.bch_height", height)
@@ -89,6 +105,111 @@ func openDbOrDie(dbPath string) (db *dgwdb.LDBDatabase, newlyCreated bool) {
 //	}
 //}
 
+//getMultiSigInfo 从配置中读取多签地址和兑现脚本
+func getMultiSigInfo() (*MultiSigInfo, error) {
+	multiSig := new(MultiSigInfo)
+	multiSig.BtcAddress = viper.GetString("BTC.btc_multisig")
+	multiSig.BchAddress = viper.GetString("BCH.bch_multisig")
+
+	btcRedeemScript, err := hex.DecodeString(viper.GetString("BTC.btc_redeem_script"))
+	if err != nil {
+		return nil, fmt.Errorf("decode btc redeem script failed, err: %v", err)
+	}
+	multiSig.BtcRedeemScript = btcRedeemScript
+
+	//未配置多签地址时按address_type从兑现脚本生成，p2wsh为原生隔离见证多签
+	if multiSig.BtcAddress == "" && len(btcRedeemScript) > 0 {
+		multiSig.BtcAddress, err = coinmanager.NewFederationAddress(btcRedeemScript, "btc", viper.GetString("BTC.address_type"))
+		if err != nil {
+			return nil, fmt.Errorf("generate btc multisig address failed, err: %v", err)
+		}
+	}
+
+	bchRedeemScript, err := hex.DecodeString(viper.GetString("BCH.bch_redeem_script"))
+	if err != nil {
+		return nil, fmt.Errorf("decode bch redeem script failed, err: %v", err)
+	}
+	multiSig.BchRedeemScript = bchRedeemScript
+
+	return multiSig, nil
+}
+
+//startWatcher 创建并启动一条链的监听，失败时每隔watcherRetryInterval秒重试
+//监听运行中出错停止时(如区块提交失败)，停止后重新创建，从leveldb中最后一次提交的区块恢复
+//各条链在独立的goroutine中运行，一条链的RPC故障或panic不影响其他链
+func startWatcher(ctx context.Context, coinType string, height int64, address string, redeemScript []byte, utxoLockTime int) {
+	startWg.Add(1)
+	go func() {
+		defer startWg.Done()
+		for {
+			watcher, err := runWatcher(ctx, coinType, height, address, redeemScript, utxoLockTime)
+			if err == nil {
+				nodeLogger.Info("watcher started", "coinType", coinType, "address", address)
+				watchers.Store(coinType, watcher)
+				if apiServer != nil {
+					apiServer.AddWatcher(watcher)
+				}
+
+				select {
+				case <-watcher.Done():
+				case <-ctx.Done():
+					return
+				}
+				nodeLogger.Error("watcher failed, restart from leveldb", "coinType", coinType, "err", watcher.Err())
+				if apiServer != nil {
+					apiServer.RemoveWatcher(coinType)
+				}
+				watchers.Delete(coinType)
+				watcher.Stop()
+			} else {
+				nodeLogger.Error("start watcher failed", "coinType", coinType, "err", err)
+			}
+
+			select {
+			case <-time.After(time.Duration(watcherRetryInterval) * time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+//stopWatchers 停止所有已启动的监听，保存确认高度并关闭leveldb和RPC连接
+func stopWatchers() {
+	//等待启动和重启监听的goroutine退出，避免遗漏
+	startWg.Wait()
+
+	var wg sync.WaitGroup
+	watchers.Range(func(k, v interface{}) bool {
+		watcher := v.(*mortgagewatcher.MortgageWatcher)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watcher.Stop()
+			nodeLogger.Info("watcher stopped", "coinType", k)
+		}()
+		return true
+	})
+	wg.Wait()
+}
+
+//runWatcher 创建并启动监听，创建和启动过程中的panic转为错误返回
+//运行中各goroutine的panic由监听自身恢复，监听以错误停止并关闭Done，由startWatcher重新创建
+func runWatcher(ctx context.Context, coinType string, height int64, address string, redeemScript []byte, utxoLockTime int) (watcher *mortgagewatcher.MortgageWatcher, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("watcher panic: %v", r)
+		}
+	}()
+
+	watcher, err = mortgagewatcher.NewMortgageWatcher(coinType, height, address, redeemScript, utxoLockTime)
+	if err != nil {
+		return nil, err
+	}
+	watcher.Start(ctx)
+	return watcher, nil
+}
+
 func main() {
 	configFile := "./config.toml"
 	viper.SetConfigFile(configFile)
@@ -102,37 +223,47 @@ func main() {
 	}
 	*/
 	//initWatchHeight(db)
-	viper.Set("DGW.bch_height", 100);
-	// bchFederationAddress, bchRedeem, btcFederationAddress, btcRedeem := getFederationAddress()
-	multiSig := new(MultiSigInfo)
-	multiSig.BtcAddress = viper.GetString("BTC.btc_multisig")
-	multiSig.BtcRedeemScript = []byte(viper.GetString("BTC.btc_redeem_script"))
-	fmt.Sprintf("get multisig address", "btc", multiSig.BtcAddress, "bch", multiSig.BchAddress)
+	multiSig, err := getMultiSigInfo()
+	if err != nil {
+		panic(err.Error())
+	}
+	nodeLogger.Info("get multisig address", "btc", multiSig.BtcAddress, "bch", multiSig.BchAddress)
 
 	utxoLockTime := viper.GetInt("DGW.utxo_lock_time")
 	if utxoLockTime == 0 {
 		utxoLockTime = defaultUtxoLockTime
 	}
 
-	var (
-		btcWatcher *mortgagewatcher.MortgageWatcher
-		//bchWatcher *btcwatcher.MortgageWatcher
-		//ethWatcher *ew.Client
-		//xinWatcher *eoswatcher.EOSWatcher6
-		//eosWatcher *eoswatcher.EOSWatcherMain
-		err error
-	)
-
-	if len(viper.GetString("BTC.rpc_server")) > 0 {
-		btcWatcher, err = mortgagewatcher.NewMortgageWatcher("btc", viper.GetInt64("DGW.btc_height"),
-			multiSig.BtcAddress, multiSig.BtcRedeemScript, utxoLockTime)
+	if viper.GetBool("HTTP.enable") {
+		apiServer, err = httpserver.NewServer(viper.GetString("HTTP.listen"), viper.GetBool("HTTP.local_only"))
+		if err != nil {
+			panic(fmt.Sprintf("new http server failed, err: %v", err))
+		}
+		err = apiServer.Start()
 		if err != nil {
-			panic(fmt.Sprintf("new btc watcher failed, err: %v", err))
+			panic(fmt.Sprintf("start http server failed, err: %v", err))
 		}
 	}
-	btcWatcher.StartWatch()
-	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, syscall.SIGINT)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if len(viper.GetString("BTC.rpc_server")) > 0 && len(multiSig.BtcAddress) > 0 {
+		startWatcher(ctx, "btc", viper.GetInt64("DGW.btc_height"), multiSig.BtcAddress, multiSig.BtcRedeemScript, utxoLockTime)
+	}
+	if len(viper.GetString("BCH.rpc_server")) > 0 && len(multiSig.BchAddress) > 0 {
+		startWatcher(ctx, "bch", viper.GetInt64("DGW.bch_height"), multiSig.BchAddress, multiSig.BchRedeemScript, utxoLockTime)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-sigChan
 	fmt.Printf("receive signal %v\n", sig)
+
+	cancel()
+	if apiServer != nil {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		apiServer.Stop(stopCtx)
+		stopCancel()
+	}
+	stopWatchers()
 }
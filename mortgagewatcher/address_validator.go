@@ -0,0 +1,101 @@
+package mortgagewatcher
+
+import (
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"golang.org/x/crypto/sha3"
+)
+
+//ErrUnknownChain payload中的目标链没有注册地址校验
+var ErrUnknownChain = errors.New("unknown chain name")
+
+//AddressValidator 目标链地址校验函数，地址无效时返回error
+type AddressValidator func(address string) error
+
+var (
+	validatorLock     sync.RWMutex
+	addressValidators = make(map[string]AddressValidator)
+
+	ethAddressRegexp = regexp.MustCompile("^0x[0-9a-fA-F]{40}$")
+	eosAccountRegexp = regexp.MustCompile("^[a-z1-5.]{0,11}[a-z1-5]$|^[a-z1-5.]{12}[a-j1-5]$")
+)
+
+func init() {
+	RegisterAddressValidator("eth", validateEthAddress)
+	RegisterAddressValidator("eos", validateEosAccount)
+	RegisterAddressValidator("btc", func(address string) error {
+		return validateBitcoinAddress(address, "btc")
+	})
+	RegisterAddressValidator("bch", func(address string) error {
+		return validateBitcoinAddress(address, "bch")
+	})
+}
+
+//RegisterAddressValidator 注册目标链的地址校验，chainName与payload中的链名称一致，重复注册时覆盖
+func RegisterAddressValidator(chainName string, validator AddressValidator) {
+	validatorLock.Lock()
+	defer validatorLock.Unlock()
+	addressValidators[chainName] = validator
+}
+
+//ValidateAddress 校验地址是否为目标链的有效地址
+func ValidateAddress(chainName string, address string) error {
+	validatorLock.RLock()
+	validator, ok := addressValidators[chainName]
+	validatorLock.RUnlock()
+
+	if !ok {
+		return ErrUnknownChain
+	}
+	return validator(address)
+}
+
+//validateEthAddress 0x开头的40位16进制地址，大小写混合时按EIP-55校验
+func validateEthAddress(address string) error {
+	if !ethAddressRegexp.MatchString(address) {
+		return errors.New("invalid eth address: " + address)
+	}
+
+	hexAddr := address[2:]
+	if hexAddr == strings.ToLower(hexAddr) || hexAddr == strings.ToUpper(hexAddr) {
+		return nil
+	}
+
+	hash := sha3.NewLegacyKeccak256()
+	hash.Write([]byte(strings.ToLower(hexAddr)))
+	hashHex := hex.EncodeToString(hash.Sum(nil))
+	for i, c := range hexAddr {
+		if c >= '0' && c <= '9' {
+			continue
+		}
+		upper := hashHex[i] >= '8'
+		if upper != (c >= 'A' && c <= 'F') {
+			return errors.New("invalid eth address checksum: " + address)
+		}
+	}
+	return nil
+}
+
+//validateEosAccount eos账户名，1~12位a-z、1-5和'.'，不能以'.'结尾，第13位只能是a-j、1-5
+func validateEosAccount(address string) error {
+	if !eosAccountRegexp.MatchString(address) {
+		return errors.New("invalid eos account: " + address)
+	}
+	return nil
+}
+
+func validateBitcoinAddress(address string, coinType string) error {
+	addr, err := coinmanager.DecodeAddress(address, coinType)
+	if err != nil {
+		return err
+	}
+	if addr == nil {
+		return errors.New("invalid " + coinType + " address: " + address)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package mortgagewatcher
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestValidateAddress(t *testing.T) {
+	oldNetParam := viper.GetString("net_param")
+	viper.Set("net_param", "mainnet")
+	defer viper.Set("net_param", oldNetParam)
+
+	tests := []struct {
+		chainName string
+		address   string
+		valid     bool
+	}{
+		//EIP-55
+		{"eth", "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", true},
+		{"eth", "0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359", true},
+		{"eth", "0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB", true},
+		{"eth", "0xD1220A0cf47c7B9Be7A2E6BA89F429762e7b9aDb", true},
+		{"eth", "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", true},
+		{"eth", "0x5AAEB6053F3E94C9B9A09F33669435E7EF1BEAED", true},
+		{"eth", "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD", false}, //校验和错误
+		{"eth", "5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", false},   //没有0x前缀
+		{"eth", "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeA", false},   //长度错误
+		{"eth", "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeg", false}, //非16进制字符
+		//eos
+		{"eos", "eosio", true},
+		{"eos", "eosio.token", true},
+		{"eos", "a", true},
+		{"eos", "abcdefghijkl", true},
+		{"eos", "abcdefghijklj", true},
+		{"eos", "abcdefghijklk", false}, //第13位超出a-j
+		{"eos", "abcdefghijklmn", false},
+		{"eos", "eosio.", false},
+		{"eos", "EOSIO", false},
+		{"eos", "eos6", false},
+		{"eos", "", false},
+		//btc
+		{"btc", "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", true},
+		{"btc", "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy", true},
+		{"btc", "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", true},
+		{"btc", "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", true},
+		{"btc", "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN3", false},         //校验和错误
+		{"btc", "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", false}, //测试网地址
+		{"btc", "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", false},
+	}
+
+	for _, test := range tests {
+		err := ValidateAddress(test.chainName, test.address)
+		if test.valid && err != nil {
+			t.Errorf("%s %s: unexpected error: %v", test.chainName, test.address, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s %s: expected error", test.chainName, test.address)
+		}
+	}
+}
+
+func TestRegisterAddressValidator(t *testing.T) {
+	if err := ValidateAddress("xin", "anything"); err != ErrUnknownChain {
+		t.Errorf("got err %v for unregistered chain, want ErrUnknownChain", err)
+	}
+
+	RegisterAddressValidator("xin", func(address string) error {
+		if address != "valid" {
+			return errors.New("invalid xin address")
+		}
+		return nil
+	})
+	defer func() {
+		validatorLock.Lock()
+		delete(addressValidators, "xin")
+		validatorLock.Unlock()
+	}()
+
+	if err := ValidateAddress("xin", "valid"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := ValidateAddress("xin", "other"); err == nil {
+		t.Error("expected error from registered validator")
+	}
+}
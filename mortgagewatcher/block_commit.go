@@ -0,0 +1,189 @@
+package mortgagewatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/JimmyHongjichuan/btc_watcher/dbop"
+	"github.com/btcsuite/btcd/btcjson"
+	log "github.com/inconshreveable/log15"
+)
+
+var defaultCommitRetryInterval = 1
+var defaultCommitRetryTimes = 3
+
+//dbWriter 读写接口，区块处理中为区块批次，其他情况直接读写leveldb
+type dbWriter interface {
+	Get(key []byte) ([]byte, error)
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+}
+
+//blockCommit 处理一个区块期间的全部写入，区块处理完后与确认高度一起一次写入leveldb
+//只在处理区块的goroutine中使用，其他goroutine直接写入leveldb
+type blockCommit struct {
+	db    dbop.Database
+	batch dbop.Batch
+	//区块内已写入的数据，值为nil表示已删除，用于区块处理中读取未提交的数据
+	writes map[string][]byte
+	//区块内推送的outbox条目，提交后才分发
+	outbox []*outboxEntry
+	//区块内对最近抵押交易列表的修改，提交后才生效
+	recent []*outboxEntry
+}
+
+func newBlockCommit(db dbop.Database) *blockCommit {
+	return &blockCommit{
+		db:     db,
+		batch:  db.NewBatch(),
+		writes: make(map[string][]byte),
+	}
+}
+
+//Get 读取数据，优先读取批次中尚未提交的写入，遍历前缀时只能读取到已提交的数据
+func (bc *blockCommit) Get(key []byte) ([]byte, error) {
+	if value, ok := bc.writes[string(key)]; ok {
+		if value == nil {
+			return nil, dbop.ErrNotFound
+		}
+		return value, nil
+	}
+	return bc.db.Get(key)
+}
+
+//Put 写入批次
+func (bc *blockCommit) Put(key []byte, value []byte) error {
+	bc.batch.Put(key, value)
+	bc.writes[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+//Delete 从批次中删除
+func (bc *blockCommit) Delete(key []byte) error {
+	bc.batch.Delete(key)
+	bc.writes[string(key)] = nil
+	return nil
+}
+
+//blockCommitRecord 最后一个已处理的确认区块，与区块的全部修改在同一批次写入
+//回退区块后记录为回退区块的父区块
+type blockCommitRecord struct {
+	Height        int64  `json:"height"`
+	Hash          string `json:"hash"`
+	ConfirmHeight int64  `json:"confirm_height"`
+}
+
+func getBlockCommitKey(coinType string) []byte {
+	return []byte(strings.Join([]string{coinType, "commit"}, "_"))
+}
+
+//loadBlockCommit 读取最后一次提交的区块记录，不存在时返回nil
+func loadBlockCommit(db dbop.Database, coinType string) *blockCommitRecord {
+	data, err := db.Get(getBlockCommitKey(coinType))
+	if err != nil || data == nil {
+		return nil
+	}
+
+	record := &blockCommitRecord{}
+	err = json.Unmarshal(data, record)
+	if err != nil {
+		log.Warn("Unmarshal block commit failed", "err", err.Error(), "coinType", coinType)
+		return nil
+	}
+	return record
+}
+
+//commitBlock 将区块处理期间的写入、区块记录和新的确认高度一次写入，保证区块要么全部生效要么全部不生效
+//重试defaultCommitRetryTimes次仍失败时内存中的状态已与leveldb不一致，监听以错误停止，由调用方重新创建后从leveldb恢复
+func (m *MortgageWatcher) commitBlock(bc *blockCommit, record *blockCommitRecord) bool {
+	data, err := json.Marshal(record)
+	if err != nil {
+		m.fail(fmt.Errorf("marshal block commit failed: %v", err))
+		return false
+	}
+	bc.Put(getBlockCommitKey(m.coinType), data)
+	bc.Put([]byte(confirmHeightLDKey), []byte(strconv.Itoa(int(record.ConfirmHeight))))
+
+	for i := 0; ; i++ {
+		err = bc.batch.Write()
+		if err == nil {
+			break
+		}
+		log.Error("commit block failed", "err", err.Error(), "height", record.Height, "hash", record.Hash, "coinType", m.coinType)
+		if i+1 >= defaultCommitRetryTimes || !m.sleep(time.Duration(defaultCommitRetryInterval)*time.Second) {
+			m.fail(fmt.Errorf("commit block %d %s failed: %v", record.Height, record.Hash, err))
+			return false
+		}
+	}
+
+	for _, entry := range bc.outbox {
+		m.outbox.Store(entry.id(), entry)
+	}
+	for _, entry := range bc.recent {
+		m.applyRecentMortgageTx(entry)
+	}
+	log.Debug("commit block", "height", record.Height, "hash", record.Hash, "writes", bc.batch.Len(), "coinType", m.coinType)
+	return true
+}
+
+//recoverCommittedBlock 检查最后提交的区块是否仍在主链上，停机期间发生回退时逐个撤销已不在主链上的区块
+func (m *MortgageWatcher) recoverCommittedBlock() error {
+	for {
+		commit := loadBlockCommit(m.levelDb, m.coinType)
+		if commit == nil || commit.Hash == "" {
+			return nil
+		}
+
+		blockCount := m.bwClient.GetBlockCount()
+		if blockCount < 0 {
+			return fmt.Errorf("get block count failed")
+		}
+		if commit.Height <= blockCount {
+			hash, err := m.bwClient.GetBlockHash(commit.Height)
+			if err != nil {
+				return err
+			}
+			if hash == commit.Hash {
+				return nil
+			}
+		}
+
+		undo := m.loadBlockUndo(commit.Hash)
+		if undo == nil {
+			return fmt.Errorf("committed block %d %s not in main chain and no undo data", commit.Height, commit.Hash)
+		}
+		log.Warn("committed block not in main chain, disconnect", "height", commit.Height, "hash", commit.Hash,
+			"blockCount", blockCount, "coinType", m.coinType)
+		m.handleDisconnectBlock(&coinmanager.BlockData{
+			BlockInfo: &btcjson.GetBlockVerboseResult{
+				Height: undo.Height,
+				Hash:   undo.Hash,
+			},
+		})
+		if err := m.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+//storeOutboxEntry 保存outbox条目等待分发，区块处理中推送的条目在区块提交后才分发
+func (m *MortgageWatcher) storeOutboxEntry(db dbWriter, entry *outboxEntry) {
+	if bc, ok := db.(*blockCommit); ok {
+		bc.outbox = append(bc.outbox, entry)
+		return
+	}
+	m.outbox.Store(entry.id(), entry)
+}
+
+//updateRecentMortgageTx 更新最近推送的抵押交易列表，区块处理中的修改在区块提交后才生效
+func (m *MortgageWatcher) updateRecentMortgageTx(db dbWriter, entry *outboxEntry) {
+	if bc, ok := db.(*blockCommit); ok {
+		bc.recent = append(bc.recent, entry)
+		return
+	}
+	m.applyRecentMortgageTx(entry)
+}
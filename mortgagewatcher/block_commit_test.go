@@ -0,0 +1,148 @@
+package mortgagewatcher
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/JimmyHongjichuan/btc_watcher/dbop"
+)
+
+//failBatchDatabase 批量写入总是失败的存储
+type failBatchDatabase struct {
+	dbop.Database
+}
+
+func (db *failBatchDatabase) NewBatch() dbop.Batch {
+	return &failBatch{Batch: db.Database.NewBatch()}
+}
+
+type failBatch struct {
+	dbop.Batch
+}
+
+func (b *failBatch) Write() error {
+	return errors.New("disk full")
+}
+
+func TestBlockCommitReadsPendingWrites(t *testing.T) {
+	db := dbop.NewMemDatabase()
+	defer db.Close()
+	db.Put([]byte("btc_a"), []byte("a"))
+	db.Put([]byte("btc_b"), []byte("b"))
+
+	bc := newBlockCommit(db)
+	bc.Put([]byte("btc_a"), []byte("a2"))
+	bc.Put([]byte("btc_c"), []byte("c"))
+	bc.Delete([]byte("btc_b"))
+
+	//批次内读取未提交的写入，提交前存储中不可见
+	tests := []struct {
+		key      string
+		batch    string
+		database string
+	}{
+		{"btc_a", "a2", "a"},
+		{"btc_b", "", "b"},
+		{"btc_c", "c", ""},
+	}
+	for _, test := range tests {
+		value, err := bc.Get([]byte(test.key))
+		if string(value) != test.batch || (test.batch == "" && err != dbop.ErrNotFound) {
+			t.Errorf("%s: got %q err %v from batch, want %q", test.key, value, err, test.batch)
+		}
+		value, err = db.Get([]byte(test.key))
+		if string(value) != test.database || (test.database == "" && err != dbop.ErrNotFound) {
+			t.Errorf("%s: got %q err %v from database, want %q", test.key, value, err, test.database)
+		}
+	}
+
+	if err := bc.batch.Write(); err != nil {
+		t.Fatalf("write batch: %v", err)
+	}
+	for _, test := range tests {
+		value, _ := db.Get([]byte(test.key))
+		if string(value) != test.batch {
+			t.Errorf("%s: got %q after write, want %q", test.key, value, test.batch)
+		}
+	}
+}
+
+func TestCommitBlockWritesStateAndRecord(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	deposit := newTestDepositTx(t, 1, 100000, newTestPayload(t, 1))
+	scTxid := deposit.TxHash().String()
+	block := newTestBlock(100, nil, deposit)
+	mw.handleConfirmBlock(block)
+
+	commit := loadBlockCommit(mw.levelDb, "btc")
+	if commit == nil || commit.Height != 100 || commit.Hash != block.BlockInfo.Hash || commit.ConfirmHeight != 101 {
+		t.Fatalf("got block commit %+v", commit)
+	}
+	if value, err := mw.levelDb.Get([]byte(confirmHeightLDKey)); err != nil || string(value) != "101" {
+		t.Errorf("got confirm height %q err %v, want 101", value, err)
+	}
+
+	//重启后从leveldb恢复区块中写入的utxo和outbox
+	restarted := newTestMortgageWatcher(t, "btc")
+	restarted.levelDb = mw.levelDb
+	restarted.loadUtxoFromLevelDb()
+	restarted.loadOutbox()
+	if utxo := restarted.GetUtxo(testUtxoID(deposit, 0)); utxo == nil || utxo.SpendType != 1 || utxo.Value != 100000 {
+		t.Errorf("got utxo %+v after restart", utxo)
+	}
+	if entry := restarted.nextUndeliveredEntry(0); entry == nil || entry.id() != scTxid {
+		t.Errorf("got outbox entry %+v after restart, want %s", entry, scTxid)
+	}
+	if record := restarted.GetDepositRecord(scTxid); record == nil || record.State != DepositStateEmitted {
+		t.Errorf("got deposit record %+v after restart, want emitted", record)
+	}
+}
+
+func TestCommitBlockFailure(t *testing.T) {
+	oldRetryTimes := defaultCommitRetryTimes
+	defaultCommitRetryTimes = 1
+	defer func() {
+		defaultCommitRetryTimes = oldRetryTimes
+	}()
+
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.scanConfirmHeight = 100
+	mw.levelDb = &failBatchDatabase{Database: mw.levelDb}
+
+	deposit := newTestDepositTx(t, 1, 100000, newTestPayload(t, 1))
+	scTxid := deposit.TxHash().String()
+	mw.handleConfirmBlock(newTestBlock(100, nil, deposit))
+
+	//提交失败时区块的修改都不写入，监听以错误停止
+	if mw.Err() == nil {
+		t.Fatal("watcher should fail after block commit failure")
+	}
+	if commit := loadBlockCommit(mw.levelDb, "btc"); commit != nil {
+		t.Errorf("got block commit %+v after failure", commit)
+	}
+	if _, err := mw.levelDb.Get([]byte(confirmHeightLDKey)); err != dbop.ErrNotFound {
+		t.Errorf("got confirm height err %v after failure, want ErrNotFound", err)
+	}
+	if utxos := mw.GetUtxoList(nil); len(utxos) != 0 {
+		t.Errorf("got utxos %v in leveldb after failure", utxos)
+	}
+	if record := mw.GetDepositRecord(scTxid); record != nil {
+		t.Errorf("got deposit record %+v after failure", record)
+	}
+	if entry := mw.nextUndeliveredEntry(0); entry != nil {
+		t.Errorf("got outbox entry %s after failure, want none", entry.id())
+	}
+	if txs := mw.GetRecentMortgageTxs(); len(txs) != 0 {
+		t.Errorf("got recent mortgage txs %v after failure, want none", txs)
+	}
+	if mw.GetScanConfirmHeight() != 100 {
+		t.Errorf("got scan confirm height %d after failure, want 100", mw.GetScanConfirmHeight())
+	}
+
+	//停止后不再处理区块
+	mw.levelDb = mw.levelDb.(*failBatchDatabase).Database
+	mw.handleConfirmBlock(newTestBlock(101, nil, newTestDepositTx(t, 2, 100000, nil)))
+	if commit := loadBlockCommit(mw.levelDb, "btc"); commit != nil {
+		t.Errorf("got block commit %+v after watcher failed", commit)
+	}
+}
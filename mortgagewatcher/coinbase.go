@@ -0,0 +1,31 @@
+package mortgagewatcher
+
+import (
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	log "github.com/inconshreveable/log15"
+)
+
+var defaultCoinbaseConfirmNum int64 = 100
+
+//isCoinbaseMature 处理到confirmHeight高度的已确认区块时，blockHeight高度的coinbase是否已经成熟
+func (m *MortgageWatcher) isCoinbaseMature(blockHeight int64, confirmHeight int64) bool {
+	return m.getConfirmations(blockHeight, confirmHeight) >= m.coinbaseConfirmNum
+}
+
+//matureCoinbase 将已成熟的coinbase utxo改为已确认，coinbase中的抵押交易按确认数延迟推送
+//undo为nil时(从链上加载utxo)不记录回退信息
+func (m *MortgageWatcher) matureCoinbase(db dbWriter, confirmHeight int64, undo *blockUndo) {
+	m.faUtxoInfo.Range(func(k, v interface{}) bool {
+		utxoInfo := v.(*coinmanager.UtxoInfo)
+		if utxoInfo.SpendType != 4 || !m.isCoinbaseMature(utxoInfo.BlockHeight, confirmHeight) {
+			return true
+		}
+		if undo != nil {
+			undo.saveUtxoState(utxoInfo)
+		}
+		utxoInfo.SpendType = 1
+		m.storeUtxo(db, k.(string))
+		log.Info("coinbase utxo mature", "id", k.(string), "value", utxoInfo.Value, "coinType", m.coinType)
+		return true
+	})
+}
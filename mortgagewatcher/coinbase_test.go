@@ -0,0 +1,93 @@
+package mortgagewatcher
+
+import (
+	"testing"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+//newTestCoinbaseTx 生成转入多签地址的coinbase交易
+func newTestCoinbaseTx(t *testing.T, amount int64, payload []byte) *wire.MsgTx {
+	pkScript, err := coinmanager.PayToAddrScript(testFederationAddress, "btc")
+	if err != nil {
+		t.Fatalf("build federation pk script: %v", err)
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{0x01, 0x64}, nil))
+	tx.AddTxOut(wire.NewTxOut(amount, pkScript))
+	tx.AddTxOut(wire.NewTxOut(0, payload))
+	return tx
+}
+
+func TestCoinbaseMature(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.coinbaseConfirmNum = 3
+	coinbase := newTestCoinbaseTx(t, 100000, newTestPayload(t, 1))
+	scTxid := coinbase.TxHash().String()
+	utxoID := testUtxoID(coinbase, 0)
+
+	//处理到102高度时coinbase达到3个确认
+	blocks := []*coinmanager.BlockData{newTestBlock(100, nil, coinbase)}
+	blocks = append(blocks, newTestBlock(101, blocks[0]))
+	blocks = append(blocks, newTestBlock(102, blocks[1]))
+	for _, block := range blocks[:2] {
+		mw.handleConfirmBlock(block)
+		if utxo := mw.GetUtxo(utxoID); utxo == nil || utxo.SpendType != 4 || !utxo.Coinbase {
+			t.Fatalf("height %d: got utxo %+v, want immature coinbase", block.BlockInfo.Height, utxo)
+		}
+		if _, err := mw.SelectUtxo(1); err != ErrInsufficientUtxo {
+			t.Errorf("height %d: got err %v selecting immature coinbase, want ErrInsufficientUtxo", block.BlockInfo.Height, err)
+		}
+		if entry := mw.nextUndeliveredEntry(0); entry != nil {
+			t.Errorf("height %d: got mortgage tx %s before coinbase mature", block.BlockInfo.Height, entry.id())
+		}
+		if pending := mw.GetPendingDeposit(scTxid); pending == nil || pending.RequiredConfirmations != 3 {
+			t.Errorf("height %d: got pending deposit %+v", block.BlockInfo.Height, pending)
+		}
+	}
+
+	mw.handleConfirmBlock(blocks[2])
+	if utxo := mw.GetUtxo(utxoID); utxo == nil || utxo.SpendType != 1 {
+		t.Fatalf("got utxo %+v after mature, want confirmed", utxo)
+	}
+	utxos, err := mw.SelectUtxo(1)
+	if err != nil || len(utxos) != 1 || getUtxoID(utxos[0]) != utxoID {
+		t.Errorf("got utxos %v err %v after mature, want %s", utxos, err, utxoID)
+	}
+	mw.UnlockUtxo([]string{utxoID})
+	if entry := mw.nextUndeliveredEntry(0); entry == nil || entry.id() != scTxid {
+		t.Fatalf("got mortgage tx %v after mature, want %s", entry, scTxid)
+	}
+	if mw.GetPendingDeposit(scTxid) != nil {
+		t.Error("pending deposit not deleted after mature")
+	}
+	if record := mw.GetDepositRecord(scTxid); record == nil || record.State != DepositStateEmitted {
+		t.Errorf("got deposit record %+v after mature, want emitted", record)
+	}
+
+	//成熟的区块回退后coinbase恢复为未成熟，抵押交易撤回并重新等待确认
+	mw.handleDisconnectBlock(blocks[2])
+	if utxo := mw.GetUtxo(utxoID); utxo == nil || utxo.SpendType != 4 {
+		t.Fatalf("got utxo %+v after disconnect, want immature coinbase", utxo)
+	}
+	if _, err := mw.SelectUtxo(1); err != ErrInsufficientUtxo {
+		t.Errorf("got err %v selecting coinbase after disconnect, want ErrInsufficientUtxo", err)
+	}
+	if entry := mw.nextUndeliveredEntry(0); entry == nil || !entry.Retract || entry.Tx.ScTxid != scTxid {
+		t.Errorf("got outbox entry %+v after disconnect, want retract of %s", entry, scTxid)
+	}
+	if pending := mw.GetPendingDeposit(scTxid); pending == nil {
+		t.Error("pending deposit not restored after disconnect")
+	}
+	if record := mw.GetDepositRecord(scTxid); record == nil || record.State != DepositStateConfirmed {
+		t.Errorf("got deposit record %+v after disconnect, want confirmed", record)
+	}
+
+	//重新连接后再次成熟
+	mw.handleConfirmBlock(blocks[2])
+	if utxo := mw.GetUtxo(utxoID); utxo == nil || utxo.SpendType != 1 {
+		t.Errorf("got utxo %+v after reconnect, want confirmed", utxo)
+	}
+}
@@ -0,0 +1,142 @@
+package mortgagewatcher
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/spf13/viper"
+)
+
+//confirmTier 按金额分级的确认数，抵押金额不小于MinAmount时至少需要ConfirmNum个确认
+type confirmTier struct {
+	MinAmount  int64 `mapstructure:"min_amount"`
+	ConfirmNum int64 `mapstructure:"confirm_block_num"`
+}
+
+//PendingDeposit 确认数不足的抵押交易，达到所需确认数后推送
+type PendingDeposit struct {
+	BlockHeight           int64           `json:"block_height"`
+	RequiredConfirmations int64           `json:"required_confirmations"`
+	Confirmations         int64           `json:"confirmations"`
+	Tx                    *SubTransaction `json:"tx"`
+}
+
+//loadConfirmPolicy 读取确认数策略，section为BTC/BCH
+//confirm_block_num是所有抵押交易的最小确认数，confirm_policy按金额分级、app_confirm_block_num按APPNumber设置更多的确认数
+func (m *MortgageWatcher) loadConfirmPolicy(section string) {
+	err := viper.UnmarshalKey(section+".confirm_policy", &m.confirmTiers)
+	if err != nil {
+		log.Warn("invalid confirm_policy", "err", err.Error(), "coinType", m.coinType)
+	}
+
+	m.appConfirmNum = make(map[uint32]int64)
+	for key := range viper.GetStringMap(section + ".app_confirm_block_num") {
+		appNumber, err := strconv.ParseUint(key, 10, 32)
+		if err != nil {
+			log.Warn("invalid app number in app_confirm_block_num", "app_number", key, "coinType", m.coinType)
+			continue
+		}
+		m.appConfirmNum[uint32(appNumber)] = viper.GetInt64(section + ".app_confirm_block_num." + key)
+	}
+}
+
+//getRequiredConfirmNum 获取抵押交易推送所需的确认数，取各项策略中的最大值
+func (m *MortgageWatcher) getRequiredConfirmNum(tx *SubTransaction, isCoinbase bool) int64 {
+	required := m.confirmNum
+	for _, tier := range m.confirmTiers {
+		if tx.Amount >= tier.MinAmount && tier.ConfirmNum > required {
+			required = tier.ConfirmNum
+		}
+	}
+	if confirmNum, ok := m.appConfirmNum[tx.TokenTo]; ok && confirmNum > required {
+		required = confirmNum
+	}
+	if isCoinbase && m.coinbaseConfirmNum > required {
+		required = m.coinbaseConfirmNum
+	}
+	return required
+}
+
+//getConfirmations 处理到confirmHeight高度的已确认区块时，blockHeight高度区块的确认数
+//已确认区块比最新区块落后confirmNum-1个区块
+func (m *MortgageWatcher) getConfirmations(blockHeight int64, confirmHeight int64) int64 {
+	return confirmHeight - blockHeight + m.confirmNum
+}
+
+func (m *MortgageWatcher) getPendingDepositKey(scTxid string) []byte {
+	return []byte(strings.Join([]string{m.levelDbPendingPreFix, scTxid}, "_"))
+}
+
+//releasePendingDeposits 推送已达到所需确认数的抵押交易
+func (m *MortgageWatcher) releasePendingDeposits(db dbWriter, confirmHeight int64, undo *blockUndo) {
+	for _, pending := range m.GetPendingDeposits() {
+		if m.getConfirmations(pending.BlockHeight, confirmHeight) < pending.RequiredConfirmations {
+			continue
+		}
+		log.Info("push pending mortgage tx", "scTxid", pending.Tx.ScTxid, "confirmations", pending.RequiredConfirmations, "coinType", m.coinType)
+		m.pushMortgageTx(db, pending.Tx)
+		m.deletePendingDeposit(db, pending.Tx.ScTxid)
+		undo.ReleasedTxs = append(undo.ReleasedTxs, pending)
+		m.updateDepositState(db, pending.Tx.ScTxid, DepositStateEmitted, confirmHeight, "", nil)
+	}
+}
+
+func (m *MortgageWatcher) storePendingDeposit(db dbWriter, pending *PendingDeposit) bool {
+	data, err := json.Marshal(pending)
+	if err != nil {
+		log.Warn("Marshal pending deposit failed", "err", err.Error(), "coinType", m.coinType)
+		return false
+	}
+	err = db.Put(m.getPendingDepositKey(pending.Tx.ScTxid), data)
+	if err != nil {
+		log.Warn("save pending deposit failed", "err", err.Error(), "scTxid", pending.Tx.ScTxid, "coinType", m.coinType)
+		return false
+	}
+	return true
+}
+
+func (m *MortgageWatcher) deletePendingDeposit(db dbWriter, scTxid string) {
+	err := db.Delete(m.getPendingDepositKey(scTxid))
+	if err != nil {
+		log.Warn("delete pending deposit failed", "err", err.Error(), "scTxid", scTxid, "coinType", m.coinType)
+	}
+}
+
+//GetPendingDeposit 查询确认数不足的抵押交易及当前确认数，不存在时返回nil
+func (m *MortgageWatcher) GetPendingDeposit(scTxid string) *PendingDeposit {
+	data, err := m.levelDb.Get(m.getPendingDepositKey(scTxid))
+	if err != nil || data == nil {
+		return nil
+	}
+
+	pending := &PendingDeposit{}
+	err = json.Unmarshal(data, pending)
+	if err != nil || pending.Tx == nil {
+		log.Warn("Unmarshal pending deposit failed", "scTxid", scTxid, "coinType", m.coinType)
+		return nil
+	}
+	pending.Confirmations = m.getConfirmations(pending.BlockHeight, m.GetScanConfirmHeight()-1)
+	return pending
+}
+
+//GetPendingDeposits 查询所有确认数不足的抵押交易及当前确认数
+func (m *MortgageWatcher) GetPendingDeposits() []*PendingDeposit {
+	var pendingList []*PendingDeposit
+	confirmHeight := m.GetScanConfirmHeight() - 1
+
+	iter := m.levelDb.NewIteratorWithPrefix([]byte(m.levelDbPendingPreFix + "_"))
+	defer iter.Release()
+	for iter.Next() {
+		pending := &PendingDeposit{}
+		err := json.Unmarshal(iter.Value(), pending)
+		if err != nil || pending.Tx == nil {
+			log.Warn("Unmarshal pending deposit failed", "key", string(iter.Key()), "coinType", m.coinType)
+			continue
+		}
+		pending.Confirmations = m.getConfirmations(pending.BlockHeight, confirmHeight)
+		pendingList = append(pendingList, pending)
+	}
+	return pendingList
+}
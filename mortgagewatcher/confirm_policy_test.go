@@ -0,0 +1,129 @@
+package mortgagewatcher
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetRequiredConfirmNum(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.confirmNum = 2
+	mw.coinbaseConfirmNum = 100
+	mw.confirmTiers = []*confirmTier{
+		{MinAmount: 100000, ConfirmNum: 3},
+		{MinAmount: 1000000, ConfirmNum: 6},
+	}
+	mw.appConfirmNum = map[uint32]int64{7: 4, 8: 1}
+
+	tests := []struct {
+		name     string
+		amount   int64
+		app      uint32
+		coinbase bool
+		expected int64
+	}{
+		{"base", 1000, 1, false, 2},
+		{"first tier", 100000, 1, false, 3},
+		{"second tier", 5000000, 1, false, 6},
+		{"app above tier", 100000, 7, false, 4},
+		{"tier above app", 1000000, 7, false, 6},
+		{"app below base", 1000, 8, false, 2},
+		{"coinbase", 1000, 1, true, 100},
+	}
+
+	for _, test := range tests {
+		tx := &SubTransaction{Amount: test.amount, TokenTo: test.app}
+		if required := mw.getRequiredConfirmNum(tx, test.coinbase); required != test.expected {
+			t.Errorf("%s: got %d, want %d", test.name, required, test.expected)
+		}
+	}
+}
+
+func TestLoadConfirmPolicy(t *testing.T) {
+	viper.Set("CONFIRM_TEST.confirm_policy", []map[string]interface{}{
+		{"min_amount": 100000, "confirm_block_num": 3},
+		{"min_amount": 1000000, "confirm_block_num": 6},
+	})
+	viper.Set("CONFIRM_TEST.app_confirm_block_num", map[string]interface{}{"7": 4, "bad": 9})
+	defer viper.Set("CONFIRM_TEST", nil)
+
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.loadConfirmPolicy("CONFIRM_TEST")
+
+	if len(mw.confirmTiers) != 2 {
+		t.Fatalf("got %d confirm tiers, want 2", len(mw.confirmTiers))
+	}
+	if mw.confirmTiers[0].MinAmount != 100000 || mw.confirmTiers[0].ConfirmNum != 3 ||
+		mw.confirmTiers[1].MinAmount != 1000000 || mw.confirmTiers[1].ConfirmNum != 6 {
+		t.Errorf("got confirm tiers %+v %+v", mw.confirmTiers[0], mw.confirmTiers[1])
+	}
+	if len(mw.appConfirmNum) != 1 || mw.appConfirmNum[7] != 4 {
+		t.Errorf("got app confirm num %v, want map[7:4]", mw.appConfirmNum)
+	}
+}
+
+func TestPendingDepositReleasedAtRequiredConfirmations(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.appConfirmNum = map[uint32]int64{7: 3}
+
+	deposit := newTestDepositTx(t, 1, 100000, newTestPayload(t, 7))
+	scTxid := deposit.TxHash().String()
+	block := newTestBlock(100, nil, deposit)
+	mw.handleConfirmBlock(block)
+
+	//confirmNum为1，处理到102高度时达到3个确认
+	for height := int64(101); height <= 102; height++ {
+		pending := mw.GetPendingDeposit(scTxid)
+		if pending == nil || pending.RequiredConfirmations != 3 || pending.Confirmations != height-100 {
+			t.Fatalf("height %d: got pending deposit %+v", height, pending)
+		}
+		if entry := mw.nextUndeliveredEntry(0); entry != nil {
+			t.Fatalf("height %d: mortgage tx %s pushed before required confirmations", height, entry.id())
+		}
+		block = newTestBlock(height, block)
+		mw.handleConfirmBlock(block)
+	}
+
+	if pending := mw.GetPendingDeposit(scTxid); pending != nil {
+		t.Errorf("got pending deposit %+v after required confirmations", pending)
+	}
+	entry := mw.nextUndeliveredEntry(0)
+	if entry == nil || entry.id() != scTxid || entry.Tx.TokenTo != 7 || entry.Tx.Amount != 100000 {
+		t.Fatalf("got outbox entry %+v, want mortgage tx %s", entry, scTxid)
+	}
+	if record := mw.GetDepositRecord(scTxid); record == nil || record.State != DepositStateEmitted {
+		t.Errorf("got deposit record %+v, want emitted", record)
+	}
+}
+
+func TestPendingDepositRestoredOnDisconnect(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.appConfirmNum = map[uint32]int64{7: 2}
+
+	deposit := newTestDepositTx(t, 1, 100000, newTestPayload(t, 7))
+	scTxid := deposit.TxHash().String()
+	block1 := newTestBlock(100, nil, deposit)
+	mw.handleConfirmBlock(block1)
+	block2 := newTestBlock(101, block1)
+	mw.handleConfirmBlock(block2)
+	if mw.GetPendingDeposit(scTxid) != nil {
+		t.Fatal("pending deposit not released at required confirmations")
+	}
+
+	//推送所在区块回退后重新等待确认，未分发的抵押交易直接删除
+	mw.handleDisconnectBlock(block2)
+	pending := mw.GetPendingDeposit(scTxid)
+	if pending == nil || pending.RequiredConfirmations != 2 {
+		t.Fatalf("got pending deposit %+v after disconnect", pending)
+	}
+	if entry := mw.nextUndeliveredEntry(0); entry != nil {
+		t.Errorf("got outbox entry %s after disconnect, want none", entry.id())
+	}
+
+	//转入交易所在区块回退后删除等待中的抵押交易
+	mw.handleDisconnectBlock(block1)
+	if pending := mw.GetPendingDeposit(scTxid); pending != nil {
+		t.Errorf("got pending deposit %+v after deposit block disconnected", pending)
+	}
+}
@@ -1,17 +1,19 @@
 package mortgagewatcher
 
-import (
-	"bytes"
-	"encoding/binary"
-	"errors"
-	"github.com/btcsuite/btcd/txscript"
-)
-var prefix = []byte{0x00, 0x66, 0x67, 0x70}
 //Message 抵押币Message信息
 type Message struct {
-	Address   string `json:"a"`
-	ChainName string `json:"b"`
-	APPNumber uint32 `json:"n"`
+	Address    string              `json:"a"` //第一个接收地址，兼容旧格式
+	ChainName  string              `json:"b"`
+	APPNumber  uint32              `json:"n"`
+	Version    byte                `json:"v"` //payload版本，旧格式为0
+	Recipients []*PayloadRecipient `json:"r"`
+	Memo       string              `json:"m"`
+}
+
+//PayloadRecipient payload中的接收地址和金额，金额为0表示接收剩余的全部金额
+type PayloadRecipient struct {
+	Address string `json:"a"`
+	Amount  int64  `json:"v"`
 }
 
 //AddressInfo 充币地址信息
@@ -22,42 +24,30 @@ type AddressInfo struct {
 
 //SubTransaction 铸币/熔币交易信息
 type SubTransaction struct {
-	ScTxid       string
-	Amount       int64
-	RechargeList []*AddressInfo //
-	From         string         //from chain
-	To           string         //to chain
-	TokenFrom    uint32
-	TokenTo      uint32
+	ScTxid            string
+	Amount            int64
+	RechargeList      []*AddressInfo //
+	From              string         //from chain
+	To                string         //to chain
+	TokenFrom         uint32
+	TokenTo           uint32
+	FederationAddress string           //收款的多签地址，有多个时为第一个输出的地址
+	Retiring          bool             //是否有输出到退役状态的多签地址
+	Outputs           []*DepositOutput //转入多签地址的各个输出，Amount为其总和
+	Memo              string           //payload中的备注
 }
 
-//ParserPayLoadScript 解析op_return script到Message
-func ParserPayLoadScript(script []byte) (*Message, error) {
-	message := &Message{}
-
-	payload, err := txscript.PushedData(script)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(payload) != 4 {
-		return nil, errors.New("payload len error")
-	}
-
-	if !bytes.Equal(payload[0], prefix) {
-		return nil, errors.New("payload prefix error")
-	}
-
-	//parser chainName
-	message.ChainName = string(payload[1])
-
-	buf := bytes.NewBuffer(payload[2])
-	err = binary.Read(buf, binary.BigEndian, &message.APPNumber)
-	if err != nil {
-		return nil, err
-	}
-
-	message.Address = string(payload[3])
+//DepositOutput 抵押交易中转入多签地址的输出
+type DepositOutput struct {
+	Vout     uint32
+	Address  string
+	Amount   int64
+	Retiring bool
+}
 
-	return message, nil
-}
\ No newline at end of file
+//FederationInfo 多签地址信息
+type FederationInfo struct {
+	Address      string `json:"address"`
+	RedeemScript []byte `json:"redeem_script"`
+	Retiring     bool   `json:"retiring"`
+}
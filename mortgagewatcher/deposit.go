@@ -0,0 +1,49 @@
+package mortgagewatcher
+
+import (
+	"errors"
+)
+
+// ErrMultiplePayload 一笔交易中有多个有效的op_return payload，无法确定铸币目标，不作为抵押交易处理
+var ErrMultiplePayload = errors.New("multiple payload outputs")
+
+//ErrBelowMinimum 抵押金额低于最小抵押金额
+var ErrBelowMinimum = errors.New("deposit amount below minimum")
+
+// newMortgageTx 根据交易中转入多签地址的输出和payload生成抵押交易
+// 同一笔交易中所有转入多签地址的输出金额合并计入，payload必须有且只有一个，按payload中的金额分配给各接收地址
+func newMortgageTx(txHash string, coinType string, deposits []*DepositOutput, messages []*Message) (*SubTransaction, error) {
+	if len(deposits) == 0 {
+		return nil, errors.New("no federation output")
+	}
+	if len(messages) != 1 {
+		return nil, ErrMultiplePayload
+	}
+	message := messages[0]
+
+	var amount int64
+	var retiring bool
+	for _, deposit := range deposits {
+		amount += deposit.Amount
+		retiring = retiring || deposit.Retiring
+	}
+
+	rechargeList, err := allocateRecipients(message.Recipients, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SubTransaction{
+		ScTxid:            txHash,
+		Amount:            amount,
+		From:              coinType,
+		To:                message.ChainName,
+		TokenFrom:         0,
+		TokenTo:           message.APPNumber,
+		RechargeList:      rechargeList,
+		FederationAddress: deposits[0].Address,
+		Retiring:          retiring,
+		Outputs:           deposits,
+		Memo:              message.Memo,
+	}, nil
+}
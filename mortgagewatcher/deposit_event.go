@@ -0,0 +1,136 @@
+package mortgagewatcher
+
+import (
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/btcsuite/btcd/wire"
+	log "github.com/inconshreveable/log15"
+)
+
+//DepositEvent 内存池或未确认区块中的转入交易，只用于展示抵押进度，不能作为铸币依据
+//达到确认数的抵押交易通过GetMortgageTxChan或MortgageTxHandler推送
+type DepositEvent struct {
+	ScTxid                string           `json:"sc_txid"`
+	Confirmations         int64            `json:"confirmations"` //内存池中的交易为0
+	RequiredConfirmations int64            `json:"required_confirmations"`
+	BlockHeight           int64            `json:"block_height"`
+	Amount                int64            `json:"amount"`
+	Outputs               []*DepositOutput `json:"outputs"`
+	Message               *Message         `json:"message"`
+	Error                 string           `json:"error,omitempty"` //交易确认后会被拒绝的原因
+	Fee                   int64            `json:"fee"`
+	FeeRate               float64          `json:"fee_rate"` //satoshi/vbyte，无法查询输入金额时为0
+}
+
+//depositFeeJob 等待查询手续费的转入交易事件
+type depositFeeJob struct {
+	tx        *wire.MsgTx
+	inMempool bool
+	event     *DepositEvent
+}
+
+//GetDepositEventChan 获取未确认转入交易的事件chan，未及时读取时丢弃
+func (m *MortgageWatcher) GetDepositEventChan() <-chan *DepositEvent {
+	return m.depositEventChan
+}
+
+//emitDepositEvent 推送未确认的转入交易事件，blockData为nil时为内存池中的交易
+//调用方持有m.Lock，手续费需要RPC查询，交给depositEventDispatcher在锁外查询后推送
+func (m *MortgageWatcher) emitDepositEvent(tx *wire.MsgTx, blockData *coinmanager.BlockData, deposits []*DepositOutput, messages []*Message, payloadErr error) {
+	txHash := tx.TxHash().String()
+	isCoinbase := coinmanager.IsCoinBaseTx(tx)
+	event := &DepositEvent{
+		ScTxid:                txHash,
+		RequiredConfirmations: m.confirmNum,
+		Outputs:               deposits,
+	}
+	for _, deposit := range deposits {
+		event.Amount += deposit.Amount
+	}
+	if blockData != nil {
+		event.BlockHeight = blockData.BlockInfo.Height
+		event.Confirmations = blockData.BlockInfo.Confirmations
+	}
+	if len(messages) > 0 {
+		event.Message = messages[0]
+	}
+
+	//与已确认区块相同的校验，提前提示确认后会被拒绝的交易
+	var err error
+	if len(messages) == 0 {
+		err = payloadErr
+		if err == nil {
+			event.Error = "no payload output"
+		}
+	} else {
+		var mortgageTx *SubTransaction
+		mortgageTx, err = newMortgageTx(txHash, m.coinType, deposits, messages)
+		if err == nil {
+			err = validateMortgageTx(mortgageTx)
+		}
+		if err == nil && mortgageTx.Amount < m.getMinDepositAmount(mortgageTx.TokenTo) {
+			err = ErrBelowMinimum
+		}
+		if err == nil {
+			event.RequiredConfirmations = m.getRequiredConfirmNum(mortgageTx, isCoinbase)
+		}
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	if isCoinbase || m.bwClient == nil {
+		m.sendDepositEvent(event)
+		return
+	}
+	select {
+	case m.depositFeeChan <- &depositFeeJob{tx: tx, inMempool: blockData == nil, event: event}:
+	default:
+		log.Warn("deposit fee queue full, send event without fee", "txid", txHash, "coinType", m.coinType)
+		m.sendDepositEvent(event)
+	}
+}
+
+//depositEventDispatcher 在m.Lock外查询转入交易的手续费后推送事件，避免RPC阻塞区块处理
+func (m *MortgageWatcher) depositEventDispatcher() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer m.recoverPanic()
+		for {
+			select {
+			case job := <-m.depositFeeChan:
+				m.fillDepositFee(job)
+				m.sendDepositEvent(job.event)
+			case <-m.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+//fillDepositFee 内存池中的交易从getmempoolentry查询手续费
+//区块中的交易查询每个输入引用的交易，被花费的交易已上链时需要全节点开启txindex，查询失败时手续费为0
+func (m *MortgageWatcher) fillDepositFee(job *depositFeeJob) {
+	var fee int64
+	var err error
+	if job.inMempool {
+		fee, err = m.bwClient.GetMempoolFee(job.event.ScTxid)
+	} else {
+		fee, err = m.bwClient.GetTxFee(job.tx)
+	}
+	if err != nil {
+		log.Debug("get tx fee failed", "txid", job.event.ScTxid, "err", err.Error(), "coinType", m.coinType)
+		return
+	}
+	job.event.Fee = fee
+	job.event.FeeRate = float64(fee) / float64(coinmanager.GetTxVSize(job.tx))
+}
+
+func (m *MortgageWatcher) sendDepositEvent(event *DepositEvent) {
+	log.Debug("deposit event", "txid", event.ScTxid, "confirmations", event.Confirmations, "amount", event.Amount, "coinType", m.coinType)
+	select {
+	case m.depositEventChan <- event:
+	default:
+		log.Warn("deposit event chan full, drop event", "txid", event.ScTxid, "coinType", m.coinType)
+	}
+}
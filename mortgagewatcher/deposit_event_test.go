@@ -0,0 +1,79 @@
+package mortgagewatcher
+
+import (
+	"testing"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+)
+
+func TestDepositEvent(t *testing.T) {
+	badAddress, _ := EncodePayLoadScript("eth", 1, []*PayloadRecipient{{Address: "0x1234"}}, "")
+
+	tests := []struct {
+		name    string
+		payload []byte
+		isErr   bool
+	}{
+		{"valid", newTestPayload(t, 1), false},
+		{"missing payload", nil, true},
+		{"invalid address", badAddress, true},
+	}
+
+	for _, test := range tests {
+		mw := newTestMortgageWatcher(t, "btc")
+		tx := newTestDepositTx(t, 1, 100000, test.payload)
+		mw.handleNewTx(tx)
+
+		select {
+		case event := <-mw.GetDepositEventChan():
+			if event.ScTxid != tx.TxHash().String() || event.Amount != 100000 || event.Confirmations != 0 ||
+				event.RequiredConfirmations != 1 || len(event.Outputs) != 1 {
+				t.Errorf("%s: got event %+v", test.name, event)
+			}
+			if (event.Error != "") != test.isErr {
+				t.Errorf("%s: got error %q", test.name, event.Error)
+			}
+		default:
+			t.Errorf("%s: no deposit event", test.name)
+		}
+	}
+}
+
+func TestDepositEventFeeQueued(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	//手续费由depositEventDispatcher在锁外查询，持有m.Lock处理交易时只排队
+	mw.bwClient = &coinmanager.BitCoinWatcher{}
+
+	mempoolTx := newTestDepositTx(t, 1, 100000, newTestPayload(t, 1))
+	mw.handleNewTx(mempoolTx)
+	blockTx := newTestDepositTx(t, 2, 100000, newTestPayload(t, 1))
+	block := newTestBlock(100, nil, blockTx)
+	block.BlockInfo.Confirmations = 1
+	mw.handleNewUnconfirmBlock(block)
+
+	select {
+	case event := <-mw.GetDepositEventChan():
+		t.Fatalf("got event %s before fee lookup", event.ScTxid)
+	default:
+	}
+
+	tests := []struct {
+		name      string
+		txid      string
+		inMempool bool
+		height    int64
+	}{
+		{"mempool", mempoolTx.TxHash().String(), true, 0},
+		{"unconfirmed block", blockTx.TxHash().String(), false, 100},
+	}
+	for _, test := range tests {
+		select {
+		case job := <-mw.depositFeeChan:
+			if job.event.ScTxid != test.txid || job.inMempool != test.inMempool || job.event.BlockHeight != test.height {
+				t.Errorf("%s: got job for %s in mempool %v height %d", test.name, job.event.ScTxid, job.inMempool, job.event.BlockHeight)
+			}
+		default:
+			t.Errorf("%s: fee lookup not queued", test.name)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package mortgagewatcher
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	log "github.com/inconshreveable/log15"
+	"github.com/spf13/viper"
+)
+
+//defaultDustThreshold 默认的粉尘阈值，低于该金额的utxo花费成本高于其价值
+var defaultDustThreshold int64 = 546
+
+//loadDepositLimit 读取最小抵押金额和粉尘阈值配置，section为BTC/BCH
+//app_min_deposit_amount按APPNumber设置最小抵押金额，未设置的APPNumber使用min_deposit_amount
+func (m *MortgageWatcher) loadDepositLimit(section string) {
+	m.minDepositAmount = viper.GetInt64(section + ".min_deposit_amount")
+	m.dustThreshold = viper.GetInt64(section + ".dust_threshold")
+	if m.dustThreshold <= 0 {
+		m.dustThreshold = defaultDustThreshold
+	}
+
+	m.appMinDepositAmount = make(map[uint32]int64)
+	for key := range viper.GetStringMap(section + ".app_min_deposit_amount") {
+		appNumber, err := strconv.ParseUint(key, 10, 32)
+		if err != nil {
+			log.Warn("invalid app number in app_min_deposit_amount", "app_number", key, "coinType", m.coinType)
+			continue
+		}
+		m.appMinDepositAmount[uint32(appNumber)] = viper.GetInt64(section + ".app_min_deposit_amount." + key)
+	}
+}
+
+//getMinDepositAmount 获取APPNumber对应的最小抵押金额
+func (m *MortgageWatcher) getMinDepositAmount(appNumber uint32) int64 {
+	if amount, ok := m.appMinDepositAmount[appNumber]; ok {
+		return amount
+	}
+	return m.minDepositAmount
+}
+
+//isDust 金额是否低于粉尘阈值
+func (m *MortgageWatcher) isDust(value int64) bool {
+	return value < m.dustThreshold
+}
+
+//GetDustThreshold 获取粉尘阈值
+func (m *MortgageWatcher) GetDustThreshold() int64 {
+	return m.dustThreshold
+}
+
+//GetConsolidationCandidates 获取可以归集的粉尘utxo，按金额从小到大排列
+//粉尘utxo不会被SelectUtxo选中，需要单独构造归集交易合并到多签地址
+func (m *MortgageWatcher) GetConsolidationCandidates() []*coinmanager.UtxoInfo {
+	m.Lock()
+	defer m.Unlock()
+
+	var candidates []*coinmanager.UtxoInfo
+	m.faUtxoInfo.Range(func(k, v interface{}) bool {
+		utxoInfo := v.(*coinmanager.UtxoInfo)
+		utxoID := k.(string)
+		if utxoInfo.SpendType == 1 && utxoInfo.IsDust && !m.IsUtxoLocked(utxoID) && !m.isRefundUtxo(utxoID) {
+			copied := *utxoInfo
+			candidates = append(candidates, &copied)
+		}
+		return true
+	})
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Value < candidates[j].Value
+	})
+	return candidates
+}
@@ -0,0 +1,142 @@
+package mortgagewatcher
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+//转入交易状态
+const (
+	DepositStateSeenInMempool = "seen_in_mempool" //在内存池中
+	DepositStateInBlock       = "in_block"        //在未确认区块中
+	DepositStateConfirmed     = "confirmed"       //达到confirm_block_num，等待推送
+	DepositStateEmitted       = "emitted"         //抵押交易已推送
+	DepositStateAcknowledged  = "acknowledged"    //抵押交易已被确认处理
+	DepositStateReorged       = "reorged"         //所在的已确认区块被回退
+	DepositStateRejected      = "rejected"        //未通过校验，不铸币
+	DepositStateRefunded      = "refunded"        //退款交易已上链
+	DepositStateRemoved       = "removed"         //未上链被替换、双花或移出内存池
+)
+
+//DepositTransition 转入交易的一次状态变化
+type DepositTransition struct {
+	State  string `json:"state"`
+	Height int64  `json:"height"`
+	Time   int64  `json:"time"`
+	Detail string `json:"detail,omitempty"`
+}
+
+//DepositRecord 转入多签地址的交易记录，保存完整的状态变化
+type DepositRecord struct {
+	Txid        string               `json:"txid"`
+	State       string               `json:"state"`
+	Amount      int64                `json:"amount"`
+	Outputs     []*DepositOutput     `json:"outputs"`
+	BlockHeight int64                `json:"block_height"`
+	UpdateTime  int64                `json:"update_time"`
+	Transitions []*DepositTransition `json:"transitions"`
+}
+
+func (m *MortgageWatcher) getDepositRecordKey(txid string) []byte {
+	return []byte(strings.Join([]string{m.levelDbDepositPreFix, txid}, "_"))
+}
+
+//updateDepositState 记录转入交易的状态变化，height为发生变化的区块高度，内存池中为0
+//deposits不为nil时记录不存在则新建，否则只更新已有记录
+func (m *MortgageWatcher) updateDepositState(db dbWriter, txid string, state string, height int64, detail string, deposits []*DepositOutput) {
+	m.depositLock.Lock()
+	defer m.depositLock.Unlock()
+
+	record := m.getDepositRecord(db, txid)
+	if record == nil {
+		if deposits == nil {
+			return
+		}
+		record = &DepositRecord{Txid: txid}
+	}
+	if deposits != nil {
+		record.Outputs = deposits
+		record.Amount = 0
+		for _, deposit := range deposits {
+			record.Amount += deposit.Amount
+		}
+	}
+
+	//重复处理同一区块时不重复记录
+	if n := len(record.Transitions); n > 0 {
+		last := record.Transitions[n-1]
+		if last.State == state && last.Height == height && last.Detail == detail {
+			return
+		}
+	}
+
+	now := time.Now().Unix()
+	record.State = state
+	record.UpdateTime = now
+	switch state {
+	case DepositStateInBlock, DepositStateConfirmed:
+		record.BlockHeight = height
+	case DepositStateReorged, DepositStateRemoved:
+		record.BlockHeight = 0
+	}
+	record.Transitions = append(record.Transitions, &DepositTransition{
+		State:  state,
+		Height: height,
+		Time:   now,
+		Detail: detail,
+	})
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Warn("Marshal deposit record failed", "err", err.Error(), "coinType", m.coinType)
+		return
+	}
+	err = db.Put(m.getDepositRecordKey(txid), data)
+	if err != nil {
+		log.Warn("save deposit record failed", "err", err.Error(), "txid", txid, "coinType", m.coinType)
+	}
+}
+
+//GetDepositRecord 查询转入交易记录，不存在时返回nil
+func (m *MortgageWatcher) GetDepositRecord(txid string) *DepositRecord {
+	return m.getDepositRecord(m.levelDb, txid)
+}
+
+func (m *MortgageWatcher) getDepositRecord(db dbWriter, txid string) *DepositRecord {
+	data, err := db.Get(m.getDepositRecordKey(txid))
+	if err != nil || data == nil {
+		return nil
+	}
+
+	record := &DepositRecord{}
+	err = json.Unmarshal(data, record)
+	if err != nil {
+		log.Warn("Unmarshal deposit record failed", "err", err.Error(), "coinType", m.coinType)
+		return nil
+	}
+	return record
+}
+
+//GetDepositRecords 查询指定状态的转入交易记录，state为空时返回全部
+func (m *MortgageWatcher) GetDepositRecords(state string) []*DepositRecord {
+	var records []*DepositRecord
+
+	iter := m.levelDb.NewIteratorWithPrefix([]byte(m.levelDbDepositPreFix + "_"))
+	defer iter.Release()
+	for iter.Next() {
+		record := &DepositRecord{}
+		err := json.Unmarshal(iter.Value(), record)
+		if err != nil {
+			log.Warn("Unmarshal deposit record failed", "err", err.Error(), "coinType", m.coinType)
+			continue
+		}
+		if state != "" && record.State != state {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
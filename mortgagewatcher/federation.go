@@ -0,0 +1,188 @@
+package mortgagewatcher
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/btcsuite/btcutil"
+	log "github.com/inconshreveable/log15"
+)
+
+func (m *MortgageWatcher) getFederationKey(address string) []byte {
+	return []byte(strings.Join([]string{m.levelDbFederationPreFix, address}, "_"))
+}
+
+//AddFederationAddress 添加要监听的多签地址，已存在时更新兑现脚本
+//多签地址持久化在leveldb中，重启后继续监听，直到调用RemoveFederationAddress
+func (m *MortgageWatcher) AddFederationAddress(address string, redeemScript []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.addFederationAddress(address, redeemScript)
+}
+
+func (m *MortgageWatcher) addFederationAddress(address string, redeemScript []byte) error {
+	addr, err := coinmanager.DecodeAddress(address, m.coinType)
+	if err != nil {
+		log.Warn("decode address failed", "err", err.Error(), "address", address, "coinType", m.coinType)
+		return err
+	}
+	if addr == nil {
+		return errors.New("unsupported coin type: " + m.coinType)
+	}
+
+	info := &FederationInfo{
+		Address:      address,
+		RedeemScript: redeemScript,
+	}
+	if old := m.GetFederationInfo(address); old != nil {
+		info.Retiring = old.Retiring
+	} else {
+		m.addrList = append(m.addrList, addr)
+	}
+
+	err = m.storeFederationInfo(info)
+	if err != nil {
+		return err
+	}
+	m.federationMap.Store(address, info)
+	log.Info("add federation address", "address", address, "coinType", m.coinType)
+	return nil
+}
+
+//RemoveFederationAddress 停止监听多签地址，已有的utxo仍保留可用
+func (m *MortgageWatcher) RemoveFederationAddress(address string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.GetFederationInfo(address) == nil {
+		return errors.New("federation address not found: " + address)
+	}
+
+	err := m.levelDb.Delete(m.getFederationKey(address))
+	if err != nil {
+		log.Warn("delete federation address failed", "err", err.Error(), "address", address, "coinType", m.coinType)
+		return err
+	}
+	m.federationMap.Delete(address)
+
+	var addrList []btcutil.Address
+	for _, addr := range m.addrList {
+		if addr.EncodeAddress() != address && addr.String() != address {
+			addrList = append(addrList, addr)
+		}
+	}
+	m.addrList = addrList
+
+	log.Info("remove federation address", "address", address, "coinType", m.coinType)
+	return nil
+}
+
+//SetFederationAddressRetiring 设置多签地址是否处于退役状态，充值到退役地址的抵押交易会被标记
+func (m *MortgageWatcher) SetFederationAddressRetiring(address string, retiring bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	old := m.GetFederationInfo(address)
+	if old == nil {
+		return errors.New("federation address not found: " + address)
+	}
+
+	info := *old
+	info.Retiring = retiring
+	err := m.storeFederationInfo(&info)
+	if err != nil {
+		return err
+	}
+	m.federationMap.Store(address, &info)
+	log.Info("set federation address retiring", "address", address, "retiring", retiring, "coinType", m.coinType)
+	return nil
+}
+
+//GetFederationInfo 获取多签地址信息，不存在时返回nil
+func (m *MortgageWatcher) GetFederationInfo(address string) *FederationInfo {
+	t, ok := m.federationMap.Load(address)
+	if ok {
+		return t.(*FederationInfo)
+	}
+	return nil
+}
+
+//GetFederationAddresses 获取所有监听的多签地址
+func (m *MortgageWatcher) GetFederationAddresses() []*FederationInfo {
+	var infos []*FederationInfo
+	m.federationMap.Range(func(k, v interface{}) bool {
+		infos = append(infos, v.(*FederationInfo))
+		return true
+	})
+	return infos
+}
+
+//GetChangeAddress 获取找零地址，优先使用创建时指定的多签地址，其退役后使用其他未退役的多签地址
+func (m *MortgageWatcher) GetChangeAddress() (*FederationInfo, error) {
+	info := m.GetFederationInfo(m.federationAddress)
+	if info != nil && !info.Retiring {
+		return info, nil
+	}
+
+	for _, info := range m.GetFederationAddresses() {
+		if !info.Retiring {
+			return info, nil
+		}
+	}
+	return nil, errors.New("no active federation address")
+}
+
+//GetFederationBalance 获取多签地址已确认未使用的utxo余额
+func (m *MortgageWatcher) GetFederationBalance(address string) int64 {
+	m.Lock()
+	defer m.Unlock()
+
+	var balance int64
+	m.faUtxoInfo.Range(func(k, v interface{}) bool {
+		utxoInfo := v.(*coinmanager.UtxoInfo)
+		if utxoInfo.Address == address && utxoInfo.SpendType == 1 {
+			balance += utxoInfo.Value
+		}
+		return true
+	})
+	return balance
+}
+
+func (m *MortgageWatcher) storeFederationInfo(info *FederationInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		log.Warn("Marshal federation info failed", "err", err.Error(), "coinType", m.coinType)
+		return err
+	}
+	err = m.levelDb.Put(m.getFederationKey(info.Address), data)
+	if err != nil {
+		log.Warn("save federation info failed", "err", err.Error(), "coinType", m.coinType)
+		return err
+	}
+	return nil
+}
+
+//loadFederationAddress 从leveldb中load已添加的多签地址
+func (m *MortgageWatcher) loadFederationAddress() {
+	iter := m.levelDb.NewIteratorWithPrefix([]byte(m.levelDbFederationPreFix + "_"))
+	defer iter.Release()
+	for iter.Next() {
+		info := &FederationInfo{}
+		err := json.Unmarshal(iter.Value(), info)
+		if err != nil {
+			log.Warn("Unmarshal federation info FROM LEVELDB ERR", "err", err.Error(), "coinType", m.coinType)
+			continue
+		}
+
+		addr, err := coinmanager.DecodeAddress(info.Address, m.coinType)
+		if err != nil || addr == nil {
+			log.Warn("decode federation address failed", "address", info.Address, "coinType", m.coinType)
+			continue
+		}
+		m.federationMap.Store(info.Address, info)
+		m.addrList = append(m.addrList, addr)
+		log.Debug("load federation address from leveldb", "address", info.Address, "retiring", info.Retiring, "coinType", m.coinType)
+	}
+}
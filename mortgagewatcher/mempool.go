@@ -0,0 +1,109 @@
+package mortgagewatcher
+
+import (
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	log "github.com/inconshreveable/log15"
+)
+
+//RemovedDeposit 未上链被移出内存池的转入交易，Utxos为被移除的未确认utxo
+type RemovedDeposit struct {
+	Txid       string                  `json:"txid"`
+	Reason     string                  `json:"reason"`
+	ReplacedBy string                  `json:"replaced_by"`
+	Utxos      []*coinmanager.UtxoInfo `json:"utxos"`
+}
+
+//GetRemovedDepositChan 获取被替换、双花或移出内存池的转入交易chan，未及时读取时丢弃
+func (m *MortgageWatcher) GetRemovedDepositChan() <-chan *RemovedDeposit {
+	return m.removedDepositChan
+}
+
+//processRemovedTx 处理未上链被移出内存池的交易
+//交易转入多签地址的未确认utxo标记为已移除，交易花费的多签地址utxo恢复为可用
+func (m *MortgageWatcher) processRemovedTx(removed *coinmanager.RemovedTx) {
+	//替换或双花的交易可能仍花费同一多签utxo，如提高手续费重发的熔币交易，此时utxo仍在使用中
+	replacedBySpends, replacedByKnown := m.getReplacedBySpends(removed)
+
+	m.Lock()
+	defer m.Unlock()
+
+	var removedUtxos []*coinmanager.UtxoInfo
+	m.faUtxoInfo.Range(func(k, v interface{}) bool {
+		utxoID := k.(string)
+		utxoInfo := v.(*coinmanager.UtxoInfo)
+
+		if utxoInfo.Txid == removed.Txid && utxoInfo.BlockHeight == 0 && (utxoInfo.SpendType == 0 || utxoInfo.SpendType == 2) {
+			utxoInfo.SpendType = -1
+			m.storeUtxo(m.levelDb, utxoID)
+			m.faUtxoInfo.Delete(utxoID)
+			removedUtxos = append(removedUtxos, utxoInfo)
+			return true
+		}
+
+		if utxoInfo.SpendType == 2 && utxoInfo.SpendTxid == removed.Txid {
+			if !replacedByKnown {
+				log.Warn("replacing tx not found, keep utxo in use", "id", utxoID, "txid", removed.Txid,
+					"replaced_by", removed.ReplacedBy, "coinType", m.coinType)
+				return true
+			}
+			if replacedBySpends[utxoID] {
+				utxoInfo.SpendTxid = removed.ReplacedBy
+				m.storeUtxo(m.levelDb, utxoID)
+				log.Info("utxo spent by replacing tx", "id", utxoID, "txid", removed.Txid, "replaced_by", removed.ReplacedBy, "coinType", m.coinType)
+				return true
+			}
+			utxoInfo.SpendType = 0
+			if utxoInfo.BlockHeight > 0 {
+				utxoInfo.SpendType = 1
+			}
+			utxoInfo.SpendTxid = ""
+			m.storeUtxo(m.levelDb, utxoID)
+			log.Info("release utxo spent by removed tx", "id", utxoID, "txid", removed.Txid, "coinType", m.coinType)
+		}
+		return true
+	})
+
+	if len(removedUtxos) == 0 {
+		return
+	}
+
+	detail := removed.Reason
+	if removed.ReplacedBy != "" {
+		detail = removed.Reason + " by " + removed.ReplacedBy
+	}
+	m.updateDepositState(m.levelDb, removed.Txid, DepositStateRemoved, 0, detail, nil)
+
+	log.Info("remove unconfirmed deposit", "txid", removed.Txid, "reason", removed.Reason, "replaced_by", removed.ReplacedBy,
+		"utxos", len(removedUtxos), "coinType", m.coinType)
+	select {
+	case m.removedDepositChan <- &RemovedDeposit{
+		Txid:       removed.Txid,
+		Reason:     removed.Reason,
+		ReplacedBy: removed.ReplacedBy,
+		Utxos:      removedUtxos,
+	}:
+	default:
+		log.Warn("removed deposit chan full, drop event", "txid", removed.Txid, "coinType", m.coinType)
+	}
+}
+
+//getReplacedBySpends 查询替换或双花交易花费的outpoint，没有替换交易时返回空集合
+//查询替换交易失败时返回false，无法确认多签utxo是否已不再被花费
+func (m *MortgageWatcher) getReplacedBySpends(removed *coinmanager.RemovedTx) (map[string]bool, bool) {
+	spends := make(map[string]bool)
+	if removed.ReplacedBy == "" {
+		return spends, true
+	}
+
+	tx, err := m.bwClient.GetRawTransaction(removed.ReplacedBy)
+	if err != nil {
+		return nil, false
+	}
+	for _, txIn := range tx.MsgTx().TxIn {
+		spends[getUtxoID(&coinmanager.UtxoInfo{
+			Txid: txIn.PreviousOutPoint.Hash.String(),
+			Vout: txIn.PreviousOutPoint.Index,
+		})] = true
+	}
+	return spends, true
+}
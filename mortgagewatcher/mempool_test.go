@@ -0,0 +1,173 @@
+package mortgagewatcher
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/spf13/viper"
+)
+
+//newTestBitCoinWatcher 创建连接模拟全节点的BitCoinWatcher，全节点只支持按txid查询txs中的交易
+func newTestBitCoinWatcher(t *testing.T, txs ...*wire.MsgTx) *coinmanager.BitCoinWatcher {
+	rawTxs := make(map[string]string)
+	for _, tx := range txs {
+		var buf bytes.Buffer
+		tx.Serialize(&buf)
+		rawTxs[tx.TxHash().String()] = hex.EncodeToString(buf.Bytes())
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     interface{}       `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var txid string
+		if len(req.Params) > 0 {
+			json.Unmarshal(req.Params[0], &txid)
+		}
+		rawTx, ok := rawTxs[txid]
+		if req.Method != "getrawtransaction" || !ok {
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": nil, "id": req.ID,
+				"error": &btcjson.RPCError{Code: btcjson.ErrRPCNoTxInfo, Message: "No such mempool or blockchain transaction"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": rawTx, "error": nil, "id": req.ID})
+	}))
+
+	oldServer := viper.Get("BTC.rpc_server")
+	viper.Set("BTC.rpc_server", strings.TrimPrefix(server.URL, "http://"))
+	defer viper.Set("BTC.rpc_server", oldServer)
+	bw, err := coinmanager.NewBitCoinWatcher("btc", 0)
+	if err != nil {
+		t.Fatalf("new bitcoin watcher: %v", err)
+	}
+	t.Cleanup(func() {
+		bw.Close()
+		server.Close()
+	})
+	return bw
+}
+
+func TestProcessRemovedDeposit(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.bwClient = newTestBitCoinWatcher(t)
+	deposit := newTestDepositTx(t, 1, 100000, newTestPayload(t, 1))
+	depositUtxo := testUtxoID(deposit, 0)
+	mw.handleNewTx(deposit)
+	//已上链的转入交易不受移除事件影响
+	mined := newTestDepositTx(t, 2, 100000, newTestPayload(t, 1))
+	mw.handleConfirmBlock(newTestBlock(100, nil, mined))
+
+	for _, tx := range []*wire.MsgTx{deposit, mined} {
+		mw.processRemovedTx(&coinmanager.RemovedTx{Txid: tx.TxHash().String(), Reason: coinmanager.RemoveReasonEvicted})
+	}
+
+	//未确认的转入utxo标记为已移除并推送事件
+	if utxo := mw.GetUtxo(depositUtxo); utxo != nil {
+		t.Errorf("got utxo %+v after deposit evicted", utxo)
+	}
+	removed := -1
+	if utxos := mw.GetUtxoList(&removed); len(utxos) != 1 || getUtxoID(utxos[0]) != depositUtxo {
+		t.Errorf("got removed utxos %v, want %s", utxos, depositUtxo)
+	}
+	if record := mw.GetDepositRecord(deposit.TxHash().String()); record == nil || record.State != DepositStateRemoved {
+		t.Errorf("got deposit record %+v, want removed", record)
+	}
+	select {
+	case event := <-mw.GetRemovedDepositChan():
+		if event.Txid != deposit.TxHash().String() || event.Reason != coinmanager.RemoveReasonEvicted ||
+			len(event.Utxos) != 1 || event.Utxos[0].SpendType != -1 {
+			t.Errorf("got removed deposit %+v", event)
+		}
+	default:
+		t.Error("no removed deposit event")
+	}
+	select {
+	case event := <-mw.GetRemovedDepositChan():
+		t.Errorf("got removed deposit %+v for mined tx", event)
+	default:
+	}
+
+	if utxo := mw.GetUtxo(testUtxoID(mined, 0)); utxo == nil || utxo.SpendType != 1 {
+		t.Errorf("got mined utxo %+v, want confirmed", utxo)
+	}
+}
+
+func TestProcessRemovedSpendTx(t *testing.T) {
+	removedTxid := strings.Repeat("f", 64)
+	utxoTxid := strings.Repeat("1", 64)
+	utxoHash, _ := chainhash.NewHashFromStr(utxoTxid)
+	//替换交易仍花费多签utxo，如提高手续费重发的熔币交易
+	bumped := wire.NewMsgTx(wire.TxVersion)
+	bumped.AddTxIn(wire.NewTxIn(wire.NewOutPoint(utxoHash, 0), nil, nil))
+	//双花交易花费其他输出
+	conflict := wire.NewMsgTx(wire.TxVersion)
+	conflict.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{9}, 0), nil, nil))
+
+	tests := []struct {
+		name        string
+		removed     *coinmanager.RemovedTx
+		blockHeight int64
+		spendType   int
+		spendTxid   string
+	}{
+		{"replaced by spend of same utxo",
+			&coinmanager.RemovedTx{Txid: removedTxid, Reason: coinmanager.RemoveReasonReplaced, ReplacedBy: bumped.TxHash().String()},
+			100, 2, bumped.TxHash().String()},
+		{"conflict",
+			&coinmanager.RemovedTx{Txid: removedTxid, Reason: coinmanager.RemoveReasonConflict, ReplacedBy: conflict.TxHash().String()},
+			100, 1, ""},
+		{"evicted unconfirmed utxo",
+			&coinmanager.RemovedTx{Txid: removedTxid, Reason: coinmanager.RemoveReasonEvicted},
+			0, 0, ""},
+		{"replacing tx not found",
+			&coinmanager.RemovedTx{Txid: removedTxid, Reason: coinmanager.RemoveReasonReplaced, ReplacedBy: strings.Repeat("e", 64)},
+			100, 2, removedTxid},
+		{"other spend tx",
+			&coinmanager.RemovedTx{Txid: strings.Repeat("d", 64), Reason: coinmanager.RemoveReasonEvicted},
+			100, 2, removedTxid},
+	}
+
+	for _, test := range tests {
+		mw := newTestMortgageWatcher(t, "btc")
+		mw.bwClient = newTestBitCoinWatcher(t, bumped, conflict)
+		utxoID := addTestUtxo(mw, "1", 100000, 2)
+		v, _ := mw.faUtxoInfo.Load(utxoID)
+		utxo := v.(*coinmanager.UtxoInfo)
+		utxo.SpendTxid = removedTxid
+		utxo.BlockHeight = test.blockHeight
+		mw.storeUtxo(mw.levelDb, utxoID)
+
+		mw.processRemovedTx(test.removed)
+		utxo = mw.GetUtxo(utxoID)
+		if utxo == nil {
+			t.Errorf("%s: utxo removed", test.name)
+			continue
+		}
+		if utxo.SpendType != test.spendType || utxo.SpendTxid != test.spendTxid {
+			t.Errorf("%s: got spend type %d spend txid %q, want %d %q", test.name, utxo.SpendType, utxo.SpendTxid,
+				test.spendType, test.spendTxid)
+		}
+		//内存中的状态同步写入leveldb
+		var stored coinmanager.UtxoInfo
+		data, err := mw.levelDb.Get([]byte(strings.Join([]string{mw.levelDbUtxoPreFix, utxoID}, "_")))
+		if err != nil || json.Unmarshal(data, &stored) != nil || stored.SpendType != test.spendType || stored.SpendTxid != test.spendTxid {
+			t.Errorf("%s: got stored utxo %s err %v", test.name, data, err)
+		}
+		select {
+		case event := <-mw.GetRemovedDepositChan():
+			t.Errorf("%s: got removed deposit %+v for spend tx", test.name, event)
+		default:
+		}
+	}
+}
@@ -1,16 +1,21 @@
 package mortgagewatcher
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
 	"github.com/JimmyHongjichuan/btc_watcher/dbop"
+	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	log "github.com/inconshreveable/log15"
-	"os"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/spf13/viper"
 )
@@ -26,9 +31,10 @@ type MortgageWatcher struct {
 	scanConfirmHeight int64
 	coinType          string
 	mortgageTxChan    chan *SubTransaction
+	retractTxChan     chan *SubTransaction
 	federationAddress string
 	redeemScript      []byte
-	levelDb           *dbop.LDBDatabase
+	levelDb           dbop.Database
 	utxoMonitorCount  sync.Map
 	federationMap     sync.Map
 	faUtxoInfo        sync.Map
@@ -37,38 +43,54 @@ type MortgageWatcher struct {
 	confirmNum        int64
 	firstBlockHeight  int64
 	loadMode          string
-
-	levelDbTxMappingPreFix string
-	levelDbTxPreFix        string
-	levelDbUtxoPreFix      string
+	mortgageTxHandler MortgageTxHandler
+	outbox            sync.Map
+	outboxLock        sync.Mutex
+	outboxSeq         uint64
+	recentTxs         []*SubTransaction
+	recentTxLock      sync.Mutex
+	refundUtxos       sync.Map
+
+	minDepositAmount    int64
+	coinbaseConfirmNum  int64
+	confirmTiers        []*confirmTier
+	appConfirmNum       map[uint32]int64
+	removedDepositChan  chan *RemovedDeposit
+	depositEventChan    chan *DepositEvent
+	depositFeeChan      chan *depositFeeJob
+	depositLock         sync.Mutex
+	failOnce            sync.Once
+	failErr             error
+	failChan            chan struct{}
+	appMinDepositAmount map[uint32]int64
+	dustThreshold       int64
+
+	levelDbTxMappingPreFix  string
+	levelDbTxPreFix         string
+	levelDbUtxoPreFix       string
+	levelDbOutboxPreFix     string
+	levelDbUndoPreFix       string
+	levelDbUtxoLockPreFix   string
+	levelDbFederationPreFix string
+	levelDbRejectedPreFix   string
+	levelDbRefundPreFix     string
+	levelDbPendingPreFix    string
+	levelDbDepositPreFix    string
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopOnce sync.Once
 }
 
-func openLevelDB(coinType string) (*dbop.LDBDatabase, error) {
+//openLevelDB 按LEVELDB.db_backend打开coinType对应的存储
+func openLevelDB(coinType string) (dbop.Database, error) {
 	dbPath := viper.GetString("LEVELDB.bch_db_path")
 	if coinType == "btc" {
 		dbPath = viper.GetString("LEVELDB.btc_db_path")
 	}
 
-	info, err := os.Stat(dbPath)
-	if os.IsNotExist(err) {
-		if err := os.Mkdir(dbPath, 0700); err != nil {
-			return nil, err
-		}
-	} else {
-		if err != nil {
-			return nil, err
-		}
-		if !info.IsDir() {
-			return nil, err
-		}
-	}
-
-	db, err := dbop.NewLDBDatabase(dbPath, 16, 16)
-	if err != nil {
-		return nil, err
-	}
-	return db, nil
-
+	return dbop.OpenDatabase(viper.GetString("LEVELDB.db_backend"), dbPath)
 }
 
 //NewMortgageWatcher 创建一个抵押交易监听实例
@@ -89,80 +111,119 @@ func NewMortgageWatcher(coinType string, confirmHeight int64, federationAddress
 		height, err = strconv.Atoi(string(value))
 		if err != nil {
 			log.Error("atoi height failed", "err", err.Error())
+			levelDb.Close()
 			return nil, err
 		}
 	}
 
+	//区块记录与区块的全部修改在同一批次写入，确认高度以最后一次提交的区块为准
+	if commit := loadBlockCommit(levelDb, coinType); commit != nil && int64(height) != commit.ConfirmHeight {
+		log.Warn("confirm height mismatch, recover from block commit", "height", height, "commit_height", commit.Height,
+			"commit_hash", commit.Hash, "coinType", coinType)
+		height = int(commit.ConfirmHeight)
+	}
+
 	log.Debug("confirm height", "height", height)
 
 	if int64(height) >= confirmHeight {
 		confirmHeight = int64(height)
 	}
 
-	bwClient, err := coinmanager.NewBitCoinWatcher(coinType, confirmHeight)
-	if err != nil {
-		return nil, err
-	}
-
 	mw := MortgageWatcher{
 		levelDb:           levelDb,
-		bwClient:          bwClient,
 		scanConfirmHeight: confirmHeight,
 		coinType:          coinType,
 		mortgageTxChan:    make(chan *SubTransaction, 100),
+		retractTxChan:     make(chan *SubTransaction, 100),
 		federationAddress: federationAddress,
 		redeemScript:      redeemScript,
 		timeout:           timeout,
 	}
+	mw.removedDepositChan = make(chan *RemovedDeposit, 100)
+	mw.depositEventChan = make(chan *DepositEvent, 100)
+	mw.depositFeeChan = make(chan *depositFeeJob, 100)
+	mw.failChan = make(chan struct{})
 
 	switch coinType {
 	case "btc":
 		mw.confirmNum = int64(viper.GetInt64("BTC.confirm_block_num"))
+		mw.coinbaseConfirmNum = viper.GetInt64("BTC.coinbase_confirm_block_num")
 		mw.firstBlockHeight = int64(viper.GetInt64("BTC.first_block_height"))
 		mw.loadMode = viper.GetString("BTC.load_mode")
+		mw.loadDepositLimit("BTC")
+		mw.loadConfirmPolicy("BTC")
 	case "bch":
 		mw.confirmNum = int64(viper.GetInt64("BCH.confirm_block_num"))
+		mw.coinbaseConfirmNum = viper.GetInt64("BCH.coinbase_confirm_block_num")
 		mw.firstBlockHeight = int64(viper.GetInt64("BCH.first_block_height"))
 		mw.loadMode = viper.GetString("BCH.load_mode")
+		mw.loadDepositLimit("BCH")
+		mw.loadConfirmPolicy("BCH")
+	}
+
+	if mw.coinbaseConfirmNum <= 0 {
+		mw.coinbaseConfirmNum = defaultCoinbaseConfirmNum
 	}
 
-	mw.levelDbUtxoPreFix = strings.Join([]string{coinType, "utxo"}, "_")
-	mw.levelDbTxPreFix = strings.Join([]string{coinType, "fa_tx"}, "_")
-	mw.levelDbTxMappingPreFix = strings.Join([]string{coinType, "hash_mapping"}, "_")
+	mw.initLevelDbPrefix()
 
-	mw.federationMap.Store(federationAddress, redeemScript)
-	addr, err := coinmanager.DecodeAddress(federationAddress, coinType)
+	mw.loadFederationAddress()
+	err = mw.addFederationAddress(federationAddress, redeemScript)
 	if err != nil {
-		log.Warn("decode address failed", "err", err.Error())
+		levelDb.Close()
 		return nil, err
 	}
-	mw.addrList = append(mw.addrList, addr)
 
-	mw.loadUtxo()
+	err = mw.loadUtxo()
+	if err != nil {
+		log.Error("load utxo failed", "err", err.Error(), "coinType", coinType)
+		levelDb.Close()
+		return nil, err
+	}
+	mw.loadOutbox()
+	mw.loadUtxoLock()
+	mw.loadRefund()
+
+	//chain模式下在Start中使用区块监听的RPC连接扫描链上区块
+	mw.bwClient, err = coinmanager.NewBitCoinWatcher(coinType, mw.scanConfirmHeight)
+	if err != nil {
+		levelDb.Close()
+		return nil, err
+	}
 
 	return &mw, err
 }
 
+//initLevelDbPrefix 按coinType设置leveldb中各类数据的KEY前缀
+func (m *MortgageWatcher) initLevelDbPrefix() {
+	m.levelDbUtxoPreFix = strings.Join([]string{m.coinType, "utxo"}, "_")
+	m.levelDbTxPreFix = strings.Join([]string{m.coinType, "fa_tx"}, "_")
+	m.levelDbTxMappingPreFix = strings.Join([]string{m.coinType, "hash_mapping"}, "_")
+	m.levelDbOutboxPreFix = strings.Join([]string{m.coinType, "outbox"}, "_")
+	m.levelDbUndoPreFix = strings.Join([]string{m.coinType, "undo"}, "_")
+	m.levelDbUtxoLockPreFix = strings.Join([]string{m.coinType, "lock"}, "_")
+	m.levelDbFederationPreFix = strings.Join([]string{m.coinType, "federation"}, "_")
+	m.levelDbRejectedPreFix = strings.Join([]string{m.coinType, "rejected"}, "_")
+	m.levelDbRefundPreFix = strings.Join([]string{m.coinType, "refund"}, "_")
+	m.levelDbPendingPreFix = strings.Join([]string{m.coinType, "pending"}, "_")
+	m.levelDbDepositPreFix = strings.Join([]string{m.coinType, "deposit"}, "_")
+}
+
 func (m *MortgageWatcher) utxoMonitor() {
+	m.wg.Add(1)
 	go func() {
+		defer m.wg.Done()
+		defer m.recoverPanic()
 		for {
-			m.utxoMonitorCount.Range(func(k, v interface{}) bool {
-				utxoID := k.(string)
-				count := v.(int)
-				count++
-				if count >= m.timeout {
-					m.utxoMonitorCount.Delete(utxoID)
-				} else {
-					m.utxoMonitorCount.Store(utxoID, count)
-				}
-				return true
-			})
+			m.expireUtxoLock()
 
-			time.Sleep(time.Duration(1) * time.Second)
+			if !m.sleep(time.Duration(1) * time.Second) {
+				return
+			}
 		}
 	}()
 }
-//GetUtxoInfoByID 从leveldb中获取utxo信息
+//GetUtxoInfoByID 从leveldb中获取utxo信息，返回内存中的utxo，只在持有m.Lock时读写，其他情况使用GetUtxo
 func (m *MortgageWatcher) GetUtxoInfoByID(utxoID string) *coinmanager.UtxoInfo {
 	t, ok := m.faUtxoInfo.Load(utxoID)
 	if ok {
@@ -172,7 +233,7 @@ func (m *MortgageWatcher) GetUtxoInfoByID(utxoID string) *coinmanager.UtxoInfo {
 
 	return nil
 }
-func (m *MortgageWatcher) storeUtxo(utxoID string) bool {
+func (m *MortgageWatcher) storeUtxo(db dbWriter, utxoID string) bool {
 	t, ok := m.faUtxoInfo.Load(utxoID)
 	if ok {
 		utxoInfo := t.(*coinmanager.UtxoInfo)
@@ -183,9 +244,9 @@ func (m *MortgageWatcher) storeUtxo(utxoID string) bool {
 			return false
 		}
 		key := strings.Join([]string{m.levelDbUtxoPreFix, utxoID}, "_")
-		retErr := m.levelDb.Put([]byte(key), []byte(data))
+		retErr := db.Put([]byte(key), []byte(data))
 		if retErr != nil {
-			log.Warn("Marshal utxo failed", "err", err.Error(), "coinType", m.coinType)
+			log.Warn("save utxo failed", "err", retErr.Error(), "utxoID", utxoID, "coinType", m.coinType)
 			return false
 		}
 
@@ -195,26 +256,30 @@ func (m *MortgageWatcher) storeUtxo(utxoID string) bool {
 	return false
 }
 
-//存储tx 签名前与签名后的交易hash映射
-func (m *MortgageWatcher) storeHashMapping(tx *wire.MsgTx) bool {
-	hashAfterSign := tx.TxHash().String()
-
+//HashBeforeSign 计算交易签名前的hash，即去掉所有输入签名脚本后的交易hash
+func HashBeforeSign(tx *wire.MsgTx) string {
 	copyTx := tx.Copy()
 	for _, vin := range copyTx.TxIn {
 		vin.SignatureScript = nil
 	}
-	hashBeforeSign := copyTx.TxHash().String()
+	return copyTx.TxHash().String()
+}
+
+//存储tx 签名前与签名后的交易hash映射
+func (m *MortgageWatcher) storeHashMapping(db dbWriter, tx *wire.MsgTx) bool {
+	hashAfterSign := tx.TxHash().String()
+	hashBeforeSign := HashBeforeSign(tx)
 	mappingKey := strings.Join([]string{m.levelDbTxMappingPreFix, hashBeforeSign}, "_")
 	log.Debug("storeHashMap", "hash_before_sign", hashBeforeSign, "hash_after_sign", hashAfterSign, "coinType", m.coinType)
 
-	retErr := m.levelDb.Put([]byte(mappingKey), []byte(hashAfterSign))
+	retErr := db.Put([]byte(mappingKey), []byte(hashAfterSign))
 	if retErr != nil {
 		log.Warn("save hashmap failed", "err", retErr.Error(), "coinType", m.coinType)
 		return false
 	}
 
 	txKey := strings.Join([]string{m.levelDbTxPreFix, hashAfterSign}, "_")
-	retErr = m.levelDb.Put([]byte(txKey), []byte(hashAfterSign))
+	retErr = db.Put([]byte(txKey), []byte(hashAfterSign))
 	if retErr != nil {
 		log.Warn("save federation hash failed", "err", retErr.Error(), "coinType", m.coinType)
 		return false
@@ -223,18 +288,30 @@ func (m *MortgageWatcher) storeHashMapping(tx *wire.MsgTx) bool {
 	return true
 }
 
+//RecordSignedTx 记录本地签名完成的交易，保存签名前后的hash映射，用于上链后识别多签地址发出的交易
+func (m *MortgageWatcher) RecordSignedTx(tx *wire.MsgTx) error {
+	if !m.storeHashMapping(m.levelDb, tx) {
+		return errors.New("store hash mapping failed")
+	}
+	log.Info("record signed tx", "hash_before_sign", HashBeforeSign(tx), "hash_after_sign", tx.TxHash().String(), "coinType", m.coinType)
+	return nil
+}
 
-
-func (m *MortgageWatcher) processConfirmBlock(blockData *coinmanager.BlockData) {
+func (m *MortgageWatcher) processConfirmBlock(db dbWriter, blockData *coinmanager.BlockData) {
+	undo := newBlockUndo(blockData)
 	for _, tx := range blockData.MsgBolck.Transactions {
 		txHash := tx.TxHash().String()
 
-		hasReturn := false
-		isFedAddr := false
 		isFromFedAddr := false
-		var value int64
-		var message *Message
-		var err error
+		//coinbase的utxo在成熟前不可花费，抵押交易延迟到成熟后推送
+		isCoinbase := coinmanager.IsCoinBaseTx(tx)
+		confirmSpendType := 1
+		if isCoinbase {
+			confirmSpendType = 4
+		}
+		var deposits []*DepositOutput
+		var messages []*Message
+		var payloadErr error
 
 		//update utxo status
 
@@ -243,24 +320,34 @@ func (m *MortgageWatcher) processConfirmBlock(blockData *coinmanager.BlockData)
 			utxoInfo := m.GetUtxoInfoByID(utxoID)
 			if utxoInfo != nil {
 				isFromFedAddr = true
+				undo.saveUtxoState(utxoInfo)
 				utxoInfo.SpendType = 3
-				m.storeUtxo(utxoID)
+				utxoInfo.SpendTxid = txHash
+				m.storeUtxo(db, utxoID)
 				m.faUtxoInfo.Delete(utxoID)
+				if refund := m.markRefunded(db, utxoID, txHash); refund != nil {
+					undo.RefundBefore = append(undo.RefundBefore, refund)
+					m.updateDepositState(db, refund.ScTxid, DepositStateRefunded, blockData.BlockInfo.Height, txHash, nil)
+				}
 
 			}
 
 		}
 
 		if isFromFedAddr {
-			m.storeHashMapping(tx)
+			m.storeHashMapping(db, tx)
 		}
 
 		for voutIndex, vout := range tx.TxOut {
 			address := coinmanager.ExtractPkScriptAddr(vout.PkScript, m.coinType)
 			if address != "" {
-				if _, ok := m.federationMap.Load(address); ok {
-					isFedAddr = true
-					value = vout.Value
+				if info := m.GetFederationInfo(address); info != nil {
+					deposits = append(deposits, &DepositOutput{
+						Vout:     uint32(voutIndex),
+						Address:  address,
+						Amount:   vout.Value,
+						Retiring: info.Retiring,
+					})
 					utxoID := strings.Join([]string{txHash, strconv.Itoa(voutIndex)}, "_")
 
 					t, ok := m.faUtxoInfo.Load(utxoID)
@@ -270,57 +357,110 @@ func (m *MortgageWatcher) processConfirmBlock(blockData *coinmanager.BlockData)
 							Txid:        txHash,
 							Vout:        uint32(voutIndex),
 							Value:       vout.Value,
-							SpendType:   1,
+							SpendType:   confirmSpendType,
 							BlockHeight: blockData.BlockInfo.Height,
+							IsDust:      m.isDust(vout.Value),
+							Coinbase:    isCoinbase,
 						}
 						m.faUtxoInfo.Store(utxoID, &newUtxo)
+						undo.CreatedUtxos = append(undo.CreatedUtxos, utxoID)
 					} else {
 						utxoInfo := t.(*coinmanager.UtxoInfo)
+						undo.saveUtxoState(utxoInfo)
 						if utxoInfo.SpendType < 1 {
-							utxoInfo.SpendType = 1
+							utxoInfo.SpendType = confirmSpendType
 						}
+						utxoInfo.BlockHeight = blockData.BlockInfo.Height
+						utxoInfo.Coinbase = isCoinbase
 					}
-					m.storeUtxo(utxoID)
+					m.storeUtxo(db, utxoID)
 
-					log.Debug("FIND NEW UTXO", "id", utxoID, "value", value, "coinType", m.coinType)
+					log.Debug("FIND NEW UTXO", "id", utxoID, "value", vout.Value, "coinType", m.coinType)
 
 				}
 			} else {
-				message, err = ParserPayLoadScript(vout.PkScript)
+				message, err := ParserPayLoadScript(vout.PkScript)
 				if err == nil {
-					hasReturn = true
+					messages = append(messages, message)
+				} else if len(vout.PkScript) > 0 && vout.PkScript[0] == txscript.OP_RETURN {
+					//记录op_return解析错误用于退款分类，优先保留前缀正确但内容错误的情况
+					if payloadErr == nil || payloadErr == ErrPayloadPrefix {
+						payloadErr = err
+					}
 				}
 			}
 		}
 
+		if len(deposits) > 0 && !isFromFedAddr {
+			m.updateDepositState(db, txHash, DepositStateConfirmed, blockData.BlockInfo.Height, "", deposits)
+			undo.DepositTxs = append(undo.DepositTxs, txHash)
+		}
+
 		// make mortgage tx
-		if isFedAddr && hasReturn {
-			mortgageTx := SubTransaction{
-				ScTxid:    tx.TxHash().String(),
-				Amount:    value,
-				From:      m.coinType,
-				To:        message.ChainName,
-				TokenFrom: 0,
-				TokenTo:   message.APPNumber,
-				RechargeList: []*AddressInfo{
-					{
-						Address: message.Address,
-						Amount:  value,
-					},
-				},
+		if len(deposits) > 0 && len(messages) > 0 {
+			mortgageTx, err := newMortgageTx(txHash, m.coinType, deposits, messages)
+			if err == nil {
+				err = validateMortgageTx(mortgageTx)
+			}
+			if err == nil && mortgageTx.Amount < m.getMinDepositAmount(mortgageTx.TokenTo) {
+				err = ErrBelowMinimum
+			}
+			if err != nil {
+				log.Warn("reject mortgage tx", "scTxid", txHash, "err", err.Error(), "coinType", m.coinType)
+				m.storeRejectedDeposit(db, newRejectedDeposit(txHash, blockData.BlockInfo.Height, deposits, messages, err))
+				undo.RejectedTxs = append(undo.RejectedTxs, txHash)
+				m.updateDepositState(db, txHash, DepositStateRejected, blockData.BlockInfo.Height, err.Error(), nil)
+				if !isFromFedAddr && !isCoinbase && m.enqueueRefund(db, tx, blockData.BlockInfo.Height, deposits, getRefundReason(err), err.Error()) != nil {
+					undo.RefundTxs = append(undo.RefundTxs, txHash)
+				}
+				continue
+			}
+			if mortgageTx.Retiring {
+				log.Warn("mortgage tx to retiring federation address", "scTxid", mortgageTx.ScTxid, "address", mortgageTx.FederationAddress, "coinType", m.coinType)
+			}
+			//确认数不足时延迟推送，coinbase至少需要成熟所需的确认数
+			required := m.getRequiredConfirmNum(mortgageTx, isCoinbase)
+			if m.getConfirmations(blockData.BlockInfo.Height, blockData.BlockInfo.Height) < required {
+				log.Info("defer mortgage tx", "scTxid", txHash, "required_confirmations", required, "coinType", m.coinType)
+				m.storePendingDeposit(db, &PendingDeposit{
+					BlockHeight:           blockData.BlockInfo.Height,
+					RequiredConfirmations: required,
+					Tx:                    mortgageTx,
+				})
+				undo.PendingTxs = append(undo.PendingTxs, txHash)
+				continue
 			}
 
 			log.Debug("push mortgage tx", "tx", mortgageTx, "coinType", m.coinType)
-			m.mortgageTxChan <- &mortgageTx
+			m.pushMortgageTx(db, mortgageTx)
+			undo.MortgageTxs = append(undo.MortgageTxs, mortgageTx.ScTxid)
+			m.updateDepositState(db, txHash, DepositStateEmitted, blockData.BlockInfo.Height, "", nil)
+		} else if len(deposits) > 0 && !isFromFedAddr && !isCoinbase {
+			//多签地址发出的交易中的找零和coinbase不需要退款
+			reason, detail := RefundReasonMissingPayload, "no payload output"
+			if payloadErr != nil {
+				reason, detail = getRefundReason(payloadErr), payloadErr.Error()
+			}
+			m.updateDepositState(db, txHash, DepositStateRejected, blockData.BlockInfo.Height, detail, nil)
+			if m.enqueueRefund(db, tx, blockData.BlockInfo.Height, deposits, reason, detail) != nil {
+				undo.RefundTxs = append(undo.RefundTxs, txHash)
+			}
 		}
 	}
 
+	m.matureCoinbase(db, blockData.BlockInfo.Height, undo)
+	m.releasePendingDeposits(db, blockData.BlockInfo.Height, undo)
+	m.storeBlockUndo(db, undo)
 }
 
-func (m *MortgageWatcher) processNewTx(newTx *wire.MsgTx) {
+//processNewTx 处理内存池或未确认区块中的交易，blockData为nil时为内存池中的交易
+func (m *MortgageWatcher) processNewTx(newTx *wire.MsgTx, blockData *coinmanager.BlockData) {
 	txHash := newTx.TxHash().String()
 	//update utxo status
 	isFromFedAddr := false
+	var deposits []*DepositOutput
+	var messages []*Message
+	var payloadErr error
 
 	for _, vin := range newTx.TxIn {
 		utxoID := strings.Join([]string{vin.PreviousOutPoint.Hash.String(), strconv.Itoa(int(vin.PreviousOutPoint.Index))}, "_")
@@ -328,14 +468,21 @@ func (m *MortgageWatcher) processNewTx(newTx *wire.MsgTx) {
 		if utxoInfo != nil {
 			isFromFedAddr = true
 			utxoInfo.SpendType = 2
-			m.storeUtxo(utxoID)
+			utxoInfo.SpendTxid = txHash
+			m.storeUtxo(m.levelDb, utxoID)
 		}
 	}
 
 	for voutIndex, vout := range newTx.TxOut {
 		address := coinmanager.ExtractPkScriptAddr(vout.PkScript, m.coinType)
 		if address != "" {
-			if _, ok := m.federationMap.Load(address); ok {
+			if info := m.GetFederationInfo(address); info != nil {
+				deposits = append(deposits, &DepositOutput{
+					Vout:     uint32(voutIndex),
+					Address:  address,
+					Amount:   vout.Value,
+					Retiring: info.Retiring,
+				})
 				id := strings.Join([]string{txHash, strconv.Itoa(voutIndex)}, "_")
 				newUtxo := coinmanager.UtxoInfo{
 					Address:   address,
@@ -343,12 +490,23 @@ func (m *MortgageWatcher) processNewTx(newTx *wire.MsgTx) {
 					Vout:      uint32(voutIndex),
 					Value:     vout.Value,
 					SpendType: 0,
+					IsDust:    m.isDust(vout.Value),
+					Coinbase:  coinmanager.IsCoinBaseTx(newTx),
 				}
 
 				_, ok := m.faUtxoInfo.Load(id)
 				if !ok {
 					m.faUtxoInfo.Store(id, &newUtxo)
-					m.storeUtxo(id)
+					m.storeUtxo(m.levelDb, id)
+				}
+			}
+		} else {
+			message, err := ParserPayLoadScript(vout.PkScript)
+			if err == nil {
+				messages = append(messages, message)
+			} else if len(vout.PkScript) > 0 && vout.PkScript[0] == txscript.OP_RETURN {
+				if payloadErr == nil || payloadErr == ErrPayloadPrefix {
+					payloadErr = err
 				}
 			}
 		}
@@ -356,57 +514,242 @@ func (m *MortgageWatcher) processNewTx(newTx *wire.MsgTx) {
 
 	if isFromFedAddr {
 		log.Info("process tx", "tx_hash", txHash, "coinType", m.coinType)
-		m.storeHashMapping(newTx)
+		m.storeHashMapping(m.levelDb, newTx)
+	} else if len(deposits) > 0 {
+		if blockData == nil {
+			m.updateDepositState(m.levelDb, txHash, DepositStateSeenInMempool, 0, "", deposits)
+		} else {
+			m.updateDepositState(m.levelDb, txHash, DepositStateInBlock, blockData.BlockInfo.Height, "", deposits)
+		}
+		m.emitDepositEvent(newTx, blockData, deposits, messages, payloadErr)
 	}
 }
 
 func (m *MortgageWatcher) processNewUnconfirmBlock(blockData *coinmanager.BlockData) {
 	for _, tx := range blockData.MsgBolck.Transactions {
-		m.processNewTx(tx)
+		m.processNewTx(tx, blockData)
 	}
 }
 //StartWatch 启动监听已确认和未确认的区块以及新交易，提取抵押交易
 func (m *MortgageWatcher) StartWatch() {
+	m.Start(context.Background())
+}
 
-	m.utxoMonitor()
+//Start 启动监听，ctx取消或调用Stop时退出
+func (m *MortgageWatcher) Start(ctx context.Context) {
+	m.ctx, m.cancel = context.WithCancel(ctx)
 
-	m.bwClient.WatchNewTxFromNodeMempool()
-	m.bwClient.WatchNewBlock()
+	m.utxoMonitor()
+	m.mortgageTxDispatcher()
+	m.depositEventDispatcher()
 
-	confirmBlockChan := m.bwClient.GetConfirmChan()
+	blockEventChan := m.bwClient.GetBlockEventChan()
 	newTxChan := m.bwClient.GetNewTxChan()
 	newUnconfirmBlockChan := m.bwClient.GetNewUnconfirmBlockChan()
+	removedTxChan := m.bwClient.GetRemovedTxChan()
 
+	m.wg.Add(1)
 	go func() {
-		for {
-			select {
-			case newConfirmBlock := <-confirmBlockChan:
-				log.Info("process confirm block height:", "height", newConfirmBlock.BlockInfo.Height, "coinType", m.coinType)
-				m.processConfirmBlock(newConfirmBlock)
-				if newConfirmBlock.BlockInfo.Height < m.scanConfirmHeight {
-					//发生回退
-					log.Info("confirm block height roll back", "height", newConfirmBlock.BlockInfo.Height, "coinType", m.coinType)
-					//m.checkUtxo(newConfirmBlock.BlockInfo.Height)
+		defer m.wg.Done()
+		defer m.recoverPanic()
+		if m.loadMode == "chain" {
+			err := m.loadUtxoFromChain()
+			if err != nil {
+				if m.ctx.Err() == nil {
+					m.fail(err)
 				}
-				m.scanConfirmHeight = newConfirmBlock.BlockInfo.Height + 1
+				return
+			}
+		}
 
-				height := strconv.Itoa(int(m.scanConfirmHeight))
-				err := m.levelDb.Put([]byte(confirmHeightLDKey), []byte(height))
-				if err != nil {
-					log.Error("Save confirmHeight Failed", "err", err.Error(), "height", height)
-				}
+		//先处理停机期间发生的回退，再从回退后的确认高度开始监听
+		err := m.recoverCommittedBlock()
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		//从最后提交的区块开始检测回退
+		var tipHash string
+		confirmHeight := m.GetScanConfirmHeight()
+		if commit := loadBlockCommit(m.levelDb, m.coinType); commit != nil && commit.ConfirmHeight == confirmHeight {
+			tipHash = commit.Hash
+		}
+		m.bwClient.SetConfirmTip(confirmHeight, tipHash)
+		m.bwClient.Start(m.ctx)
 
+		//修改utxo状态时持有m.Lock，与SelectUtxo、LockUtxo互斥
+		for {
+			select {
+			case blockEvent := <-blockEventChan:
+				m.handleBlockEvent(blockEvent)
 			case newTx := <-newTxChan:
-				m.processNewTx(newTx)
+				m.handleNewTx(newTx)
+			case removedTx := <-removedTxChan:
+				m.processRemovedTx(removedTx)
 			case newUnconfirmBlock := <-newUnconfirmBlockChan:
 				log.Info("process new block height:", "height", newUnconfirmBlock.BlockInfo.Height, "coinType", m.coinType)
-				m.processNewUnconfirmBlock(newUnconfirmBlock)
+				m.handleNewUnconfirmBlock(newUnconfirmBlock)
+			case <-m.bwClient.Done():
+				m.fail(m.bwClient.Err())
+				return
+			case <-m.ctx.Done():
+				return
 			}
 		}
 	}()
 
 }
 
+//Stop 停止监听，处理并提交已收到的区块，关闭RPC连接和leveldb
+func (m *MortgageWatcher) Stop() {
+	m.stopOnce.Do(func() {
+		//区块监听使用同一ctx，取消后不再产生新的区块事件
+		if m.cancel != nil {
+			m.cancel()
+		}
+		m.wg.Wait()
+		m.bwClient.Stop()
+
+		//确认高度随每个区块一起提交，不需要再单独保存，出错停止时内存状态不可信，不再处理剩余区块
+		//处理区块时可能通过RPC查询退款地址，处理完后再关闭RPC连接
+		if m.Err() == nil {
+			m.drainBlocks()
+		}
+		m.bwClient.Close()
+
+		err := m.levelDb.Close()
+		if err != nil {
+			log.Warn("close leveldb failed", "err", err.Error(), "coinType", m.coinType)
+		}
+		log.Info("mortgage watcher stopped", "height", m.scanConfirmHeight, "coinType", m.coinType)
+	})
+}
+
+//fail 监听出现无法恢复的错误，内存中的状态不再可信，停止处理区块
+//调用方在Done关闭后Stop，重新创建监听从leveldb恢复
+func (m *MortgageWatcher) fail(err error) {
+	m.failOnce.Do(func() {
+		log.Error("mortgage watcher failed", "err", err.Error(), "coinType", m.coinType)
+		m.failErr = err
+		close(m.failChan)
+		if m.cancel != nil {
+			m.cancel()
+		}
+	})
+}
+
+//recoverPanic 将监听goroutine中的panic转为错误，监听以错误停止，由调用方重新创建
+func (m *MortgageWatcher) recoverPanic() {
+	if r := recover(); r != nil {
+		m.fail(fmt.Errorf("mortgage watcher panic: %v\n%s", r, debug.Stack()))
+	}
+}
+
+//Done 监听出错停止时关闭，之后Err返回出错原因
+func (m *MortgageWatcher) Done() <-chan struct{} {
+	return m.failChan
+}
+
+//Err 返回监听出错停止的原因，正常运行时返回nil
+func (m *MortgageWatcher) Err() error {
+	select {
+	case <-m.failChan:
+		return m.failErr
+	default:
+		return nil
+	}
+}
+
+//drainBlocks 处理区块监听停止前已推送但尚未处理的区块
+func (m *MortgageWatcher) drainBlocks() {
+	blockEventChan := m.bwClient.GetBlockEventChan()
+	for {
+		select {
+		case blockEvent := <-blockEventChan:
+			m.handleBlockEvent(blockEvent)
+		default:
+			return
+		}
+	}
+}
+
+//handleNewTx 处理内存池新交易，panic时也会释放m.Lock
+func (m *MortgageWatcher) handleNewTx(newTx *wire.MsgTx) {
+	m.Lock()
+	defer m.Unlock()
+	m.processNewTx(newTx, nil)
+}
+
+func (m *MortgageWatcher) handleNewUnconfirmBlock(blockData *coinmanager.BlockData) {
+	m.Lock()
+	defer m.Unlock()
+	m.processNewUnconfirmBlock(blockData)
+}
+
+func (m *MortgageWatcher) handleBlockEvent(blockEvent *coinmanager.BlockEvent) {
+	if blockEvent.Disconnect {
+		m.handleDisconnectBlock(blockEvent.Block)
+		return
+	}
+	m.handleConfirmBlock(blockEvent.Block)
+}
+
+func (m *MortgageWatcher) handleConfirmBlock(newConfirmBlock *coinmanager.BlockData) {
+	if m.Err() != nil {
+		return
+	}
+	log.Info("process confirm block height:", "height", newConfirmBlock.BlockInfo.Height, "coinType", m.coinType)
+	m.Lock()
+	defer m.Unlock()
+	bc := newBlockCommit(m.levelDb)
+	m.processConfirmBlock(bc, newConfirmBlock)
+	if newConfirmBlock.BlockInfo.Height < m.scanConfirmHeight {
+		//发生回退
+		log.Info("confirm block height roll back", "height", newConfirmBlock.BlockInfo.Height, "coinType", m.coinType)
+	}
+	committed := m.commitBlock(bc, &blockCommitRecord{
+		Height:        newConfirmBlock.BlockInfo.Height,
+		Hash:          newConfirmBlock.BlockInfo.Hash,
+		ConfirmHeight: newConfirmBlock.BlockInfo.Height + 1,
+	})
+	if committed {
+		atomic.StoreInt64(&m.scanConfirmHeight, newConfirmBlock.BlockInfo.Height+1)
+	}
+}
+
+func (m *MortgageWatcher) handleDisconnectBlock(disconnectBlock *coinmanager.BlockData) {
+	if m.Err() != nil {
+		return
+	}
+	log.Info("process disconnect block height:", "height", disconnectBlock.BlockInfo.Height, "coinType", m.coinType)
+	m.Lock()
+	defer m.Unlock()
+	bc := newBlockCommit(m.levelDb)
+	undo := m.processDisconnectBlock(bc, disconnectBlock)
+	if undo == nil {
+		return
+	}
+	//回退后最后处理的确认区块为回退区块的父区块
+	committed := m.commitBlock(bc, &blockCommitRecord{
+		Height:        undo.Height - 1,
+		Hash:          undo.PrevHash,
+		ConfirmHeight: undo.Height,
+	})
+	if committed {
+		atomic.StoreInt64(&m.scanConfirmHeight, undo.Height)
+	}
+}
+
+//sleep 等待一段时间，监听停止时返回false
+func (m *MortgageWatcher) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-m.ctx.Done():
+		return false
+	}
+}
+
 //loadUtxoFromLevelDb 从leveldb中，load utxo进内存
 func (m *MortgageWatcher) loadUtxoFromLevelDb() {
 	iter := m.levelDb.NewIteratorWithPrefix([]byte(m.levelDbUtxoPreFix))
@@ -422,17 +765,128 @@ func (m *MortgageWatcher) loadUtxoFromLevelDb() {
 		if utxo.SpendType == 3 {
 			continue
 		}
+		//粉尘阈值可能修改过，按当前配置重新分类
+		utxo.IsDust = m.isDust(utxo.Value)
 
 		m.faUtxoInfo.Store(string(iter.Key())[9:], utxo)
 
 	}
 }
 
-func (m *MortgageWatcher) loadUtxo() {
+//loadUtxoFromChain 从first_block_height开始扫描到最新已确认区块，重建多签地址utxo
+//扫描结果与确认高度、最后一个区块记录一次写入，中途停止或失败时不写入，下次启动重新扫描
+//leveldb中已有确认高度时说明已经扫描过，已在创建时从leveldb中load
+func (m *MortgageWatcher) loadUtxoFromChain() error {
+	value, err := m.levelDb.Get([]byte(confirmHeightLDKey))
+	if value != nil && err == nil {
+		return nil
+	}
+
+	blockCount := m.bwClient.GetBlockCount()
+	if blockCount < 0 {
+		return errors.New("get block count failed")
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	endHeight := blockCount - m.confirmNum + 1
+	log.Info("load utxo from chain", "from", m.firstBlockHeight, "to", endHeight, "coinType", m.coinType)
+
+	bc := newBlockCommit(m.levelDb)
+	record := &blockCommitRecord{
+		Height:        m.GetScanConfirmHeight() - 1,
+		ConfirmHeight: m.GetScanConfirmHeight(),
+	}
+	for height := m.firstBlockHeight; height <= endHeight; height++ {
+		if err := m.ctx.Err(); err != nil {
+			return err
+		}
+		blockData := m.bwClient.GetBlockInfoByHeight(height)
+		if blockData == nil {
+			return fmt.Errorf("get block %d failed", height)
+		}
+		m.loadUtxoFromBlock(bc, blockData)
+		m.matureCoinbase(bc, height, nil)
+		record = &blockCommitRecord{
+			Height:        height,
+			Hash:          blockData.BlockInfo.Hash,
+			ConfirmHeight: height + 1,
+		}
+
+		if height%1000 == 0 {
+			log.Info("load utxo from chain progress", "height", height, "coinType", m.coinType)
+		}
+	}
+
+	if !m.commitBlock(bc, record) {
+		return m.Err()
+	}
+	atomic.StoreInt64(&m.scanConfirmHeight, record.ConfirmHeight)
+	return nil
+}
+
+//loadUtxoFromBlock 扫描一个已确认区块中多签地址的utxo变化，不推送抵押交易
+func (m *MortgageWatcher) loadUtxoFromBlock(db dbWriter, blockData *coinmanager.BlockData) {
+	for _, tx := range blockData.MsgBolck.Transactions {
+		txHash := tx.TxHash().String()
+		isFromFedAddr := false
+		isCoinbase := coinmanager.IsCoinBaseTx(tx)
+
+		for _, vin := range tx.TxIn {
+			utxoID := strings.Join([]string{vin.PreviousOutPoint.Hash.String(), strconv.Itoa(int(vin.PreviousOutPoint.Index))}, "_")
+			utxoInfo := m.GetUtxoInfoByID(utxoID)
+			if utxoInfo != nil {
+				isFromFedAddr = true
+				utxoInfo.SpendType = 3
+				m.storeUtxo(db, utxoID)
+				m.faUtxoInfo.Delete(utxoID)
+			}
+		}
+
+		if isFromFedAddr {
+			m.storeHashMapping(db, tx)
+		}
+
+		for voutIndex, vout := range tx.TxOut {
+			address := coinmanager.ExtractPkScriptAddr(vout.PkScript, m.coinType)
+			if address == "" {
+				continue
+			}
+			if _, ok := m.federationMap.Load(address); ok {
+				utxoID := strings.Join([]string{txHash, strconv.Itoa(voutIndex)}, "_")
+				spendType := 1
+				if isCoinbase {
+					spendType = 4
+				}
+				m.faUtxoInfo.Store(utxoID, &coinmanager.UtxoInfo{
+					Address:     address,
+					Txid:        txHash,
+					Vout:        uint32(voutIndex),
+					Value:       vout.Value,
+					SpendType:   spendType,
+					BlockHeight: blockData.BlockInfo.Height,
+					IsDust:      m.isDust(vout.Value),
+					Coinbase:    isCoinbase,
+				})
+				m.storeUtxo(db, utxoID)
+				log.Debug("LOAD UTXO FROM CHAIN", "id", utxoID, "value", vout.Value, "coinType", m.coinType)
+			}
+		}
+	}
+}
+
+func (m *MortgageWatcher) loadUtxo() error {
 	switch m.loadMode {
 	case "leveldb":
 		m.loadUtxoFromLevelDb()
 	case "chain":
-		//m.loadUtxoFromChain()
+		//已扫描过时从leveldb中load，否则在Start中扫描链上区块
+		value, err := m.levelDb.Get([]byte(confirmHeightLDKey))
+		if value != nil && err == nil {
+			log.Info("confirm height exists, load utxo from leveldb", "height", string(value), "coinType", m.coinType)
+			m.loadUtxoFromLevelDb()
+		}
 	}
+	return nil
 }
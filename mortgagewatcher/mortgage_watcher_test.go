@@ -0,0 +1,128 @@
+package mortgagewatcher
+
+import (
+	"context"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/JimmyHongjichuan/btc_watcher/dbop"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	//testRedeemScript 2-of-2多签兑现脚本，公钥为secp256k1的G和2G
+	testRedeemScript = "52210279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f817982102c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee552ae"
+	//testFederationAddress testRedeemScript对应的主网P2SH地址
+	testFederationAddress = "33RQmypKhD6f4tMquiR5a3C6dRT7eBpaiG"
+	//testSenderPubKey 转入交易P2PKH输入中的公钥，对应地址testSenderAddress
+	testSenderPubKey  = "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	testSenderAddress = "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"
+	//testEthAddress payload中的目标链地址
+	testEthAddress = "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"
+)
+
+//newTestMortgageWatcher 创建使用内存存储、不连接全节点的监听实例，监听testFederationAddress
+func newTestMortgageWatcher(t *testing.T, coinType string) *MortgageWatcher {
+	mw := &MortgageWatcher{
+		levelDb:            dbop.NewMemDatabase(),
+		coinType:           coinType,
+		mortgageTxChan:     make(chan *SubTransaction, 100),
+		retractTxChan:      make(chan *SubTransaction, 100),
+		removedDepositChan: make(chan *RemovedDeposit, 100),
+		depositEventChan:   make(chan *DepositEvent, 100),
+		depositFeeChan:     make(chan *depositFeeJob, 100),
+		failChan:           make(chan struct{}),
+		timeout:            60,
+		confirmNum:         1,
+		coinbaseConfirmNum: defaultCoinbaseConfirmNum,
+	}
+	mw.initLevelDbPrefix()
+	mw.ctx, mw.cancel = context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		mw.cancel()
+		mw.wg.Wait()
+		mw.levelDb.Close()
+	})
+
+	redeemScript, _ := hex.DecodeString(testRedeemScript)
+	if err := mw.addFederationAddress(testFederationAddress, redeemScript); err != nil {
+		t.Fatalf("add federation address: %v", err)
+	}
+	return mw
+}
+
+//newTestPayload 生成转给testEthAddress的版本1 payload
+func newTestPayload(t *testing.T, appNumber uint32) []byte {
+	script, err := EncodePayLoadScript("eth", appNumber, []*PayloadRecipient{{Address: testEthAddress}}, "")
+	if err != nil {
+		t.Fatalf("encode payload: %v", err)
+	}
+	return script
+}
+
+//newTestDepositTx 生成从testSenderAddress转入多签地址的交易，seed区分花费的输出，payload为nil时没有op_return输出
+func newTestDepositTx(t *testing.T, seed byte, amount int64, payload []byte) *wire.MsgTx {
+	pubKey, _ := hex.DecodeString(testSenderPubKey)
+	sigScript, err := txscript.NewScriptBuilder().AddData(make([]byte, 71)).AddData(pubKey).Script()
+	if err != nil {
+		t.Fatalf("build signature script: %v", err)
+	}
+	pkScript, err := coinmanager.PayToAddrScript(testFederationAddress, "btc")
+	if err != nil {
+		t.Fatalf("build federation pk script: %v", err)
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{seed}, 0), sigScript, nil))
+	tx.AddTxOut(wire.NewTxOut(amount, pkScript))
+	if payload != nil {
+		tx.AddTxOut(wire.NewTxOut(0, payload))
+	}
+	return tx
+}
+
+//newTestSpendTx 生成花费多签地址utxo的交易
+func newTestSpendTx(prevTx *wire.MsgTx, vout uint32) *wire.MsgTx {
+	prevHash := prevTx.TxHash()
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, vout), []byte{txscript.OP_0}, nil))
+	tx.AddTxOut(wire.NewTxOut(prevTx.TxOut[vout].Value-1000, []byte{txscript.OP_TRUE}))
+	return tx
+}
+
+//newTestBlock 生成height高度、父区块为prev的区块，prev为nil时父区块hash为空
+func newTestBlock(height int64, prev *coinmanager.BlockData, txs ...*wire.MsgTx) *coinmanager.BlockData {
+	header := wire.BlockHeader{
+		Version:   1,
+		Timestamp: time.Unix(1500000000+height*600, 0),
+		Nonce:     uint32(height),
+	}
+	prevHash := ""
+	if prev != nil {
+		header.PrevBlock = prev.MsgBolck.BlockHash()
+		prevHash = prev.BlockInfo.Hash
+	}
+	block := wire.NewMsgBlock(&header)
+	for _, tx := range txs {
+		block.AddTransaction(tx)
+	}
+	return &coinmanager.BlockData{
+		BlockInfo: &btcjson.GetBlockVerboseResult{
+			Height:       height,
+			Hash:         block.BlockHash().String(),
+			PreviousHash: prevHash,
+		},
+		MsgBolck: block,
+	}
+}
+
+func testUtxoID(tx *wire.MsgTx, vout int) string {
+	return strings.Join([]string{tx.TxHash().String(), strconv.Itoa(vout)}, "_")
+}
@@ -0,0 +1,290 @@
+package mortgagewatcher
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+var defaultDispatchInterval = 1
+
+//defaultRedeliverTimeout chan模式下已推送但超过该时间(秒)未AckMortgageTx的条目重新推送
+var defaultRedeliverTimeout = 600
+
+//MortgageTxHandler 抵押交易处理接口
+//HandleMortgageTx 返回nil视为已确认(ack)，返回error则稍后重试
+type MortgageTxHandler interface {
+	HandleMortgageTx(tx *SubTransaction) error
+}
+
+//MortgageTxRetractHandler 抵押交易撤回处理接口，MortgageTxHandler可选实现
+//已推送的抵押交易所在区块被回退时调用，返回nil视为已确认
+type MortgageTxRetractHandler interface {
+	RetractMortgageTx(tx *SubTransaction) error
+}
+
+//outboxEntry 待确认的抵押交易或抵押交易撤回
+type outboxEntry struct {
+	Seq       uint64          `json:"seq"`
+	Tx        *SubTransaction `json:"tx"`
+	Retract   bool            `json:"retract,omitempty"`
+	delivered bool
+	//deliveredAt 最近一次推送的时间，用于chan模式下超时重新推送
+	deliveredAt time.Time
+}
+
+func (e *outboxEntry) id() string {
+	if e.Retract {
+		return getRetractID(e.Tx.ScTxid)
+	}
+	return e.Tx.ScTxid
+}
+
+func getRetractID(scTxid string) string {
+	return strings.Join([]string{scTxid, "retract"}, "_")
+}
+
+func (m *MortgageWatcher) getOutboxKey(id string) []byte {
+	return []byte(strings.Join([]string{m.levelDbOutboxPreFix, id}, "_"))
+}
+
+//SetMortgageTxHandler 设置抵押交易处理接口，需在StartWatch之前调用
+//未设置时抵押交易推送到GetMortgageTxChan返回的chan中，由调用方AckMortgageTx确认
+func (m *MortgageWatcher) SetMortgageTxHandler(handler MortgageTxHandler) {
+	m.Lock()
+	defer m.Unlock()
+	m.mortgageTxHandler = handler
+}
+
+//GetMortgageTxChan 获取抵押交易chan
+//推送后需调用AckMortgageTx确认，超过defaultRedeliverTimeout秒未确认的抵押交易会重新推送，调用方需按ScTxid去重
+func (m *MortgageWatcher) GetMortgageTxChan() <-chan *SubTransaction {
+	return m.mortgageTxChan
+}
+
+//GetRetractTxChan 获取抵押交易撤回chan，已推送的抵押交易所在区块被回退时推送
+//与GetMortgageTxChan相同，超时未AckRetractMortgageTx的撤回会重新推送
+func (m *MortgageWatcher) GetRetractTxChan() <-chan *SubTransaction {
+	return m.retractTxChan
+}
+
+//AckMortgageTx 确认抵押交易已被处理，从outbox中删除
+//未确认的抵押交易在重启后会重新推送，调用方需按ScTxid去重
+func (m *MortgageWatcher) AckMortgageTx(scTxid string) error {
+	return m.ackOutboxEntry(scTxid, false)
+}
+
+//AckRetractMortgageTx 确认抵押交易撤回已被处理，从outbox中删除
+func (m *MortgageWatcher) AckRetractMortgageTx(scTxid string) error {
+	return m.ackOutboxEntry(getRetractID(scTxid), true)
+}
+
+//ackOutboxEntry 删除已确认的outbox条目，抵押交易记录为已确认
+//与区块处理使用同一个m.Lock，避免区块批次提交时覆盖确认状态；条目已被撤回时不再记录确认状态
+func (m *MortgageWatcher) ackOutboxEntry(id string, retract bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	_, ok := m.outbox.Load(id)
+	err := m.deleteOutboxEntry(m.levelDb, id)
+	if err != nil {
+		return err
+	}
+	if ok && !retract {
+		m.updateDepositState(m.levelDb, id, DepositStateAcknowledged, 0, "", nil)
+	}
+	return nil
+}
+
+func (m *MortgageWatcher) deleteOutboxEntry(db dbWriter, id string) error {
+	err := db.Delete(m.getOutboxKey(id))
+	if err != nil {
+		log.Warn("delete outbox tx failed", "err", err.Error(), "id", id, "coinType", m.coinType)
+		return err
+	}
+	m.outbox.Delete(id)
+	log.Debug("ack outbox tx", "id", id, "coinType", m.coinType)
+	return nil
+}
+
+//pushMortgageTx 持久化抵押交易到outbox，等待分发
+func (m *MortgageWatcher) pushMortgageTx(db dbWriter, tx *SubTransaction) {
+	m.pushOutboxEntry(db, tx, false)
+	m.updateRecentMortgageTx(db, &outboxEntry{Tx: tx})
+}
+
+//retractMortgageTx 撤回抵押交易，未分发的直接删除，已分发的推送撤回
+func (m *MortgageWatcher) retractMortgageTx(db dbWriter, scTxid string) {
+	m.outboxLock.Lock()
+	t, ok := m.outbox.Load(scTxid)
+	var entry *outboxEntry
+	delivered := false
+	if ok {
+		entry = t.(*outboxEntry)
+		delivered = entry.delivered
+	}
+	m.outboxLock.Unlock()
+
+	m.updateRecentMortgageTx(db, &outboxEntry{Tx: &SubTransaction{ScTxid: scTxid}, Retract: true})
+	if entry != nil {
+		m.deleteOutboxEntry(db, scTxid)
+		if !delivered {
+			log.Info("drop undelivered mortgage tx", "scTxid", scTxid, "coinType", m.coinType)
+			return
+		}
+	}
+
+	tx := &SubTransaction{ScTxid: scTxid}
+	if entry != nil {
+		tx = entry.Tx
+	}
+	log.Info("retract mortgage tx", "scTxid", scTxid, "coinType", m.coinType)
+	m.pushOutboxEntry(db, tx, true)
+}
+
+func (m *MortgageWatcher) pushOutboxEntry(db dbWriter, tx *SubTransaction, retract bool) {
+	entry := &outboxEntry{
+		Seq:     atomic.AddUint64(&m.outboxSeq, 1),
+		Tx:      tx,
+		Retract: retract,
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Warn("Marshal outbox tx failed", "err", err.Error(), "coinType", m.coinType)
+		return
+	}
+	err = db.Put(m.getOutboxKey(entry.id()), data)
+	if err != nil {
+		log.Warn("save outbox tx failed", "err", err.Error(), "coinType", m.coinType)
+	}
+
+	m.storeOutboxEntry(db, entry)
+}
+
+//loadOutbox 从leveldb中load未确认的抵押交易，重启后重新推送
+func (m *MortgageWatcher) loadOutbox() {
+	iter := m.levelDb.NewIteratorWithPrefix([]byte(m.levelDbOutboxPreFix))
+	defer iter.Release()
+	for iter.Next() {
+		entry := &outboxEntry{}
+		err := json.Unmarshal(iter.Value(), entry)
+		if err != nil || entry.Tx == nil {
+			log.Warn("Unmarshal outbox tx FROM LEVELDB ERR", "key", string(iter.Key()), "coinType", m.coinType)
+			continue
+		}
+		if entry.Seq > m.outboxSeq {
+			m.outboxSeq = entry.Seq
+		}
+		m.outbox.Store(entry.id(), entry)
+		log.Debug("load outbox tx from leveldb", "id", entry.id(), "coinType", m.coinType)
+	}
+}
+
+//nextUndeliveredEntry 按推送顺序返回下一个尚未分发的条目，并标记为已分发
+//redeliverTimeout大于0时，已分发超过redeliverTimeout仍未确认的条目视为未分发
+func (m *MortgageWatcher) nextUndeliveredEntry(redeliverTimeout time.Duration) *outboxEntry {
+	m.outboxLock.Lock()
+	defer m.outboxLock.Unlock()
+
+	now := time.Now()
+	var entries []*outboxEntry
+	m.outbox.Range(func(k, v interface{}) bool {
+		entry := v.(*outboxEntry)
+		if !entry.delivered || (redeliverTimeout > 0 && now.Sub(entry.deliveredAt) >= redeliverTimeout) {
+			entries = append(entries, entry)
+		}
+		return true
+	})
+	if len(entries) == 0 {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+	if entries[0].delivered {
+		log.Info("redeliver unacked outbox tx", "id", entries[0].id(), "coinType", m.coinType)
+	}
+	entries[0].delivered = true
+	entries[0].deliveredAt = now
+	return entries[0]
+}
+
+func (m *MortgageWatcher) markUndelivered(entry *outboxEntry) {
+	m.outboxLock.Lock()
+	defer m.outboxLock.Unlock()
+	entry.delivered = false
+}
+
+//deliverEntry 分发一个outbox条目，返回false表示需要稍后重试
+func (m *MortgageWatcher) deliverEntry(handler MortgageTxHandler, entry *outboxEntry) bool {
+	if handler == nil {
+		ch := m.mortgageTxChan
+		if entry.Retract {
+			ch = m.retractTxChan
+		}
+		select {
+		case ch <- entry.Tx:
+			return true
+		case <-m.ctx.Done():
+			return false
+		}
+	}
+
+	var err error
+	if entry.Retract {
+		retractHandler, ok := handler.(MortgageTxRetractHandler)
+		if ok {
+			err = retractHandler.RetractMortgageTx(entry.Tx)
+		}
+	} else {
+		err = handler.HandleMortgageTx(entry.Tx)
+	}
+	if err != nil {
+		log.Warn("handle outbox tx failed", "err", err.Error(), "id", entry.id(), "coinType", m.coinType)
+		return false
+	}
+
+	m.ackOutboxEntry(entry.id(), entry.Retract)
+	return true
+}
+
+//mortgageTxDispatcher 分发outbox中的抵押交易，避免阻塞区块处理
+func (m *MortgageWatcher) mortgageTxDispatcher() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer m.recoverPanic()
+		for {
+			m.Lock()
+			handler := m.mortgageTxHandler
+			m.Unlock()
+
+			//handler处理成功后直接删除条目，只有chan模式需要等待调用方确认
+			var redeliverTimeout time.Duration
+			if handler == nil {
+				redeliverTimeout = time.Duration(defaultRedeliverTimeout) * time.Second
+			}
+
+			for {
+				entry := m.nextUndeliveredEntry(redeliverTimeout)
+				if entry == nil {
+					break
+				}
+				if !m.deliverEntry(handler, entry) {
+					m.markUndelivered(entry)
+					break
+				}
+			}
+
+			if !m.sleep(time.Duration(defaultDispatchInterval) * time.Second) {
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,161 @@
+package mortgagewatcher
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboxRedeliverUnacked(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.pushMortgageTx(mw.levelDb, &SubTransaction{ScTxid: "a"})
+	mw.pushMortgageTx(mw.levelDb, &SubTransaction{ScTxid: "b"})
+
+	redeliverTimeout := 50 * time.Millisecond
+	for _, want := range []string{"a", "b"} {
+		entry := mw.nextUndeliveredEntry(redeliverTimeout)
+		if entry == nil || entry.id() != want {
+			t.Fatalf("got entry %v, want %s", entry, want)
+		}
+	}
+	if entry := mw.nextUndeliveredEntry(redeliverTimeout); entry != nil {
+		t.Fatalf("got entry %s before redeliver timeout, want nil", entry.id())
+	}
+
+	if err := mw.AckMortgageTx("a"); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if _, err := mw.levelDb.Get(mw.getOutboxKey("a")); err == nil {
+		t.Error("acked entry still in leveldb")
+	}
+
+	//超时未确认的条目按推送顺序重新推送，已确认的不再推送
+	time.Sleep(2 * redeliverTimeout)
+	entry := mw.nextUndeliveredEntry(redeliverTimeout)
+	if entry == nil || entry.id() != "b" {
+		t.Fatalf("got entry %v after redeliver timeout, want b", entry)
+	}
+	if entry := mw.nextUndeliveredEntry(redeliverTimeout); entry != nil {
+		t.Fatalf("got entry %s right after redeliver, want nil", entry.id())
+	}
+}
+
+func TestOutboxNoRedeliverWithoutTimeout(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.pushMortgageTx(mw.levelDb, &SubTransaction{ScTxid: "a"})
+
+	//handler模式下不按超时重新推送，只有处理失败时重新推送
+	entry := mw.nextUndeliveredEntry(0)
+	if entry == nil {
+		t.Fatal("got nil entry, want a")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if next := mw.nextUndeliveredEntry(0); next != nil {
+		t.Fatalf("got entry %s without redeliver timeout, want nil", next.id())
+	}
+
+	mw.markUndelivered(entry)
+	if next := mw.nextUndeliveredEntry(0); next == nil || next.id() != "a" {
+		t.Fatalf("got entry %v after markUndelivered, want a", next)
+	}
+}
+
+func TestOutboxDispatcherRedeliverToChan(t *testing.T) {
+	oldTimeout := defaultRedeliverTimeout
+	defaultRedeliverTimeout = 1
+	//在监听实例停止后恢复
+	t.Cleanup(func() {
+		defaultRedeliverTimeout = oldTimeout
+	})
+
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.pushMortgageTx(mw.levelDb, &SubTransaction{ScTxid: "a"})
+	mw.mortgageTxDispatcher()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case tx := <-mw.GetMortgageTxChan():
+			if tx.ScTxid != "a" {
+				t.Fatalf("delivery %d: got %s, want a", i, tx.ScTxid)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("delivery %d: unacked mortgage tx not delivered", i)
+		}
+	}
+
+	mw.AckMortgageTx("a")
+	select {
+	case tx := <-mw.GetMortgageTxChan():
+		t.Errorf("got %s after ack, want no delivery", tx.ScTxid)
+	case <-time.After(2500 * time.Millisecond):
+	}
+}
+
+func TestAckMortgageTxStateTransitions(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	deposit := newTestDepositTx(t, 1, 100000, newTestPayload(t, 1))
+	scTxid := deposit.TxHash().String()
+	mw.handleNewTx(deposit)
+	block := newTestBlock(100, nil, deposit)
+	mw.handleConfirmBlock(block)
+	mw.nextUndeliveredEntry(0)
+
+	if err := mw.AckMortgageTx(scTxid); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	//所在区块回退后撤回，迟到的确认不覆盖回退状态
+	mw.handleDisconnectBlock(block)
+	if err := mw.AckMortgageTx(scTxid); err != nil {
+		t.Fatalf("ack after retract: %v", err)
+	}
+	if err := mw.AckRetractMortgageTx(scTxid); err != nil {
+		t.Fatalf("ack retract: %v", err)
+	}
+
+	record := mw.GetDepositRecord(scTxid)
+	if record == nil {
+		t.Fatal("no deposit record")
+	}
+	var states []string
+	for _, transition := range record.Transitions {
+		states = append(states, transition.State)
+	}
+	expected := []string{DepositStateSeenInMempool, DepositStateConfirmed, DepositStateEmitted, DepositStateAcknowledged, DepositStateReorged}
+	if strings.Join(states, ",") != strings.Join(expected, ",") {
+		t.Errorf("got transitions %v, want %v", states, expected)
+	}
+	if record.State != DepositStateReorged || record.BlockHeight != 0 {
+		t.Errorf("got state %s height %d, want reorged", record.State, record.BlockHeight)
+	}
+}
+
+func TestAckMortgageTxWaitsForBlock(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	deposit := newTestDepositTx(t, 1, 100000, newTestPayload(t, 1))
+	scTxid := deposit.TxHash().String()
+	mw.handleConfirmBlock(newTestBlock(100, nil, deposit))
+	mw.nextUndeliveredEntry(0)
+
+	//区块处理持有m.Lock期间确认等待，不与区块批次交错写入
+	mw.Lock()
+	done := make(chan error)
+	go func() {
+		done <- mw.AckMortgageTx(scTxid)
+	}()
+	select {
+	case <-done:
+		t.Fatal("ack finished while block processing holds the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if record := mw.GetDepositRecord(scTxid); record == nil || record.State != DepositStateEmitted {
+		t.Errorf("got deposit record %+v during block processing, want emitted", record)
+	}
+	mw.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if record := mw.GetDepositRecord(scTxid); record == nil || record.State != DepositStateAcknowledged {
+		t.Errorf("got deposit record %+v, want acknowledged", record)
+	}
+}
@@ -0,0 +1,250 @@
+package mortgagewatcher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+)
+
+var prefix = []byte{0x00, 0x66, 0x67, 0x70}
+
+//ErrPayloadPrefix op_return中的数据不是以payload前缀开头
+var ErrPayloadPrefix = errors.New("payload prefix error")
+
+//PayloadVersion1 当前的payload版本
+const PayloadVersion1 byte = 0x01
+
+const (
+	maxRecipientNum    = 16
+	maxMemoLen         = 64
+	addrChecksumLen    = 4
+	recipientAmountLen = 8
+)
+
+//op_return payload格式
+//旧格式(版本0): OP_RETURN <prefix> <chainName> <appNumber 4字节> <address>
+//版本1:        OP_RETURN <prefix 0x01> <chainName> <appNumber 4字节> <recipients> [memo]
+//版本号附加在prefix之后，单独push的单字节数据会被编码为OP_1~OP_16
+//recipients为一个或多个 [地址长度 1字节][地址][金额 8字节][地址校验和 4字节]，校验和为double-sha256(地址)的前4字节
+//金额单位为聪，为0表示接收剩余的全部金额，最多只能有一个为0
+
+//ParserPayLoadScript 解析op_return script到Message
+func ParserPayLoadScript(script []byte) (*Message, error) {
+	payload, err := txscript.PushedData(script)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) == 0 || !bytes.HasPrefix(payload[0], prefix) {
+		return nil, ErrPayloadPrefix
+	}
+
+	if len(payload) < 4 {
+		return nil, errors.New("payload len error")
+	}
+
+	switch len(payload[0]) {
+	case len(prefix):
+		if len(payload) != 4 {
+			return nil, errors.New("payload len error")
+		}
+		return parseLegacyPayload(payload)
+	case len(prefix) + 1:
+		version := payload[0][len(prefix)]
+		if version != PayloadVersion1 {
+			return nil, fmt.Errorf("unsupported payload version %d", version)
+		}
+		return parsePayloadV1(payload)
+	default:
+		return nil, ErrPayloadPrefix
+	}
+}
+
+func parseLegacyPayload(payload [][]byte) (*Message, error) {
+	message := &Message{}
+
+	//parser chainName
+	message.ChainName = string(payload[1])
+
+	buf := bytes.NewBuffer(payload[2])
+	err := binary.Read(buf, binary.BigEndian, &message.APPNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	message.Address = string(payload[3])
+	message.Recipients = []*PayloadRecipient{
+		{Address: message.Address},
+	}
+
+	return message, nil
+}
+
+func parsePayloadV1(payload [][]byte) (*Message, error) {
+	if len(payload) != 4 && len(payload) != 5 {
+		return nil, errors.New("payload len error")
+	}
+
+	message := &Message{
+		Version:   PayloadVersion1,
+		ChainName: string(payload[1]),
+	}
+	if message.ChainName == "" {
+		return nil, errors.New("empty chain name")
+	}
+
+	if len(payload[2]) != 4 {
+		return nil, errors.New("app number len error")
+	}
+	message.APPNumber = binary.BigEndian.Uint32(payload[2])
+
+	recipients, err := parseRecipients(payload[3])
+	if err != nil {
+		return nil, err
+	}
+	message.Recipients = recipients
+	message.Address = recipients[0].Address
+
+	if len(payload) == 5 {
+		if len(payload[4]) > maxMemoLen {
+			return nil, errors.New("memo too long")
+		}
+		message.Memo = string(payload[4])
+	}
+
+	return message, nil
+}
+
+func parseRecipients(data []byte) ([]*PayloadRecipient, error) {
+	var recipients []*PayloadRecipient
+	var zeroAmountNum int
+	for len(data) > 0 {
+		addrLen := int(data[0])
+		if addrLen == 0 || len(data) < 1+addrLen+recipientAmountLen+addrChecksumLen {
+			return nil, errors.New("recipient len error")
+		}
+		addr := data[1 : 1+addrLen]
+		data = data[1+addrLen:]
+
+		amount := int64(binary.BigEndian.Uint64(data[:recipientAmountLen]))
+		if amount < 0 || amount > btcutil.MaxSatoshi {
+			return nil, errors.New("recipient amount error")
+		}
+		if amount == 0 {
+			zeroAmountNum++
+		}
+		data = data[recipientAmountLen:]
+
+		if !bytes.Equal(data[:addrChecksumLen], addressChecksum(addr)) {
+			return nil, fmt.Errorf("address checksum error: %s", string(addr))
+		}
+		data = data[addrChecksumLen:]
+
+		recipients = append(recipients, &PayloadRecipient{
+			Address: string(addr),
+			Amount:  amount,
+		})
+	}
+
+	if len(recipients) == 0 {
+		return nil, errors.New("empty recipients")
+	}
+	if len(recipients) > maxRecipientNum {
+		return nil, errors.New("too many recipients")
+	}
+	if zeroAmountNum > 1 {
+		return nil, errors.New("more than one recipient without amount")
+	}
+	return recipients, nil
+}
+
+func addressChecksum(addr []byte) []byte {
+	return chainhash.DoubleHashB(addr)[:addrChecksumLen]
+}
+
+//EncodePayLoadScript 生成版本1的op_return script，供前端构造抵押交易
+//只有一个接收地址时Amount可以为0，表示接收抵押的全部金额
+func EncodePayLoadScript(chainName string, appNumber uint32, recipients []*PayloadRecipient, memo string) ([]byte, error) {
+	if chainName == "" {
+		return nil, errors.New("empty chain name")
+	}
+	if len(recipients) == 0 || len(recipients) > maxRecipientNum {
+		return nil, errors.New("invalid recipient number")
+	}
+	if len(memo) > maxMemoLen {
+		return nil, errors.New("memo too long")
+	}
+	if len(chainName) == 1 || len(memo) == 1 {
+		//单字节数据会被编码为小整数操作码，解析时无法取回
+		return nil, errors.New("chain name and memo must be longer than one byte")
+	}
+
+	var zeroAmountNum int
+	var recipientData bytes.Buffer
+	for _, recipient := range recipients {
+		if len(recipient.Address) == 0 || len(recipient.Address) > 0xff {
+			return nil, fmt.Errorf("invalid recipient address: %s", recipient.Address)
+		}
+		if recipient.Amount < 0 || recipient.Amount > btcutil.MaxSatoshi {
+			return nil, errors.New("recipient amount error")
+		}
+		if recipient.Amount == 0 {
+			zeroAmountNum++
+		}
+
+		recipientData.WriteByte(byte(len(recipient.Address)))
+		recipientData.WriteString(recipient.Address)
+		binary.Write(&recipientData, binary.BigEndian, uint64(recipient.Amount))
+		recipientData.Write(addressChecksum([]byte(recipient.Address)))
+	}
+	if zeroAmountNum > 1 {
+		return nil, errors.New("more than one recipient without amount")
+	}
+
+	appNumberData := make([]byte, 4)
+	binary.BigEndian.PutUint32(appNumberData, appNumber)
+
+	builder := txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).
+		AddData(append(append([]byte{}, prefix...), PayloadVersion1)).
+		AddData([]byte(chainName)).
+		AddData(appNumberData).
+		AddData(recipientData.Bytes())
+	if memo != "" {
+		builder.AddData([]byte(memo))
+	}
+	return builder.Script()
+}
+
+//allocateRecipients 按payload中的金额分配抵押金额，金额为0的地址接收剩余部分
+func allocateRecipients(recipients []*PayloadRecipient, amount int64) ([]*AddressInfo, error) {
+	var allocated int64
+	for _, recipient := range recipients {
+		allocated += recipient.Amount
+	}
+	if allocated > amount {
+		return nil, fmt.Errorf("recipient amount %d exceed deposit amount %d", allocated, amount)
+	}
+
+	var rechargeList []*AddressInfo
+	var hasRemainder bool
+	for _, recipient := range recipients {
+		value := recipient.Amount
+		if value == 0 {
+			value = amount - allocated
+			hasRemainder = true
+		}
+		rechargeList = append(rechargeList, &AddressInfo{
+			Address: recipient.Address,
+			Amount:  value,
+		})
+	}
+	if !hasRemainder && allocated != amount {
+		return nil, fmt.Errorf("recipient amount %d not equal to deposit amount %d", allocated, amount)
+	}
+	return rechargeList, nil
+}
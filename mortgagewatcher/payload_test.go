@@ -0,0 +1,203 @@
+package mortgagewatcher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/txscript"
+)
+
+//buildTestPayloadScript 按版本1格式直接拼出op_return script，checksum为nil时使用正确的校验和
+func buildTestPayloadScript(t *testing.T, version byte, chainName string, appNumber uint32, addr string, amount int64, checksum []byte) []byte {
+	var recipient bytes.Buffer
+	recipient.WriteByte(byte(len(addr)))
+	recipient.WriteString(addr)
+	binary.Write(&recipient, binary.BigEndian, uint64(amount))
+	if checksum == nil {
+		checksum = addressChecksum([]byte(addr))
+	}
+	recipient.Write(checksum)
+
+	appNumberData := make([]byte, 4)
+	binary.BigEndian.PutUint32(appNumberData, appNumber)
+	script, err := txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).
+		AddData(append(append([]byte{}, prefix...), version)).
+		AddData([]byte(chainName)).
+		AddData(appNumberData).
+		AddData(recipient.Bytes()).
+		Script()
+	if err != nil {
+		t.Fatalf("build payload script: %v", err)
+	}
+	return script
+}
+
+func TestPayloadV1RoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		chainName  string
+		appNumber  uint32
+		recipients []*PayloadRecipient
+		memo       string
+	}{
+		{"single recipient", "eth", 1, []*PayloadRecipient{{Address: "0x2d6b2b8c4ad1a7d3c3f1c5e1a8b6d4f5e6a7b8c9"}}, ""},
+		{"with memo", "eth", 0x01020304, []*PayloadRecipient{{Address: "0x2d6b2b8c4ad1a7d3c3f1c5e1a8b6d4f5e6a7b8c9", Amount: 1000}}, "order-42"},
+		{"multiple recipients", "xin", 7, []*PayloadRecipient{
+			{Address: "addr-one", Amount: 1500},
+			{Address: "addr-two", Amount: 0},
+			{Address: "addr-three", Amount: 2500},
+		}, ""},
+	}
+
+	for _, test := range tests {
+		script, err := EncodePayLoadScript(test.chainName, test.appNumber, test.recipients, test.memo)
+		if err != nil {
+			t.Errorf("%s: encode error: %v", test.name, err)
+			continue
+		}
+		message, err := ParserPayLoadScript(script)
+		if err != nil {
+			t.Errorf("%s: parse error: %v", test.name, err)
+			continue
+		}
+		if message.Version != PayloadVersion1 || message.ChainName != test.chainName || message.APPNumber != test.appNumber ||
+			message.Memo != test.memo || message.Address != test.recipients[0].Address {
+			t.Errorf("%s: got message %+v", test.name, message)
+		}
+		if fmt.Sprint(recipientStrings(message.Recipients)) != fmt.Sprint(recipientStrings(test.recipients)) {
+			t.Errorf("%s: got recipients %v, want %v", test.name, recipientStrings(message.Recipients), recipientStrings(test.recipients))
+		}
+	}
+}
+
+func recipientStrings(recipients []*PayloadRecipient) []string {
+	var result []string
+	for _, recipient := range recipients {
+		result = append(result, fmt.Sprintf("%s:%d", recipient.Address, recipient.Amount))
+	}
+	return result
+}
+
+func TestPayloadLegacy(t *testing.T) {
+	appNumberData := make([]byte, 4)
+	binary.BigEndian.PutUint32(appNumberData, 3)
+	script, err := txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).
+		AddData(prefix).
+		AddData([]byte("eth")).
+		AddData(appNumberData).
+		AddData([]byte("0xabcdef")).
+		Script()
+	if err != nil {
+		t.Fatalf("build legacy script: %v", err)
+	}
+
+	message, err := ParserPayLoadScript(script)
+	if err != nil {
+		t.Fatalf("parse legacy payload: %v", err)
+	}
+	if message.Version != 0 || message.ChainName != "eth" || message.APPNumber != 3 || message.Address != "0xabcdef" ||
+		len(message.Recipients) != 1 || message.Recipients[0].Address != "0xabcdef" || message.Recipients[0].Amount != 0 {
+		t.Errorf("got message %+v", message)
+	}
+}
+
+func TestPayloadParseInvalid(t *testing.T) {
+	addr := "0xabcdef"
+	checksum := addressChecksum([]byte(addr))
+	badChecksum := append([]byte{}, checksum...)
+	badChecksum[0] ^= 0xff
+
+	notPayload, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).AddData([]byte("hello world")).Script()
+	truncated := buildTestPayloadScript(t, PayloadVersion1, "eth", 1, addr, 1, checksum[:2])
+
+	tests := []struct {
+		name   string
+		script []byte
+	}{
+		{"checksum error", buildTestPayloadScript(t, PayloadVersion1, "eth", 1, addr, 1, badChecksum)},
+		{"unsupported version", buildTestPayloadScript(t, 0x02, "eth", 1, addr, 1, nil)},
+		{"empty chain name", buildTestPayloadScript(t, PayloadVersion1, "", 1, addr, 1, nil)},
+		{"amount overflow", buildTestPayloadScript(t, PayloadVersion1, "eth", 1, addr, -1, nil)},
+		{"truncated recipient", truncated},
+		{"not payload", notPayload},
+	}
+
+	for _, test := range tests {
+		if _, err := ParserPayLoadScript(test.script); err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+
+	if _, err := ParserPayLoadScript(notPayload); err != ErrPayloadPrefix {
+		t.Errorf("not payload: got err %v, want ErrPayloadPrefix", err)
+	}
+}
+
+func TestPayloadEncodeInvalid(t *testing.T) {
+	var tooMany []*PayloadRecipient
+	for i := 0; i <= maxRecipientNum; i++ {
+		tooMany = append(tooMany, &PayloadRecipient{Address: fmt.Sprintf("addr-%d", i), Amount: 1})
+	}
+
+	tests := []struct {
+		name       string
+		chainName  string
+		recipients []*PayloadRecipient
+		memo       string
+	}{
+		{"empty chain name", "", []*PayloadRecipient{{Address: "addr"}}, ""},
+		{"one byte chain name", "e", []*PayloadRecipient{{Address: "addr"}}, ""},
+		{"one byte memo", "eth", []*PayloadRecipient{{Address: "addr"}}, "m"},
+		{"memo too long", "eth", []*PayloadRecipient{{Address: "addr"}}, string(make([]byte, maxMemoLen+1))},
+		{"no recipient", "eth", nil, ""},
+		{"too many recipients", "eth", tooMany, ""},
+		{"empty address", "eth", []*PayloadRecipient{{Address: ""}}, ""},
+		{"negative amount", "eth", []*PayloadRecipient{{Address: "addr", Amount: -1}}, ""},
+		{"two remainder recipients", "eth", []*PayloadRecipient{{Address: "addr1"}, {Address: "addr2"}}, ""},
+	}
+
+	for _, test := range tests {
+		if _, err := EncodePayLoadScript(test.chainName, 1, test.recipients, test.memo); err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+func TestAllocateRecipients(t *testing.T) {
+	tests := []struct {
+		name       string
+		recipients []*PayloadRecipient
+		amount     int64
+		expected   string
+		fail       bool
+	}{
+		{"remainder only", []*PayloadRecipient{{Address: "a"}}, 1000, "[a:1000]", false},
+		{"exact amounts", []*PayloadRecipient{{Address: "a", Amount: 400}, {Address: "b", Amount: 600}}, 1000, "[a:400 b:600]", false},
+		{"with remainder", []*PayloadRecipient{{Address: "a", Amount: 400}, {Address: "b"}}, 1000, "[a:400 b:600]", false},
+		{"exceed deposit", []*PayloadRecipient{{Address: "a", Amount: 1200}}, 1000, "", true},
+		{"less than deposit", []*PayloadRecipient{{Address: "a", Amount: 400}}, 1000, "", true},
+	}
+
+	for _, test := range tests {
+		rechargeList, err := allocateRecipients(test.recipients, test.amount)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		var got []string
+		for _, info := range rechargeList {
+			got = append(got, fmt.Sprintf("%s:%d", info.Address, info.Amount))
+		}
+		if fmt.Sprint(got) != test.expected {
+			t.Errorf("%s: got %v, want %s", test.name, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package mortgagewatcher
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/btcsuite/btcd/wire"
+	log "github.com/inconshreveable/log15"
+)
+
+var defaultRecentTxNum = 100
+
+//GetCoinType 获取监听的币种 btc/bch
+func (m *MortgageWatcher) GetCoinType() string {
+	return m.coinType
+}
+
+//GetScanConfirmHeight 获取下一个待处理的已确认区块高度
+func (m *MortgageWatcher) GetScanConfirmHeight() int64 {
+	return atomic.LoadInt64(&m.scanConfirmHeight)
+}
+
+//GetRawTransaction 通过全节点RPC查询交易，已确认的交易需要全节点开启txindex
+func (m *MortgageWatcher) GetRawTransaction(txid string) (*wire.MsgTx, error) {
+	tx, err := m.bwClient.GetRawTransaction(txid)
+	if err != nil {
+		return nil, err
+	}
+	return tx.MsgTx(), nil
+}
+
+//GetUtxo 获取utxo信息的副本，utxo不存在时返回nil
+//内存中的utxo状态由区块处理在m.Lock下修改，对外只返回加锁复制的副本
+func (m *MortgageWatcher) GetUtxo(utxoID string) *coinmanager.UtxoInfo {
+	m.Lock()
+	defer m.Unlock()
+
+	utxoInfo := m.GetUtxoInfoByID(utxoID)
+	if utxoInfo == nil {
+		return nil
+	}
+	copied := *utxoInfo
+	return &copied
+}
+
+//GetUtxoList 从leveldb中查询指定SpendType的utxo，spendType为nil时返回全部
+func (m *MortgageWatcher) GetUtxoList(spendType *int) []*coinmanager.UtxoInfo {
+	var utxoList []*coinmanager.UtxoInfo
+
+	iter := m.levelDb.NewIteratorWithPrefix([]byte(m.levelDbUtxoPreFix + "_"))
+	defer iter.Release()
+	for iter.Next() {
+		utxo := &coinmanager.UtxoInfo{}
+		err := json.Unmarshal(iter.Value(), utxo)
+		if err != nil {
+			log.Warn("Unmarshal UTXO FROM LEVELDB ERR", "err", err.Error(), "coinType", m.coinType)
+			continue
+		}
+		if spendType != nil && utxo.SpendType != *spendType {
+			continue
+		}
+		utxoList = append(utxoList, utxo)
+	}
+
+	return utxoList
+}
+
+//GetHashAfterSign 根据签名前的交易hash查询签名后的交易hash
+func (m *MortgageWatcher) GetHashAfterSign(hashBeforeSign string) (string, error) {
+	mappingKey := strings.Join([]string{m.levelDbTxMappingPreFix, hashBeforeSign}, "_")
+	data, err := m.levelDb.Get([]byte(mappingKey))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+//GetRecentMortgageTxs 获取最近推送的抵押交易，按推送时间倒序
+func (m *MortgageWatcher) GetRecentMortgageTxs() []*SubTransaction {
+	m.recentTxLock.Lock()
+	defer m.recentTxLock.Unlock()
+
+	txs := make([]*SubTransaction, 0, len(m.recentTxs))
+	for i := len(m.recentTxs) - 1; i >= 0; i-- {
+		txs = append(txs, m.recentTxs[i])
+	}
+	return txs
+}
+
+//applyRecentMortgageTx 推送的抵押交易加入最近列表，撤回的从列表中删除
+func (m *MortgageWatcher) applyRecentMortgageTx(entry *outboxEntry) {
+	m.recentTxLock.Lock()
+	defer m.recentTxLock.Unlock()
+
+	if entry.Retract {
+		for i, tx := range m.recentTxs {
+			if tx.ScTxid == entry.Tx.ScTxid {
+				m.recentTxs = append(m.recentTxs[:i], m.recentTxs[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+	m.recentTxs = append(m.recentTxs, entry.Tx)
+	if len(m.recentTxs) > defaultRecentTxNum {
+		m.recentTxs = m.recentTxs[len(m.recentTxs)-defaultRecentTxNum:]
+	}
+}
@@ -0,0 +1,254 @@
+package mortgagewatcher
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/btcsuite/btcd/wire"
+	log "github.com/inconshreveable/log15"
+)
+
+//退款原因
+const (
+	RefundReasonMissingPayload = "missing_payload"
+	RefundReasonBadPrefix      = "bad_prefix"
+	RefundReasonInvalidPayload = "invalid_payload"
+	RefundReasonUnknownChain   = "unknown_chain"
+	RefundReasonBelowMinimum   = "below_minimum"
+)
+
+//退款状态
+const (
+	RefundStatusPending  = 0 //待退款
+	RefundStatusRefunded = 1 //退款交易已确认
+)
+
+//RefundInfo 待退款的转入交易，使用转入的utxo原路退回到发送方地址
+type RefundInfo struct {
+	ScTxid        string   `json:"sc_txid"`
+	BlockHeight   int64    `json:"block_height"`
+	Amount        int64    `json:"amount"`
+	Reason        string   `json:"reason"`
+	Detail        string   `json:"detail"`
+	SenderAddress string   `json:"sender_address"`
+	Utxos         []string `json:"utxos"`
+	Status        int      `json:"status"`
+	RefundTxid    string   `json:"refund_txid"`
+}
+
+func (m *MortgageWatcher) getRefundKey(scTxid string) []byte {
+	return []byte(strings.Join([]string{m.levelDbRefundPreFix, scTxid}, "_"))
+}
+
+//enqueueRefund 将无效的转入交易加入退款队列，转入的utxo保留给退款使用，不会被SelectUtxo选中
+func (m *MortgageWatcher) enqueueRefund(db dbWriter, tx *wire.MsgTx, height int64, deposits []*DepositOutput, reason string, detail string) *RefundInfo {
+	txHash := tx.TxHash().String()
+	refund := &RefundInfo{
+		ScTxid:        txHash,
+		BlockHeight:   height,
+		Reason:        reason,
+		Detail:        detail,
+		SenderAddress: m.getSenderAddress(tx),
+		Status:        RefundStatusPending,
+	}
+	for _, deposit := range deposits {
+		refund.Amount += deposit.Amount
+		refund.Utxos = append(refund.Utxos, strings.Join([]string{txHash, strconv.Itoa(int(deposit.Vout))}, "_"))
+	}
+
+	if !m.storeRefund(db, refund) {
+		return nil
+	}
+	for _, utxoID := range refund.Utxos {
+		m.refundUtxos.Store(utxoID, txHash)
+	}
+
+	log.Info("enqueue refund", "scTxid", txHash, "reason", reason, "detail", detail, "amount", refund.Amount,
+		"sender", refund.SenderAddress, "coinType", m.coinType)
+	return refund
+}
+
+//getSenderAddress 获取交易第一个输入的地址，签名脚本中无法推导时从链上查询被花费的输出
+func (m *MortgageWatcher) getSenderAddress(tx *wire.MsgTx) string {
+	if len(tx.TxIn) == 0 {
+		return ""
+	}
+
+	txIn := tx.TxIn[0]
+	address := coinmanager.ExtractSenderAddress(txIn, m.coinType)
+	if address != "" || m.bwClient == nil {
+		return address
+	}
+
+	prevTx, err := m.bwClient.GetRawTransaction(txIn.PreviousOutPoint.Hash.String())
+	if err != nil {
+		log.Warn("get sender tx failed", "err", err.Error(), "txid", txIn.PreviousOutPoint.Hash.String(), "coinType", m.coinType)
+		return ""
+	}
+	txOut := prevTx.MsgTx().TxOut
+	if int(txIn.PreviousOutPoint.Index) >= len(txOut) {
+		return ""
+	}
+	return coinmanager.ExtractPkScriptAddr(txOut[txIn.PreviousOutPoint.Index].PkScript, m.coinType)
+}
+
+//markRefunded 退款utxo被花费时标记退款完成，返回修改前的退款信息
+func (m *MortgageWatcher) markRefunded(db dbWriter, utxoID string, refundTxid string) *RefundInfo {
+	t, ok := m.refundUtxos.Load(utxoID)
+	if !ok {
+		return nil
+	}
+	scTxid := t.(string)
+
+	refund := m.getRefund(db, scTxid)
+	if refund == nil || refund.Status == RefundStatusRefunded {
+		return nil
+	}
+
+	prev := *refund
+	refund.Status = RefundStatusRefunded
+	refund.RefundTxid = refundTxid
+	m.storeRefund(db, refund)
+	for _, id := range refund.Utxos {
+		m.refundUtxos.Delete(id)
+	}
+
+	log.Info("refund confirmed", "scTxid", scTxid, "refundTxid", refundTxid, "coinType", m.coinType)
+	return &prev
+}
+
+//restoreRefund 区块回退时恢复退款信息
+func (m *MortgageWatcher) restoreRefund(db dbWriter, refund *RefundInfo) {
+	m.storeRefund(db, refund)
+	if refund.Status == RefundStatusPending {
+		for _, utxoID := range refund.Utxos {
+			m.refundUtxos.Store(utxoID, refund.ScTxid)
+		}
+	}
+}
+
+//deleteRefund 区块回退时删除该区块中加入的退款
+func (m *MortgageWatcher) deleteRefund(db dbWriter, scTxid string) {
+	refund := m.getRefund(db, scTxid)
+	if refund != nil {
+		for _, utxoID := range refund.Utxos {
+			m.refundUtxos.Delete(utxoID)
+		}
+	}
+
+	err := db.Delete(m.getRefundKey(scTxid))
+	if err != nil {
+		log.Warn("delete refund failed", "err", err.Error(), "scTxid", scTxid, "coinType", m.coinType)
+	}
+}
+
+//isRefundUtxo utxo是否保留给退款使用
+func (m *MortgageWatcher) isRefundUtxo(utxoID string) bool {
+	_, ok := m.refundUtxos.Load(utxoID)
+	return ok
+}
+
+func (m *MortgageWatcher) storeRefund(db dbWriter, refund *RefundInfo) bool {
+	data, err := json.Marshal(refund)
+	if err != nil {
+		log.Warn("Marshal refund failed", "err", err.Error(), "coinType", m.coinType)
+		return false
+	}
+	err = db.Put(m.getRefundKey(refund.ScTxid), data)
+	if err != nil {
+		log.Warn("save refund failed", "err", err.Error(), "scTxid", refund.ScTxid, "coinType", m.coinType)
+		return false
+	}
+	return true
+}
+
+//GetRefund 查询退款信息，不存在时返回nil
+func (m *MortgageWatcher) GetRefund(scTxid string) *RefundInfo {
+	return m.getRefund(m.levelDb, scTxid)
+}
+
+func (m *MortgageWatcher) getRefund(db dbWriter, scTxid string) *RefundInfo {
+	data, err := db.Get(m.getRefundKey(scTxid))
+	if err != nil || data == nil {
+		return nil
+	}
+
+	refund := &RefundInfo{}
+	err = json.Unmarshal(data, refund)
+	if err != nil {
+		log.Warn("Unmarshal refund failed", "err", err.Error(), "coinType", m.coinType)
+		return nil
+	}
+	return refund
+}
+
+//GetRefundList 查询退款队列，status为nil时返回全部
+func (m *MortgageWatcher) GetRefundList(status *int) []*RefundInfo {
+	var refundList []*RefundInfo
+
+	iter := m.levelDb.NewIteratorWithPrefix([]byte(m.levelDbRefundPreFix + "_"))
+	defer iter.Release()
+	for iter.Next() {
+		refund := &RefundInfo{}
+		err := json.Unmarshal(iter.Value(), refund)
+		if err != nil {
+			log.Warn("Unmarshal refund failed", "err", err.Error(), "coinType", m.coinType)
+			continue
+		}
+		if status != nil && refund.Status != *status {
+			continue
+		}
+		refundList = append(refundList, refund)
+	}
+	return refundList
+}
+
+//SetRefundAddress 发送方地址无法推导或需要更改时，由运营人员指定退款地址
+func (m *MortgageWatcher) SetRefundAddress(scTxid string, address string) error {
+	refund := m.GetRefund(scTxid)
+	if refund == nil {
+		return errors.New("refund not found: " + scTxid)
+	}
+	if refund.Status != RefundStatusPending {
+		return errors.New("refund already finished: " + scTxid)
+	}
+	err := validateBitcoinAddress(address, m.coinType)
+	if err != nil {
+		return err
+	}
+
+	refund.SenderAddress = address
+	if !m.storeRefund(m.levelDb, refund) {
+		return errors.New("save refund failed")
+	}
+	return nil
+}
+
+//loadRefund 从leveldb中恢复待退款的utxo
+func (m *MortgageWatcher) loadRefund() {
+	for _, refund := range m.GetRefundList(nil) {
+		if refund.Status != RefundStatusPending {
+			continue
+		}
+		for _, utxoID := range refund.Utxos {
+			m.refundUtxos.Store(utxoID, refund.ScTxid)
+		}
+	}
+}
+
+//getRefundReason 根据payload解析错误获取退款原因
+func getRefundReason(err error) string {
+	switch err {
+	case ErrPayloadPrefix:
+		return RefundReasonBadPrefix
+	case ErrUnknownChain:
+		return RefundReasonUnknownChain
+	case ErrBelowMinimum:
+		return RefundReasonBelowMinimum
+	default:
+		return RefundReasonInvalidPayload
+	}
+}
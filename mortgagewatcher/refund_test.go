@@ -0,0 +1,141 @@
+package mortgagewatcher
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/txscript"
+)
+
+func TestRefundReason(t *testing.T) {
+	unknownChain, _ := EncodePayLoadScript("xyz", 1, []*PayloadRecipient{{Address: testEthAddress}}, "")
+	badPrefix, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_RETURN).AddData([]byte("hello world")).Script()
+	//地址校验和错误
+	badChecksum := newTestPayload(t, 1)
+	badChecksum[len(badChecksum)-1] ^= 0xff
+	//目标链地址无效
+	badAddress, _ := EncodePayLoadScript("eth", 1, []*PayloadRecipient{{Address: "0x1234"}}, "")
+
+	tests := []struct {
+		name       string
+		payload    []byte
+		minDeposit int64
+		reason     string
+	}{
+		{"missing payload", nil, 0, RefundReasonMissingPayload},
+		{"bad prefix", badPrefix, 0, RefundReasonBadPrefix},
+		{"bad checksum", badChecksum, 0, RefundReasonInvalidPayload},
+		{"invalid address", badAddress, 0, RefundReasonInvalidPayload},
+		{"unknown chain", unknownChain, 0, RefundReasonUnknownChain},
+		{"below minimum", newTestPayload(t, 1), 200000, RefundReasonBelowMinimum},
+	}
+
+	for _, test := range tests {
+		mw := newTestMortgageWatcher(t, "btc")
+		mw.minDepositAmount = test.minDeposit
+		tx := newTestDepositTx(t, 1, 100000, test.payload)
+		mw.handleConfirmBlock(newTestBlock(100, nil, tx))
+
+		refund := mw.GetRefund(tx.TxHash().String())
+		if refund == nil {
+			t.Errorf("%s: refund not found", test.name)
+			continue
+		}
+		if refund.Reason != test.reason || refund.Amount != 100000 || refund.SenderAddress != testSenderAddress ||
+			refund.Status != RefundStatusPending || refund.BlockHeight != 100 {
+			t.Errorf("%s: got refund %+v", test.name, refund)
+		}
+		if !mw.isRefundUtxo(testUtxoID(tx, 0)) {
+			t.Errorf("%s: deposit utxo not reserved for refund", test.name)
+		}
+		if record := mw.GetDepositRecord(tx.TxHash().String()); record == nil || record.State != DepositStateRejected {
+			t.Errorf("%s: got deposit record %+v, want rejected", test.name, record)
+		}
+	}
+}
+
+func TestRefundValidDepositNotQueued(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	tx := newTestDepositTx(t, 1, 100000, newTestPayload(t, 1))
+	mw.handleConfirmBlock(newTestBlock(100, nil, tx))
+
+	if refund := mw.GetRefund(tx.TxHash().String()); refund != nil {
+		t.Errorf("got refund %+v for valid deposit", refund)
+	}
+	if mw.isRefundUtxo(testUtxoID(tx, 0)) {
+		t.Error("valid deposit utxo reserved for refund")
+	}
+}
+
+func TestRefundConfirmedAndReorged(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	deposit := newTestDepositTx(t, 1, 100000, nil)
+	block1 := newTestBlock(100, nil, deposit)
+	mw.handleConfirmBlock(block1)
+
+	//退款交易花费转入的utxo后退款完成
+	refundTx := newTestSpendTx(deposit, 0)
+	block2 := newTestBlock(101, block1, refundTx)
+	mw.handleConfirmBlock(block2)
+
+	scTxid := deposit.TxHash().String()
+	refund := mw.GetRefund(scTxid)
+	if refund == nil || refund.Status != RefundStatusRefunded || refund.RefundTxid != refundTx.TxHash().String() {
+		t.Fatalf("got refund %+v after refund tx confirmed", refund)
+	}
+	if mw.isRefundUtxo(testUtxoID(deposit, 0)) {
+		t.Error("refunded utxo still reserved")
+	}
+	if record := mw.GetDepositRecord(scTxid); record == nil || record.State != DepositStateRefunded {
+		t.Errorf("got deposit record %+v, want refunded", record)
+	}
+
+	//退款交易所在区块回退后恢复为待退款
+	mw.handleDisconnectBlock(block2)
+	refund = mw.GetRefund(scTxid)
+	if refund == nil || refund.Status != RefundStatusPending || refund.RefundTxid != "" {
+		t.Fatalf("got refund %+v after refund block disconnected", refund)
+	}
+	if !mw.isRefundUtxo(testUtxoID(deposit, 0)) {
+		t.Error("utxo not reserved for refund after disconnect")
+	}
+
+	//转入交易所在区块回退后删除退款
+	mw.handleDisconnectBlock(block1)
+	if refund := mw.GetRefund(scTxid); refund != nil {
+		t.Errorf("got refund %+v after deposit block disconnected", refund)
+	}
+	if mw.isRefundUtxo(testUtxoID(deposit, 0)) {
+		t.Error("utxo still reserved after deposit block disconnected")
+	}
+}
+
+func TestSetRefundAddress(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	deposit := newTestDepositTx(t, 1, 100000, nil)
+	mw.handleConfirmBlock(newTestBlock(100, nil, deposit))
+	scTxid := deposit.TxHash().String()
+
+	if err := mw.SetRefundAddress("missing", testSenderAddress); err == nil {
+		t.Error("expected error for unknown refund")
+	}
+	if err := mw.SetRefundAddress(scTxid, testEthAddress); err == nil {
+		t.Error("expected error for invalid btc address")
+	}
+	if err := mw.SetRefundAddress(scTxid, "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy"); err != nil {
+		t.Fatalf("set refund address: %v", err)
+	}
+	if refund := mw.GetRefund(scTxid); refund.SenderAddress != "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy" {
+		t.Errorf("got sender address %s", refund.SenderAddress)
+	}
+
+	//重启后恢复待退款的utxo
+	mw.refundUtxos.Delete(testUtxoID(deposit, 0))
+	mw.loadRefund()
+	if !mw.isRefundUtxo(testUtxoID(deposit, 0)) {
+		t.Error("refund utxo not restored by loadRefund")
+	}
+	pending := RefundStatusPending
+	if refunds := mw.GetRefundList(&pending); len(refunds) != 1 || refunds[0].ScTxid != scTxid {
+		t.Errorf("got pending refunds %v", refunds)
+	}
+}
@@ -0,0 +1,107 @@
+package mortgagewatcher
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+)
+
+//RejectedDeposit 转入多签地址但未通过校验的抵押交易，需要退款处理
+type RejectedDeposit struct {
+	ScTxid      string           `json:"sc_txid"`
+	BlockHeight int64            `json:"block_height"`
+	Amount      int64            `json:"amount"`
+	Reason      string           `json:"reason"`
+	Outputs     []*DepositOutput `json:"outputs"`
+	Messages    []*Message       `json:"messages"`
+}
+
+func newRejectedDeposit(txHash string, height int64, deposits []*DepositOutput, messages []*Message, reason error) *RejectedDeposit {
+	var amount int64
+	for _, deposit := range deposits {
+		amount += deposit.Amount
+	}
+	return &RejectedDeposit{
+		ScTxid:      txHash,
+		BlockHeight: height,
+		Amount:      amount,
+		Reason:      reason.Error(),
+		Outputs:     deposits,
+		Messages:    messages,
+	}
+}
+
+//validateMortgageTx 校验抵押交易的目标链和接收地址
+func validateMortgageTx(tx *SubTransaction) error {
+	for _, recharge := range tx.RechargeList {
+		if recharge.Amount <= 0 {
+			return errors.New("recipient amount is zero: " + recharge.Address)
+		}
+		err := ValidateAddress(tx.To, recharge.Address)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MortgageWatcher) getRejectedKey(scTxid string) []byte {
+	return []byte(strings.Join([]string{m.levelDbRejectedPreFix, scTxid}, "_"))
+}
+
+func (m *MortgageWatcher) storeRejectedDeposit(db dbWriter, rejected *RejectedDeposit) bool {
+	data, err := json.Marshal(rejected)
+	if err != nil {
+		log.Warn("Marshal rejected deposit failed", "err", err.Error(), "coinType", m.coinType)
+		return false
+	}
+	err = db.Put(m.getRejectedKey(rejected.ScTxid), data)
+	if err != nil {
+		log.Warn("save rejected deposit failed", "err", err.Error(), "scTxid", rejected.ScTxid, "coinType", m.coinType)
+		return false
+	}
+	return true
+}
+
+func (m *MortgageWatcher) deleteRejectedDeposit(db dbWriter, scTxid string) {
+	err := db.Delete(m.getRejectedKey(scTxid))
+	if err != nil {
+		log.Warn("delete rejected deposit failed", "err", err.Error(), "scTxid", scTxid, "coinType", m.coinType)
+	}
+}
+
+//GetRejectedDeposit 查询被拒绝的抵押交易，不存在时返回nil
+func (m *MortgageWatcher) GetRejectedDeposit(scTxid string) *RejectedDeposit {
+	data, err := m.levelDb.Get(m.getRejectedKey(scTxid))
+	if err != nil || data == nil {
+		return nil
+	}
+
+	rejected := &RejectedDeposit{}
+	err = json.Unmarshal(data, rejected)
+	if err != nil {
+		log.Warn("Unmarshal rejected deposit failed", "err", err.Error(), "coinType", m.coinType)
+		return nil
+	}
+	return rejected
+}
+
+//GetRejectedDeposits 查询所有被拒绝的抵押交易
+func (m *MortgageWatcher) GetRejectedDeposits() []*RejectedDeposit {
+	var rejectedList []*RejectedDeposit
+
+	iter := m.levelDb.NewIteratorWithPrefix([]byte(m.levelDbRejectedPreFix + "_"))
+	defer iter.Release()
+	for iter.Next() {
+		rejected := &RejectedDeposit{}
+		err := json.Unmarshal(iter.Value(), rejected)
+		if err != nil {
+			log.Warn("Unmarshal rejected deposit failed", "err", err.Error(), "coinType", m.coinType)
+			continue
+		}
+		rejectedList = append(rejectedList, rejected)
+	}
+	return rejectedList
+}
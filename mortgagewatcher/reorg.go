@@ -0,0 +1,172 @@
+package mortgagewatcher
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	log "github.com/inconshreveable/log15"
+)
+
+var defaultUndoKeepDepth int64 = 144
+
+//blockUndo 已确认区块的回退信息
+type blockUndo struct {
+	Height   int64  `json:"height"`
+	Hash     string `json:"hash"`
+	PrevHash string `json:"prev_hash"`
+	//区块处理前被修改的utxo状态
+	UtxoBefore []*coinmanager.UtxoInfo `json:"utxo_before"`
+	//区块中新建的utxo
+	CreatedUtxos []string `json:"created_utxos"`
+	//区块中推送的抵押交易
+	MortgageTxs []string `json:"mortgage_txs"`
+	//区块中被拒绝的抵押交易
+	RejectedTxs []string `json:"rejected_txs"`
+	//区块中加入退款队列的交易
+	RefundTxs []string `json:"refund_txs"`
+	//区块处理前被修改的退款信息
+	RefundBefore []*RefundInfo `json:"refund_before"`
+	//区块中确认数不足延迟推送的抵押交易
+	PendingTxs []string `json:"pending_txs"`
+	//区块处理时达到确认数推送的抵押交易
+	ReleasedTxs []*PendingDeposit `json:"released_txs"`
+	//区块中转入多签地址的交易
+	DepositTxs []string `json:"deposit_txs"`
+}
+
+func newBlockUndo(blockData *coinmanager.BlockData) *blockUndo {
+	return &blockUndo{
+		Height:   blockData.BlockInfo.Height,
+		Hash:     blockData.BlockInfo.Hash,
+		PrevHash: blockData.BlockInfo.PreviousHash,
+	}
+}
+
+//saveUtxoState 记录utxo修改前的状态
+func (u *blockUndo) saveUtxoState(utxoInfo *coinmanager.UtxoInfo) {
+	prev := *utxoInfo
+	u.UtxoBefore = append(u.UtxoBefore, &prev)
+}
+
+func getUtxoID(utxoInfo *coinmanager.UtxoInfo) string {
+	return strings.Join([]string{utxoInfo.Txid, strconv.Itoa(int(utxoInfo.Vout))}, "_")
+}
+
+func (m *MortgageWatcher) getBlockUndoKey(blockHash string) []byte {
+	return []byte(strings.Join([]string{m.levelDbUndoPreFix, blockHash}, "_"))
+}
+
+//storeBlockUndo 存储区块回退信息，并清理超过回退深度的记录
+func (m *MortgageWatcher) storeBlockUndo(db dbWriter, undo *blockUndo) bool {
+	data, err := json.Marshal(undo)
+	if err != nil {
+		log.Warn("Marshal block undo failed", "err", err.Error(), "coinType", m.coinType)
+		return false
+	}
+
+	err = db.Put(m.getBlockUndoKey(undo.Hash), data)
+	if err != nil {
+		log.Warn("save block undo failed", "err", err.Error(), "coinType", m.coinType)
+		return false
+	}
+
+	iter := m.levelDb.NewIteratorWithPrefix([]byte(m.levelDbUndoPreFix))
+	defer iter.Release()
+	for iter.Next() {
+		old := &blockUndo{}
+		err := json.Unmarshal(iter.Value(), old)
+		if err != nil || old.Height+defaultUndoKeepDepth < undo.Height {
+			db.Delete(iter.Key())
+		}
+	}
+
+	return true
+}
+
+//loadBlockUndo 获取区块回退信息，区块未被确认处理时返回nil
+func (m *MortgageWatcher) loadBlockUndo(blockHash string) *blockUndo {
+	data, err := m.levelDb.Get(m.getBlockUndoKey(blockHash))
+	if err != nil || data == nil {
+		return nil
+	}
+
+	undo := &blockUndo{}
+	err = json.Unmarshal(data, undo)
+	if err != nil {
+		log.Warn("Unmarshal block undo failed", "err", err.Error(), "coinType", m.coinType)
+		return nil
+	}
+	return undo
+}
+
+//processDisconnectBlock 处理回退区块，撤销已确认区块对utxo和抵押交易的修改
+//回退的是已确认区块时返回其回退信息，确认高度由调用方随区块一起提交，未确认区块返回nil
+func (m *MortgageWatcher) processDisconnectBlock(db dbWriter, blockData *coinmanager.BlockData) *blockUndo {
+	undo := m.loadBlockUndo(blockData.BlockInfo.Hash)
+	if undo == nil {
+		log.Info("disconnect unconfirmed block", "height", blockData.BlockInfo.Height, "hash", blockData.BlockInfo.Hash, "coinType", m.coinType)
+		return nil
+	}
+
+	log.Info("disconnect confirmed block", "height", undo.Height, "hash", undo.Hash, "coinType", m.coinType)
+
+	//逆序恢复，保证同一utxo恢复到区块处理前最早的状态
+	for i := len(undo.UtxoBefore) - 1; i >= 0; i-- {
+		utxoInfo := undo.UtxoBefore[i]
+		utxoID := getUtxoID(utxoInfo)
+		m.faUtxoInfo.Store(utxoID, utxoInfo)
+		m.storeUtxo(db, utxoID)
+	}
+
+	for _, utxoID := range undo.CreatedUtxos {
+		utxoInfo := m.GetUtxoInfoByID(utxoID)
+		if utxoInfo == nil {
+			continue
+		}
+		utxoInfo.SpendType = -1
+		m.storeUtxo(db, utxoID)
+		m.faUtxoInfo.Delete(utxoID)
+	}
+
+	for _, scTxid := range undo.MortgageTxs {
+		m.retractMortgageTx(db, scTxid)
+	}
+
+	//先恢复达到确认数推送的抵押交易，再删除本区块中延迟的抵押交易
+	for _, pending := range undo.ReleasedTxs {
+		m.retractMortgageTx(db, pending.Tx.ScTxid)
+		m.storePendingDeposit(db, pending)
+	}
+
+	for _, scTxid := range undo.PendingTxs {
+		m.deletePendingDeposit(db, scTxid)
+	}
+
+	for _, txid := range undo.DepositTxs {
+		m.updateDepositState(db, txid, DepositStateReorged, undo.Height, undo.Hash, nil)
+	}
+
+	for _, pending := range undo.ReleasedTxs {
+		m.updateDepositState(db, pending.Tx.ScTxid, DepositStateConfirmed, pending.BlockHeight, "retracted by reorg", nil)
+	}
+
+	for _, scTxid := range undo.RejectedTxs {
+		m.deleteRejectedDeposit(db, scTxid)
+	}
+
+	for _, scTxid := range undo.RefundTxs {
+		m.deleteRefund(db, scTxid)
+	}
+
+	for i := len(undo.RefundBefore) - 1; i >= 0; i-- {
+		m.restoreRefund(db, undo.RefundBefore[i])
+		if undo.RefundBefore[i].Status == RefundStatusPending {
+			m.updateDepositState(db, undo.RefundBefore[i].ScTxid, DepositStateRejected, undo.Height, "refund tx reorged", nil)
+		}
+	}
+
+	db.Delete(m.getBlockUndoKey(undo.Hash))
+	return undo
+}
@@ -0,0 +1,147 @@
+package mortgagewatcher
+
+import (
+	"testing"
+)
+
+func TestDisconnectBlockRestoresUtxos(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	deposit := newTestDepositTx(t, 1, 100000, newTestPayload(t, 1))
+	depositUtxo := testUtxoID(deposit, 0)
+	block1 := newTestBlock(100, nil, deposit)
+	mw.handleConfirmBlock(block1)
+
+	spend := newTestSpendTx(deposit, 0)
+	block2 := newTestBlock(101, block1, spend)
+	mw.handleConfirmBlock(block2)
+	if utxo := mw.GetUtxo(depositUtxo); utxo != nil {
+		t.Fatalf("got spent utxo %+v in memory", utxo)
+	}
+
+	//花费交易所在区块回退，utxo恢复为已确认可用
+	mw.handleDisconnectBlock(block2)
+	utxo := mw.GetUtxo(depositUtxo)
+	if utxo == nil || utxo.SpendType != 1 || utxo.SpendTxid != "" || utxo.BlockHeight != 100 {
+		t.Fatalf("got utxo %+v after spend block disconnected", utxo)
+	}
+	if mw.GetScanConfirmHeight() != 101 {
+		t.Errorf("got scan confirm height %d, want 101", mw.GetScanConfirmHeight())
+	}
+
+	//转入交易所在区块回退，utxo标记为已移除
+	mw.handleDisconnectBlock(block1)
+	if utxo := mw.GetUtxo(depositUtxo); utxo != nil {
+		t.Errorf("got utxo %+v after deposit block disconnected", utxo)
+	}
+	removed := -1
+	if utxos := mw.GetUtxoList(&removed); len(utxos) != 1 || getUtxoID(utxos[0]) != depositUtxo {
+		t.Errorf("got removed utxos %v, want %s", utxos, depositUtxo)
+	}
+	if record := mw.GetDepositRecord(deposit.TxHash().String()); record == nil || record.State != DepositStateReorged {
+		t.Errorf("got deposit record %+v, want reorged", record)
+	}
+	if undo := mw.loadBlockUndo(block1.BlockInfo.Hash); undo != nil {
+		t.Error("block undo not deleted after disconnect")
+	}
+}
+
+func TestDisconnectBlockRetractsMortgageTx(t *testing.T) {
+	tests := []struct {
+		name      string
+		delivered bool
+	}{
+		{"undelivered", false},
+		{"delivered", true},
+	}
+
+	for _, test := range tests {
+		mw := newTestMortgageWatcher(t, "btc")
+		deposit := newTestDepositTx(t, 1, 100000, newTestPayload(t, 1))
+		scTxid := deposit.TxHash().String()
+		block := newTestBlock(100, nil, deposit)
+		mw.handleConfirmBlock(block)
+		if txs := mw.GetRecentMortgageTxs(); len(txs) != 1 || txs[0].ScTxid != scTxid {
+			t.Fatalf("%s: got recent mortgage txs %v, want %s", test.name, txs, scTxid)
+		}
+
+		if test.delivered {
+			if entry := mw.nextUndeliveredEntry(0); entry == nil || entry.id() != scTxid {
+				t.Fatalf("%s: got outbox entry %v, want %s", test.name, entry, scTxid)
+			}
+		}
+
+		mw.handleDisconnectBlock(block)
+		if _, err := mw.levelDb.Get(mw.getOutboxKey(scTxid)); err == nil {
+			t.Errorf("%s: mortgage tx still in outbox after disconnect", test.name)
+		}
+		if txs := mw.GetRecentMortgageTxs(); len(txs) != 0 {
+			t.Errorf("%s: got recent mortgage txs %v after disconnect, want none", test.name, txs)
+		}
+
+		//未分发的直接删除，已分发的推送撤回
+		entry := mw.nextUndeliveredEntry(0)
+		if !test.delivered {
+			if entry != nil {
+				t.Errorf("%s: got outbox entry %s, want none", test.name, entry.id())
+			}
+			continue
+		}
+		if entry == nil || !entry.Retract || entry.Tx.ScTxid != scTxid {
+			t.Errorf("%s: got outbox entry %+v, want retract of %s", test.name, entry, scTxid)
+		}
+	}
+}
+
+func TestDisconnectBlockThenConnectOtherBranch(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	parent := newTestBlock(99, nil)
+	mw.handleConfirmBlock(parent)
+
+	deposit := newTestDepositTx(t, 1, 100000, newTestPayload(t, 1))
+	scTxid := deposit.TxHash().String()
+	block := newTestBlock(100, parent, deposit)
+	mw.handleConfirmBlock(block)
+	mw.nextUndeliveredEntry(0)
+
+	mw.handleDisconnectBlock(block)
+	commit := loadBlockCommit(mw.levelDb, "btc")
+	if commit == nil || commit.Height != 99 || commit.Hash != parent.BlockInfo.Hash || commit.ConfirmHeight != 100 {
+		t.Fatalf("got block commit %+v after disconnect, want parent block", commit)
+	}
+	if mw.GetScanConfirmHeight() != 100 {
+		t.Errorf("got scan confirm height %d, want 100", mw.GetScanConfirmHeight())
+	}
+	mw.AckRetractMortgageTx(scTxid)
+
+	//同一交易被打包进另一个分支的区块后重新推送
+	other := newTestBlock(100, parent, newTestDepositTx(t, 2, 5000, nil), deposit)
+	mw.handleConfirmBlock(other)
+	utxo := mw.GetUtxo(testUtxoID(deposit, 0))
+	if utxo == nil || utxo.SpendType != 1 || utxo.BlockHeight != 100 {
+		t.Errorf("got utxo %+v after reconnect", utxo)
+	}
+	entry := mw.nextUndeliveredEntry(0)
+	if entry == nil || entry.Retract || entry.id() != scTxid {
+		t.Errorf("got outbox entry %+v after reconnect, want mortgage tx %s", entry, scTxid)
+	}
+	if record := mw.GetDepositRecord(scTxid); record == nil || record.State != DepositStateEmitted {
+		t.Errorf("got deposit record %+v, want emitted", record)
+	}
+}
+
+func TestDisconnectUnconfirmedBlock(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	block := newTestBlock(100, nil, newTestDepositTx(t, 1, 100000, newTestPayload(t, 1)))
+	mw.handleConfirmBlock(block)
+	commit := loadBlockCommit(mw.levelDb, "btc")
+
+	//没有回退信息的区块不影响已提交的状态
+	unconfirmed := newTestBlock(101, block)
+	mw.handleDisconnectBlock(unconfirmed)
+	if got := loadBlockCommit(mw.levelDb, "btc"); got == nil || *got != *commit {
+		t.Errorf("got block commit %+v, want %+v", got, commit)
+	}
+	if mw.GetScanConfirmHeight() != 101 {
+		t.Errorf("got scan confirm height %d, want 101", mw.GetScanConfirmHeight())
+	}
+}
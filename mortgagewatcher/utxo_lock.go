@@ -0,0 +1,185 @@
+package mortgagewatcher
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	log "github.com/inconshreveable/log15"
+)
+
+//ErrInsufficientUtxo 可用utxo不足
+var ErrInsufficientUtxo = errors.New("insufficient utxo")
+
+//utxoLock utxo锁定信息
+type utxoLock struct {
+	ExpireAt int64 `json:"expire_at"`
+}
+
+func (m *MortgageWatcher) getUtxoLockKey(utxoID string) []byte {
+	return []byte(strings.Join([]string{m.levelDbUtxoLockPreFix, utxoID}, "_"))
+}
+
+//IsUtxoLocked 查询utxo是否被锁定
+func (m *MortgageWatcher) IsUtxoLocked(utxoID string) bool {
+	_, ok := m.utxoMonitorCount.Load(utxoID)
+	return ok
+}
+
+//SelectUtxo 按金额从大到小选择总额不小于amount的已确认utxo，并锁定timeout秒，保留给退款的utxo和粉尘utxo不会被选中
+//金额相同时按txid、vout排序，相同的utxo集合和锁定状态总是选出相同的utxo，返回的是utxo的副本
+//锁定期间其他调用不会再选中这些utxo，使用完毕或放弃时调用UnlockUtxo解锁
+//锁定只在本节点有效，不会同步给其他多签成员，各成员需在相同的确认高度按相同顺序处理熔币请求，才能选出相同的utxo
+func (m *MortgageWatcher) SelectUtxo(amount int64) ([]*coinmanager.UtxoInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var candidates []*coinmanager.UtxoInfo
+	m.faUtxoInfo.Range(func(k, v interface{}) bool {
+		utxoInfo := v.(*coinmanager.UtxoInfo)
+		utxoID := k.(string)
+		if utxoInfo.SpendType == 1 && !utxoInfo.IsDust && !m.IsUtxoLocked(utxoID) && !m.isRefundUtxo(utxoID) {
+			candidates = append(candidates, utxoInfo)
+		}
+		return true
+	})
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Value != candidates[j].Value {
+			return candidates[i].Value > candidates[j].Value
+		}
+		if candidates[i].Txid != candidates[j].Txid {
+			return candidates[i].Txid < candidates[j].Txid
+		}
+		return candidates[i].Vout < candidates[j].Vout
+	})
+
+	var selected []*coinmanager.UtxoInfo
+	var total int64
+	for _, utxoInfo := range candidates {
+		if total >= amount {
+			break
+		}
+		selected = append(selected, utxoInfo)
+		total += utxoInfo.Value
+	}
+
+	if total < amount {
+		log.Warn("select utxo failed", "amount", amount, "total", total, "coinType", m.coinType)
+		return nil, ErrInsufficientUtxo
+	}
+
+	var utxoIDs []string
+	for i, utxoInfo := range selected {
+		utxoIDs = append(utxoIDs, getUtxoID(utxoInfo))
+		copied := *utxoInfo
+		selected[i] = &copied
+	}
+	m.lockUtxo(utxoIDs)
+
+	return selected, nil
+}
+
+//LockUtxo 锁定指定的utxo timeout秒，utxo不存在、不可用或已被锁定时返回error
+//用于按其他成员发起的熔币交易锁定相同的utxo，锁定只在本节点有效
+func (m *MortgageWatcher) LockUtxo(utxoIDs []string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, utxoID := range utxoIDs {
+		utxoInfo := m.GetUtxoInfoByID(utxoID)
+		if utxoInfo == nil || utxoInfo.SpendType != 1 {
+			return errors.New("utxo not available: " + utxoID)
+		}
+		if m.IsUtxoLocked(utxoID) {
+			return errors.New("utxo already locked: " + utxoID)
+		}
+	}
+
+	m.lockUtxo(utxoIDs)
+	return nil
+}
+
+//UnlockUtxo 解锁utxo
+func (m *MortgageWatcher) UnlockUtxo(utxoIDs []string) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, utxoID := range utxoIDs {
+		m.utxoMonitorCount.Delete(utxoID)
+		m.deleteUtxoLock(utxoID)
+	}
+}
+
+func (m *MortgageWatcher) lockUtxo(utxoIDs []string) {
+	expireAt := time.Now().Unix() + int64(m.timeout)
+	for _, utxoID := range utxoIDs {
+		m.utxoMonitorCount.Store(utxoID, 0)
+
+		data, err := json.Marshal(&utxoLock{ExpireAt: expireAt})
+		if err != nil {
+			log.Warn("Marshal utxo lock failed", "err", err.Error(), "coinType", m.coinType)
+			continue
+		}
+		err = m.levelDb.Put(m.getUtxoLockKey(utxoID), data)
+		if err != nil {
+			log.Warn("save utxo lock failed", "err", err.Error(), "utxoID", utxoID, "coinType", m.coinType)
+		}
+	}
+	log.Debug("lock utxo", "utxo", utxoIDs, "expire_at", expireAt, "coinType", m.coinType)
+}
+
+//expireUtxoLock 锁定计时加一秒，达到timeout秒的锁定解除
+//与加锁、解锁一样持有m.Lock，避免计时写回已解除的锁定，或删除同一utxo新加的锁定
+func (m *MortgageWatcher) expireUtxoLock() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.utxoMonitorCount.Range(func(k, v interface{}) bool {
+		utxoID := k.(string)
+		count := v.(int)
+		count++
+		if count >= m.timeout {
+			m.utxoMonitorCount.Delete(utxoID)
+			m.deleteUtxoLock(utxoID)
+			log.Debug("utxo lock timeout", "utxoID", utxoID, "coinType", m.coinType)
+		} else {
+			m.utxoMonitorCount.Store(utxoID, count)
+		}
+		return true
+	})
+}
+
+func (m *MortgageWatcher) deleteUtxoLock(utxoID string) {
+	err := m.levelDb.Delete(m.getUtxoLockKey(utxoID))
+	if err != nil {
+		log.Warn("delete utxo lock failed", "err", err.Error(), "utxoID", utxoID, "coinType", m.coinType)
+	}
+}
+
+//loadUtxoLock 从leveldb中恢复未过期的utxo锁定，过期的直接删除
+func (m *MortgageWatcher) loadUtxoLock() {
+	now := time.Now().Unix()
+
+	iter := m.levelDb.NewIteratorWithPrefix([]byte(m.levelDbUtxoLockPreFix + "_"))
+	defer iter.Release()
+	for iter.Next() {
+		utxoID := strings.TrimPrefix(string(iter.Key()), m.levelDbUtxoLockPreFix+"_")
+		lock := &utxoLock{}
+		err := json.Unmarshal(iter.Value(), lock)
+		if err != nil || lock.ExpireAt <= now {
+			m.deleteUtxoLock(utxoID)
+			continue
+		}
+
+		count := m.timeout - int(lock.ExpireAt-now)
+		if count < 0 {
+			count = 0
+		}
+		m.utxoMonitorCount.Store(utxoID, count)
+		log.Debug("load utxo lock from leveldb", "utxoID", utxoID, "expire_at", lock.ExpireAt, "coinType", m.coinType)
+	}
+}
@@ -0,0 +1,192 @@
+package mortgagewatcher
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/JimmyHongjichuan/btc_watcher/dbop"
+)
+
+//addTestUtxo 在内存中添加多签地址的utxo，txid由seed重复生成，返回utxoID
+func addTestUtxo(mw *MortgageWatcher, seed string, value int64, spendType int) string {
+	utxo := &coinmanager.UtxoInfo{
+		Address:   testFederationAddress,
+		Txid:      strings.Repeat(seed, 64),
+		Value:     value,
+		SpendType: spendType,
+		IsDust:    mw.isDust(value),
+	}
+	utxoID := getUtxoID(utxo)
+	mw.faUtxoInfo.Store(utxoID, utxo)
+	return utxoID
+}
+
+func TestSelectUtxoOrder(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	small := addTestUtxo(mw, "1", 5000, 1)
+	medium := addTestUtxo(mw, "2", 10000, 1)
+	largeB := addTestUtxo(mw, "b", 20000, 1)
+	largeA := addTestUtxo(mw, "a", 20000, 1)
+
+	//按金额从大到小、金额相同时按txid选择，已选中的utxo被锁定不再选中
+	tests := []struct {
+		amount   int64
+		expected []string
+	}{
+		{20000, []string{largeA}},
+		{25000, []string{largeB, medium}},
+		{1, []string{small}},
+	}
+	for _, test := range tests {
+		utxos, err := mw.SelectUtxo(test.amount)
+		if err != nil {
+			t.Fatalf("select %d: %v", test.amount, err)
+		}
+		var utxoIDs []string
+		for _, utxo := range utxos {
+			utxoIDs = append(utxoIDs, getUtxoID(utxo))
+		}
+		if strings.Join(utxoIDs, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("select %d: got %v, want %v", test.amount, utxoIDs, test.expected)
+		}
+	}
+
+	if _, err := mw.SelectUtxo(1); err != ErrInsufficientUtxo {
+		t.Errorf("got err %v after all utxos locked, want ErrInsufficientUtxo", err)
+	}
+}
+
+func TestSelectUtxoExclusions(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.dustThreshold = 546
+	available := addTestUtxo(mw, "1", 10000, 1)
+	addTestUtxo(mw, "2", 500, 1)
+	addTestUtxo(mw, "3", 50000, 0)
+	addTestUtxo(mw, "4", 50000, 2)
+	addTestUtxo(mw, "5", 50000, 4)
+	refund := addTestUtxo(mw, "6", 50000, 1)
+	mw.refundUtxos.Store(refund, "sc_txid")
+	locked := addTestUtxo(mw, "7", 50000, 1)
+	if err := mw.LockUtxo([]string{locked}); err != nil {
+		t.Fatalf("lock utxo: %v", err)
+	}
+
+	//粉尘、未确认、使用中、未成熟、保留退款和已锁定的utxo都不会被选中
+	if _, err := mw.SelectUtxo(10001); err != ErrInsufficientUtxo {
+		t.Errorf("got err %v, want ErrInsufficientUtxo", err)
+	}
+	utxos, err := mw.SelectUtxo(10000)
+	if err != nil || len(utxos) != 1 || getUtxoID(utxos[0]) != available {
+		t.Fatalf("got utxos %v err %v, want %s", utxos, err, available)
+	}
+
+	//返回的是副本，修改不影响内存中的utxo
+	utxos[0].Value = 1
+	if utxo := mw.GetUtxo(available); utxo.Value != 10000 {
+		t.Errorf("got value %d after modifying selected copy", utxo.Value)
+	}
+}
+
+func TestLockUtxo(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	available := addTestUtxo(mw, "1", 10000, 1)
+	unconfirmed := addTestUtxo(mw, "2", 10000, 0)
+
+	tests := []struct {
+		name    string
+		utxoIDs []string
+		isErr   bool
+	}{
+		{"missing", []string{"missing_0"}, true},
+		{"unconfirmed", []string{available, unconfirmed}, true},
+		{"available", []string{available}, false},
+		{"already locked", []string{available}, true},
+	}
+	for _, test := range tests {
+		if err := mw.LockUtxo(test.utxoIDs); (err != nil) != test.isErr {
+			t.Errorf("%s: got err %v", test.name, err)
+		}
+	}
+	//部分utxo不可用时不锁定任何utxo
+	if mw.IsUtxoLocked(unconfirmed) {
+		t.Error("unconfirmed utxo locked")
+	}
+}
+
+func TestUtxoLockPersisted(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.timeout = 60
+	utxoID := addTestUtxo(mw, "1", 10000, 1)
+	if err := mw.LockUtxo([]string{utxoID}); err != nil {
+		t.Fatalf("lock utxo: %v", err)
+	}
+	data, err := mw.levelDb.Get(mw.getUtxoLockKey(utxoID))
+	lock := &utxoLock{}
+	if err != nil || json.Unmarshal(data, lock) != nil || lock.ExpireAt <= time.Now().Unix() {
+		t.Fatalf("got utxo lock %s err %v", data, err)
+	}
+
+	//过期的锁定在重启时删除
+	expired := "expired_0"
+	data, _ = json.Marshal(&utxoLock{ExpireAt: time.Now().Unix() - 1})
+	mw.levelDb.Put(mw.getUtxoLockKey(expired), data)
+
+	//重启后恢复未过期的锁定，剩余时间不变
+	restarted := newTestMortgageWatcher(t, "btc")
+	restarted.levelDb = mw.levelDb
+	restarted.timeout = 60
+	restarted.loadUtxoLock()
+	if !restarted.IsUtxoLocked(utxoID) {
+		t.Fatal("utxo lock not restored after restart")
+	}
+	if count, _ := restarted.utxoMonitorCount.Load(utxoID); count.(int) > 1 {
+		t.Errorf("got lock count %d after restart, want at most 1", count)
+	}
+	if restarted.IsUtxoLocked(expired) {
+		t.Error("expired utxo lock restored")
+	}
+	if _, err := mw.levelDb.Get(mw.getUtxoLockKey(expired)); err != dbop.ErrNotFound {
+		t.Errorf("got err %v for expired lock, want ErrNotFound", err)
+	}
+
+	restarted.UnlockUtxo([]string{utxoID})
+	if restarted.IsUtxoLocked(utxoID) {
+		t.Error("utxo still locked after unlock")
+	}
+	if _, err := mw.levelDb.Get(mw.getUtxoLockKey(utxoID)); err != dbop.ErrNotFound {
+		t.Errorf("got err %v for unlocked utxo, want ErrNotFound", err)
+	}
+}
+
+func TestUtxoLockExpire(t *testing.T) {
+	mw := newTestMortgageWatcher(t, "btc")
+	mw.timeout = 2
+	utxoID := addTestUtxo(mw, "1", 10000, 1)
+	if err := mw.LockUtxo([]string{utxoID}); err != nil {
+		t.Fatalf("lock utxo: %v", err)
+	}
+
+	mw.expireUtxoLock()
+	if !mw.IsUtxoLocked(utxoID) {
+		t.Fatal("utxo lock expired before timeout")
+	}
+	mw.expireUtxoLock()
+	if mw.IsUtxoLocked(utxoID) {
+		t.Fatal("utxo still locked after timeout")
+	}
+	if _, err := mw.levelDb.Get(mw.getUtxoLockKey(utxoID)); err != dbop.ErrNotFound {
+		t.Errorf("got err %v for expired lock, want ErrNotFound", err)
+	}
+
+	//解锁后重新锁定重新计时
+	if utxos, err := mw.SelectUtxo(10000); err != nil || len(utxos) != 1 {
+		t.Fatalf("got utxos %v err %v after lock expired", utxos, err)
+	}
+	mw.expireUtxoLock()
+	if !mw.IsUtxoLocked(utxoID) {
+		t.Error("relocked utxo expired early")
+	}
+}
@@ -1,7 +1,7 @@
 package primitives
 
 //// GetCurrentHeight 获取上次某条公链监听到的高度
-//func GetCurrentHeight(db *dgwdb.LDBDatabase, chainType string) int64 {
+//func GetCurrentHeight(db dbop.Database, chainType string) int64 {
 //	k := append(keyHeightPrefix, []byte(chainType)...)
 //	data, err := db.Get(k)
 //	if err != nil {
@@ -15,7 +15,7 @@ package primitives
 //}
 //
 //// InitDB 初始化leveldb数据
-//func InitDB(db *dgwdb.LDBDatabase, genesis *pb.BlockPack) {
+//func InitDB(db dbop.Database, genesis *pb.BlockPack) {
 //	db.Delete(keyTerm)
 //	db.Delete(keyLastTermAccuse)
 //	db.Delete(keyWeakAccuses)
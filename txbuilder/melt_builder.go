@@ -0,0 +1,276 @@
+package txbuilder
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/JimmyHongjichuan/btc_watcher/mortgagewatcher"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	log "github.com/inconshreveable/log15"
+)
+
+var defaultFeeRate int64 = 20
+var maxSelectTimes = 10
+
+//MeltTx 未签名的熔币交易
+type MeltTx struct {
+	Tx             *wire.MsgTx
+	Utxos          []*coinmanager.UtxoInfo //按输入顺序排列的utxo
+	RedeemScripts  [][]byte                //按输入顺序排列的兑现脚本
+	Fee            int64
+	Change         int64
+	HashBeforeSign string
+}
+
+//MeltTxBuilder 熔币交易构造类，从MortgageWatcher中选择多签地址utxo构造未签名交易
+type MeltTxBuilder struct {
+	watcher *mortgagewatcher.MortgageWatcher
+	feeRate int64                                  //satoshi/vbyte
+	fetchTx func(txid string) (*wire.MsgTx, error) //查询utxo所在的交易，用于PSBT中非见证输入的NonWitnessUtxo
+}
+
+//NewMeltTxBuilder 创建熔币交易构造实例，feeRate单位为satoshi/vbyte，小于等于0时使用默认值
+func NewMeltTxBuilder(watcher *mortgagewatcher.MortgageWatcher, feeRate int64) *MeltTxBuilder {
+	if feeRate <= 0 {
+		feeRate = defaultFeeRate
+	}
+	return &MeltTxBuilder{
+		watcher: watcher,
+		feeRate: feeRate,
+		fetchTx: watcher.GetRawTransaction,
+	}
+}
+
+//BuildMeltTx 构造支付给recipients的熔币交易，找零到多签地址
+//选中的utxo会被锁定，签名广播失败时调用方需通过MortgageWatcher.UnlockUtxo解锁
+func (b *MeltTxBuilder) BuildMeltTx(recipients []*mortgagewatcher.AddressInfo) (*MeltTx, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("empty recipients")
+	}
+
+	coinType := b.watcher.GetCoinType()
+	dustThreshold := b.watcher.GetDustThreshold()
+	var outputs []*wire.TxOut
+	var amount int64
+	for _, recipient := range recipients {
+		if recipient.Amount < dustThreshold {
+			return nil, fmt.Errorf("amount of %s below dust threshold", recipient.Address)
+		}
+		pkScript, err := coinmanager.PayToAddrScript(recipient.Address, coinType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient address %s: %v", recipient.Address, err)
+		}
+		outputs = append(outputs, wire.NewTxOut(recipient.Amount, pkScript))
+		amount += recipient.Amount
+	}
+
+	changeInfo, err := b.watcher.GetChangeAddress()
+	if err != nil {
+		return nil, err
+	}
+	changeScript, err := coinmanager.PayToAddrScript(changeInfo.Address, coinType)
+	if err != nil {
+		return nil, err
+	}
+
+	utxos, spendInfos, err := b.selectUtxo(amount, outputs, changeScript)
+	if err != nil {
+		return nil, err
+	}
+
+	meltTx, err := b.buildTx(utxos, spendInfos, outputs, changeScript)
+	if err != nil {
+		b.watcher.UnlockUtxo(getUtxoIDs(utxos))
+		return nil, err
+	}
+
+	log.Info("build melt tx", "hash_before_sign", meltTx.HashBeforeSign, "inputs", len(utxos), "amount", amount,
+		"fee", meltTx.Fee, "change", meltTx.Change, "coinType", coinType)
+	return meltTx, nil
+}
+
+//spendInfo 花费多签utxo所需的兑现脚本，witness为true时是P2WSH输入，兑现脚本作为见证脚本
+type spendInfo struct {
+	redeemScript []byte
+	witness      bool
+}
+
+//selectUtxo 选择足够支付金额和手续费的utxo，手续费随输入数量变化，不足时重新选择
+func (b *MeltTxBuilder) selectUtxo(amount int64, outputs []*wire.TxOut, changeScript []byte) ([]*coinmanager.UtxoInfo, []*spendInfo, error) {
+	fee := b.feeRate * estimateVSize(nil, outputs, changeScript)
+
+	for i := 0; i < maxSelectTimes; i++ {
+		utxos, err := b.watcher.SelectUtxo(amount + fee)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		spendInfos, err := b.getSpendInfos(utxos)
+		if err != nil {
+			b.watcher.UnlockUtxo(getUtxoIDs(utxos))
+			return nil, nil, err
+		}
+
+		fee = b.feeRate * estimateVSize(spendInfos, outputs, changeScript)
+		if sumUtxoValue(utxos) >= amount+fee {
+			return utxos, spendInfos, nil
+		}
+		b.watcher.UnlockUtxo(getUtxoIDs(utxos))
+	}
+
+	return nil, nil, mortgagewatcher.ErrInsufficientUtxo
+}
+
+func (b *MeltTxBuilder) getSpendInfos(utxos []*coinmanager.UtxoInfo) ([]*spendInfo, error) {
+	var spendInfos []*spendInfo
+	for _, utxo := range utxos {
+		info := b.watcher.GetFederationInfo(utxo.Address)
+		if info == nil || len(info.RedeemScript) == 0 {
+			return nil, fmt.Errorf("redeem script of %s not found", utxo.Address)
+		}
+		pkScript, err := coinmanager.PayToAddrScript(utxo.Address, b.watcher.GetCoinType())
+		if err != nil {
+			return nil, err
+		}
+		spendInfos = append(spendInfos, &spendInfo{
+			redeemScript: info.RedeemScript,
+			witness:      txscript.IsPayToWitnessScriptHash(pkScript),
+		})
+	}
+	return spendInfos, nil
+}
+
+//buildTx 构造交易，找零低于粉尘阈值或changeScript为nil时并入手续费
+func (b *MeltTxBuilder) buildTx(utxos []*coinmanager.UtxoInfo, spendInfos []*spendInfo, outputs []*wire.TxOut, changeScript []byte) (*MeltTx, error) {
+	tx := wire.NewMsgTx(wire.TxVersion)
+	var redeemScripts [][]byte
+	for i, utxo := range utxos {
+		hash, err := chainhash.NewHashFromStr(utxo.Txid)
+		if err != nil {
+			return nil, err
+		}
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, utxo.Vout), nil, nil))
+		redeemScripts = append(redeemScripts, spendInfos[i].redeemScript)
+	}
+
+	var amount int64
+	for _, output := range outputs {
+		tx.AddTxOut(output)
+		amount += output.Value
+	}
+
+	total := sumUtxoValue(utxos)
+	fee := b.feeRate * estimateVSize(spendInfos, outputs, changeScript)
+	change := total - amount - fee
+	if change < 0 {
+		return nil, mortgagewatcher.ErrInsufficientUtxo
+	}
+
+	if change >= b.watcher.GetDustThreshold() && changeScript != nil {
+		tx.AddTxOut(wire.NewTxOut(change, changeScript))
+	} else {
+		fee += change
+		change = 0
+	}
+
+	return &MeltTx{
+		Tx:             tx,
+		Utxos:          utxos,
+		RedeemScripts:  redeemScripts,
+		Fee:            fee,
+		Change:         change,
+		HashBeforeSign: mortgagewatcher.HashBeforeSign(tx),
+	}, nil
+}
+
+//estimateVSize 估算签名后交易的vsize，changeScript不为nil时包含找零输出
+//vsize = (非见证数据大小*4 + 见证数据大小) / 4
+func estimateVSize(spendInfos []*spendInfo, outputs []*wire.TxOut, changeScript []byte) int64 {
+	//version + locktime + 输入输出数量
+	baseSize := int64(4 + 4 + wire.VarIntSerializeSize(uint64(len(spendInfos))) + wire.VarIntSerializeSize(uint64(len(outputs)+1)))
+	var witnessSize int64
+
+	for _, info := range spendInfos {
+		if info.witness {
+			baseSize += estimateInputSize(nil)
+			witnessSize += estimateWitnessSize(info.redeemScript)
+		} else {
+			baseSize += estimateInputSize(info.redeemScript)
+			witnessSize++
+		}
+	}
+	for _, output := range outputs {
+		baseSize += int64(output.SerializeSize())
+	}
+	if changeScript != nil {
+		baseSize += int64(wire.NewTxOut(0, changeScript).SerializeSize())
+	}
+
+	for _, info := range spendInfos {
+		if info.witness {
+			//marker + flag
+			weight := baseSize*4 + witnessSize + 2
+			return (weight + 3) / 4
+		}
+	}
+	return baseSize
+}
+
+//estimateInputSize 估算P2SH多签输入签名后的大小，redeemScript为nil时为P2WSH输入
+func estimateInputSize(redeemScript []byte) int64 {
+	var scriptSigSize int
+	if redeemScript != nil {
+		//OP_0 + 签名(push + 最长72字节DER签名 + hashtype) + push兑现脚本
+		scriptSigSize = 1 + getNumSigs(redeemScript)*(1+73) + pushDataSize(len(redeemScript)) + len(redeemScript)
+	}
+	//outpoint + sequence + 脚本长度 + 脚本
+	return int64(32 + 4 + 4 + wire.VarIntSerializeSize(uint64(scriptSigSize)) + scriptSigSize)
+}
+
+//estimateWitnessSize 估算P2WSH多签输入的见证数据大小
+func estimateWitnessSize(witnessScript []byte) int64 {
+	numSigs := getNumSigs(witnessScript)
+	//见证项数量 + 空项 + 签名 + 见证脚本
+	return int64(wire.VarIntSerializeSize(uint64(numSigs+2)) + 1 + numSigs*(1+73) +
+		wire.VarIntSerializeSize(uint64(len(witnessScript))) + len(witnessScript))
+}
+
+func getNumSigs(redeemScript []byte) int {
+	_, numSigs, err := txscript.CalcMultiSigStats(redeemScript)
+	if err != nil {
+		return 1
+	}
+	return numSigs
+}
+
+func pushDataSize(dataLen int) int {
+	switch {
+	case dataLen < txscript.OP_PUSHDATA1:
+		return 1
+	case dataLen <= 0xff:
+		return 2
+	case dataLen <= 0xffff:
+		return 3
+	default:
+		return 5
+	}
+}
+
+func sumUtxoValue(utxos []*coinmanager.UtxoInfo) int64 {
+	var total int64
+	for _, utxo := range utxos {
+		total += utxo.Value
+	}
+	return total
+}
+
+func getUtxoIDs(utxos []*coinmanager.UtxoInfo) []string {
+	var utxoIDs []string
+	for _, utxo := range utxos {
+		utxoIDs = append(utxoIDs, fmt.Sprintf("%s_%d", utxo.Txid, utxo.Vout))
+	}
+	return utxoIDs
+}
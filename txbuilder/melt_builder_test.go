@@ -0,0 +1,197 @@
+package txbuilder
+
+import (
+	"testing"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/JimmyHongjichuan/btc_watcher/mortgagewatcher"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+//newTestMultisig 生成m-of-n多签兑现脚本，私钥为1到n
+func newTestMultisig(t *testing.T, m int, n int) ([]byte, []*btcec.PrivateKey) {
+	var keys []*btcec.PrivateKey
+	var pubKeys []*btcutil.AddressPubKey
+	for i := 1; i <= n; i++ {
+		key := testPrivKey(byte(i))
+		pubKey, err := btcutil.NewAddressPubKey(key.PubKey().SerializeCompressed(), &chaincfg.MainNetParams)
+		if err != nil {
+			t.Fatalf("new address pubkey: %v", err)
+		}
+		keys = append(keys, key)
+		pubKeys = append(pubKeys, pubKey)
+	}
+	script, err := txscript.MultiSigScript(pubKeys, m)
+	if err != nil {
+		t.Fatalf("multisig script: %v", err)
+	}
+	return script, keys
+}
+
+//signTestInputs 用前m个私钥对所有输入签名，P2SH输入生成签名脚本，P2WSH输入生成见证
+func signTestInputs(t *testing.T, tx *wire.MsgTx, spendInfos []*spendInfo, keys [][]*btcec.PrivateKey, amount int64) {
+	for i, info := range spendInfos {
+		var sigs [][]byte
+		for _, key := range keys[i][:getNumSigs(info.redeemScript)] {
+			var sig []byte
+			var err error
+			if info.witness {
+				sig, err = coinmanager.RawTxInWitnessSignature(tx, i, info.redeemScript, txscript.SigHashAll, key, amount)
+			} else {
+				sig, err = coinmanager.RawTxInSignature(tx, i, info.redeemScript, txscript.SigHashAll, key, amount, "btc")
+			}
+			if err != nil {
+				t.Fatalf("sign input %d: %v", i, err)
+			}
+			sigs = append(sigs, sig)
+		}
+
+		if info.witness {
+			witness := append(wire.TxWitness{nil}, sigs...)
+			tx.TxIn[i].Witness = append(witness, info.redeemScript)
+			continue
+		}
+		builder := txscript.NewScriptBuilder().AddOp(txscript.OP_0)
+		for _, sig := range sigs {
+			builder.AddData(sig)
+		}
+		sigScript, err := builder.AddData(info.redeemScript).Script()
+		if err != nil {
+			t.Fatalf("build signature script: %v", err)
+		}
+		tx.TxIn[i].SignatureScript = sigScript
+	}
+}
+
+func TestEstimateVSize(t *testing.T) {
+	recipient, _ := coinmanager.PayToAddrScript(testRecipientAddress, "btc")
+	changeScript := []byte{txscript.OP_HASH160, txscript.OP_DATA_20,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, txscript.OP_EQUAL}
+
+	type input struct {
+		m, n    int
+		witness bool
+	}
+	tests := []struct {
+		name   string
+		inputs []input
+	}{
+		{"p2sh 2-of-3", []input{{2, 3, false}}},
+		{"p2sh 2-of-3 three inputs", []input{{2, 3, false}, {2, 3, false}, {2, 3, false}}},
+		{"p2sh 3-of-5", []input{{3, 5, false}, {3, 5, false}}},
+		{"p2wsh 2-of-3", []input{{2, 3, true}}},
+		{"p2wsh 5-of-7 two inputs", []input{{5, 7, true}, {5, 7, true}}},
+		{"p2sh and p2wsh", []input{{2, 3, false}, {3, 5, true}}},
+	}
+
+	for _, test := range tests {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		var spendInfos []*spendInfo
+		var keys [][]*btcec.PrivateKey
+		var numSigs int
+		for i, in := range test.inputs {
+			redeemScript, inputKeys := newTestMultisig(t, in.m, in.n)
+			spendInfos = append(spendInfos, &spendInfo{redeemScript: redeemScript, witness: in.witness})
+			keys = append(keys, inputKeys)
+			numSigs += in.m
+			tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{byte(i + 1)}, 0), nil, nil))
+		}
+		outputs := []*wire.TxOut{wire.NewTxOut(50000, recipient)}
+		tx.AddTxOut(outputs[0])
+		tx.AddTxOut(wire.NewTxOut(10000, changeScript))
+		signTestInputs(t, tx, spendInfos, keys, 100000)
+
+		//签名后的vsize按BIP141计算
+		weight := blockchain.GetTransactionWeight(btcutil.NewTx(tx))
+		actual := (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor
+		estimated := estimateVSize(spendInfos, outputs, changeScript)
+		//估算按最长73字节签名，实际签名71到73字节
+		if estimated < actual || estimated-actual > int64(2*numSigs+1) {
+			t.Errorf("%s: estimated vsize %d, actual %d", test.name, estimated, actual)
+		}
+	}
+}
+
+func TestBuildTxChange(t *testing.T) {
+	b, watcher := newTestMeltTxBuilder(t, coinmanager.FederationAddressP2SH)
+	info, _ := watcher.GetChangeAddress()
+	changeScript, _ := coinmanager.PayToAddrScript(info.Address, "btc")
+	recipient, _ := coinmanager.PayToAddrScript(testRecipientAddress, "btc")
+	utxos := watcher.GetUtxoList(nil)[:1]
+	spendInfos, err := b.getSpendInfos(utxos)
+	if err != nil {
+		t.Fatalf("get spend infos: %v", err)
+	}
+	feeWithChange := b.feeRate * estimateVSize(spendInfos, []*wire.TxOut{wire.NewTxOut(0, recipient)}, changeScript)
+
+	//找零低于粉尘阈值或没有找零脚本时并入手续费
+	tests := []struct {
+		name         string
+		amount       int64
+		changeScript []byte
+		change       int64
+	}{
+		{"change", 100000 - feeWithChange - 546, changeScript, 546},
+		{"dust change", 100000 - feeWithChange - 545, changeScript, 0},
+		{"no change script", 50000, nil, 0},
+	}
+	for _, test := range tests {
+		meltTx, err := b.buildTx(utxos, spendInfos, []*wire.TxOut{wire.NewTxOut(test.amount, recipient)}, test.changeScript)
+		if err != nil {
+			t.Errorf("%s: build tx: %v", test.name, err)
+			continue
+		}
+		if meltTx.Change != test.change || meltTx.Fee+meltTx.Change+test.amount != 100000 {
+			t.Errorf("%s: got change %d fee %d, want change %d", test.name, meltTx.Change, meltTx.Fee, test.change)
+		}
+		outputs := 1
+		if test.change > 0 {
+			outputs = 2
+		}
+		if len(meltTx.Tx.TxOut) != outputs {
+			t.Errorf("%s: got %d outputs, want %d", test.name, len(meltTx.Tx.TxOut), outputs)
+		}
+	}
+
+	if _, err := b.buildTx(utxos, spendInfos, []*wire.TxOut{wire.NewTxOut(100000, recipient)}, changeScript); err != mortgagewatcher.ErrInsufficientUtxo {
+		t.Errorf("got err %v for amount without fee, want ErrInsufficientUtxo", err)
+	}
+}
+
+func TestSelectUtxoFeeReestimate(t *testing.T) {
+	b, watcher := newTestMeltTxBuilder(t, coinmanager.FederationAddressP2SH)
+
+	//只按输出估算的手续费一个utxo足够，加入输入后手续费不足，重新选择两个utxo
+	meltTx, err := b.BuildMeltTx([]*mortgagewatcher.AddressInfo{{Address: testRecipientAddress, Amount: 99000}})
+	if err != nil {
+		t.Fatalf("build melt tx: %v", err)
+	}
+	if len(meltTx.Utxos) != 2 {
+		t.Fatalf("got %d utxos, want 2", len(meltTx.Utxos))
+	}
+	for _, utxoID := range getUtxoIDs(meltTx.Utxos) {
+		if !watcher.IsUtxoLocked(utxoID) {
+			t.Errorf("selected utxo %s not locked", utxoID)
+		}
+	}
+	if meltTx.Fee+meltTx.Change+99000 != 200000 {
+		t.Errorf("got fee %d change %d, inputs and outputs mismatch", meltTx.Fee, meltTx.Change)
+	}
+	watcher.UnlockUtxo(getUtxoIDs(meltTx.Utxos))
+
+	//加上手续费后全部utxo都不足时解锁返回错误
+	if _, err := b.BuildMeltTx([]*mortgagewatcher.AddressInfo{{Address: testRecipientAddress, Amount: 199000}}); err != mortgagewatcher.ErrInsufficientUtxo {
+		t.Fatalf("got err %v, want ErrInsufficientUtxo", err)
+	}
+	for _, utxo := range watcher.GetUtxoList(nil) {
+		if watcher.IsUtxoLocked(utxo.Txid + "_0") {
+			t.Errorf("utxo %s still locked after failed selection", utxo.Txid)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package txbuilder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/psbt"
+	log "github.com/inconshreveable/log15"
+)
+
+//MeltPsbt 熔币交易的PSBT(BIP174)，用于多签成员之间传递部分签名
+//P2WSH输入在WitnessUtxo中记录utxo，P2SH输入按BIP174在NonWitnessUtxo中记录utxo所在的完整交易
+//每个输入记录utxo金额和兑现脚本，各成员用本地私钥签名后合并，签名数达到兑现脚本要求的m后完成交易
+//签名类型按coinType选择，bch为SIGHASH_ALL|SIGHASH_FORKID
+//签名前检查PSBT与本地构造的熔币交易一致，避免签名被篡改的交易
+type MeltPsbt struct {
+	Packet   *psbt.Packet
+	coinType string
+	meltTx   *MeltTx
+}
+
+//NewMeltPsbt 根据未签名的熔币交易创建PSBT，P2SH输入的utxo所在交易通过全节点查询，已确认的交易需要全节点开启txindex
+func (b *MeltTxBuilder) NewMeltPsbt(meltTx *MeltTx) (*MeltPsbt, error) {
+	if len(meltTx.Utxos) != len(meltTx.Tx.TxIn) || len(meltTx.RedeemScripts) != len(meltTx.Tx.TxIn) {
+		return nil, errors.New("utxo and input mismatch")
+	}
+
+	packet, err := psbt.NewFromUnsignedTx(meltTx.Tx.Copy())
+	if err != nil {
+		return nil, err
+	}
+
+	coinType := b.watcher.GetCoinType()
+	for i, utxo := range meltTx.Utxos {
+		pkScript, err := coinmanager.PayToAddrScript(utxo.Address, coinType)
+		if err != nil {
+			return nil, err
+		}
+		if txscript.IsPayToWitnessScriptHash(pkScript) {
+			packet.Inputs[i].WitnessUtxo = wire.NewTxOut(utxo.Value, pkScript)
+			packet.Inputs[i].WitnessScript = meltTx.RedeemScripts[i]
+		} else {
+			prevTx, err := b.fetchTx(utxo.Txid)
+			if err != nil {
+				return nil, fmt.Errorf("get tx of utxo %s_%d failed: %v", utxo.Txid, utxo.Vout, err)
+			}
+			packet.Inputs[i].NonWitnessUtxo = prevTx
+			packet.Inputs[i].RedeemScript = meltTx.RedeemScripts[i]
+		}
+		packet.Inputs[i].SighashType = coinmanager.GetSigHashType(coinType)
+
+		//查询到的交易需与utxo一致
+		txOut, err := spentOutput(packet, i)
+		if err != nil {
+			return nil, err
+		}
+		if txOut.Value != utxo.Value || !bytes.Equal(txOut.PkScript, pkScript) {
+			return nil, fmt.Errorf("input %d utxo mismatch with previous tx", i)
+		}
+	}
+
+	return &MeltPsbt{
+		Packet:   packet,
+		coinType: coinType,
+		meltTx:   meltTx,
+	}, nil
+}
+
+//ImportMeltPsbt 从base64字符串导入其他成员发起的PSBT，meltTx为本地按相同参数构造的熔币交易
+//要求未签名交易与meltTx一致，兑现脚本与输入的锁定脚本匹配，输入金额与本地utxo一致且utxo已被本地锁定
+func (b *MeltTxBuilder) ImportMeltPsbt(data string, meltTx *MeltTx) (*MeltPsbt, error) {
+	packet, err := psbt.NewFromRawBytes(strings.NewReader(data), true)
+	if err != nil {
+		return nil, err
+	}
+
+	coinType := b.watcher.GetCoinType()
+	for i, input := range packet.Inputs {
+		if len(signScript(&input)) == 0 {
+			return nil, fmt.Errorf("input %d missing redeem script", i)
+		}
+		txOut, err := spentOutput(packet, i)
+		if err != nil {
+			return nil, err
+		}
+		if input.SighashType != coinmanager.GetSigHashType(coinType) {
+			return nil, fmt.Errorf("input %d invalid sighash type %d", i, input.SighashType)
+		}
+		address := coinmanager.ExtractPkScriptAddr(txOut.PkScript, coinType)
+		info := b.watcher.GetFederationInfo(address)
+		if info == nil {
+			return nil, fmt.Errorf("input %d not spend from federation address", i)
+		}
+		if !bytes.Equal(signScript(&input), info.RedeemScript) || !matchPkScript(&input, txOut.PkScript) {
+			return nil, fmt.Errorf("input %d redeem script mismatch with pkScript", i)
+		}
+
+		outPoint := packet.UnsignedTx.TxIn[i].PreviousOutPoint
+		utxoID := fmt.Sprintf("%s_%d", outPoint.Hash.String(), outPoint.Index)
+		utxo := b.watcher.GetUtxo(utxoID)
+		if utxo == nil || utxo.Address != address || utxo.Value != txOut.Value {
+			return nil, fmt.Errorf("input %d utxo %s mismatch with local utxo", i, utxoID)
+		}
+		if !b.watcher.IsUtxoLocked(utxoID) {
+			return nil, fmt.Errorf("input %d utxo %s not locked", i, utxoID)
+		}
+	}
+
+	p := &MeltPsbt{
+		Packet:   packet,
+		coinType: coinType,
+		meltTx:   meltTx,
+	}
+	err = p.checkMeltTx()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//checkMeltTx 检查未签名交易、输入金额和兑现脚本与本地构造的熔币交易一致
+func (p *MeltPsbt) checkMeltTx() error {
+	if p.meltTx == nil {
+		return errors.New("melt tx not built locally")
+	}
+	if p.Packet.UnsignedTx.TxHash() != p.meltTx.Tx.TxHash() {
+		return errors.New("unsigned tx mismatch with local melt tx")
+	}
+	if len(p.meltTx.Utxos) != len(p.Packet.Inputs) || len(p.meltTx.RedeemScripts) != len(p.Packet.Inputs) {
+		return errors.New("utxo and input mismatch")
+	}
+	for i := range p.Packet.Inputs {
+		input := &p.Packet.Inputs[i]
+		txOut, err := spentOutput(p.Packet, i)
+		if err != nil || txOut.Value != p.meltTx.Utxos[i].Value {
+			return fmt.Errorf("input %d value mismatch with local melt tx", i)
+		}
+		if !bytes.Equal(signScript(input), p.meltTx.RedeemScripts[i]) || !matchPkScript(input, txOut.PkScript) {
+			return fmt.Errorf("input %d redeem script mismatch with local melt tx", i)
+		}
+	}
+	return nil
+}
+
+//Export 导出为base64字符串
+func (p *MeltPsbt) Export() (string, error) {
+	return p.Packet.B64Encode()
+}
+
+//HashBeforeSign 签名前的交易hash
+func (p *MeltPsbt) HashBeforeSign() string {
+	return p.Packet.UnsignedTx.TxHash().String()
+}
+
+//Sign 用私钥对兑现脚本中包含该公钥的输入签名，返回新签名的输入数量
+func (p *MeltPsbt) Sign(key *btcec.PrivateKey) (int, error) {
+	err := p.checkMeltTx()
+	if err != nil {
+		return 0, err
+	}
+
+	var signed int
+	for i := range p.Packet.Inputs {
+		input := &p.Packet.Inputs[i]
+		script := signScript(input)
+		//兑现脚本中的公钥可能是压缩或非压缩格式
+		pubKey := key.PubKey().SerializeCompressed()
+		if !containsPubKey(script, pubKey) {
+			pubKey = key.PubKey().SerializeUncompressed()
+		}
+		if !containsPubKey(script, pubKey) || hasPartialSig(input, pubKey) {
+			continue
+		}
+
+		txOut, err := spentOutput(p.Packet, i)
+		if err != nil {
+			return signed, err
+		}
+		var sig []byte
+		if isWitnessInput(input) {
+			sig, err = coinmanager.RawTxInWitnessSignature(p.Packet.UnsignedTx, i, script, input.SighashType, key,
+				txOut.Value)
+		} else {
+			sig, err = coinmanager.RawTxInSignature(p.Packet.UnsignedTx, i, script, input.SighashType, key,
+				txOut.Value, p.coinType)
+		}
+		if err != nil {
+			return signed, err
+		}
+		input.PartialSigs = append(input.PartialSigs, &psbt.PartialSig{
+			PubKey:    pubKey,
+			Signature: sig,
+		})
+		signed++
+	}
+
+	log.Debug("sign melt psbt", "hash_before_sign", p.HashBeforeSign(), "signed", signed, "coinType", p.coinType)
+	return signed, nil
+}
+
+//Combine 合并其他成员签名的同一笔交易的PSBT
+func (p *MeltPsbt) Combine(other *MeltPsbt) error {
+	if p.HashBeforeSign() != other.HashBeforeSign() {
+		return errors.New("combine different transaction")
+	}
+
+	for i := range p.Packet.Inputs {
+		input := &p.Packet.Inputs[i]
+		for _, partialSig := range other.Packet.Inputs[i].PartialSigs {
+			if !containsPubKey(signScript(input), partialSig.PubKey) || hasPartialSig(input, partialSig.PubKey) {
+				continue
+			}
+			if !p.verifyPartialSig(i, partialSig) {
+				log.Warn("invalid partial sig", "input", i, "pubkey", fmt.Sprintf("%x", partialSig.PubKey), "coinType", p.coinType)
+				continue
+			}
+			input.PartialSigs = append(input.PartialSigs, partialSig)
+		}
+	}
+	return nil
+}
+
+//IsReady 所有输入的签名数是否都已达到兑现脚本要求的数量
+func (p *MeltPsbt) IsReady() bool {
+	for i := range p.Packet.Inputs {
+		input := &p.Packet.Inputs[i]
+		_, numSigs, err := txscript.CalcMultiSigStats(signScript(input))
+		if err != nil || len(input.PartialSigs) < numSigs {
+			return false
+		}
+	}
+	return true
+}
+
+//Finalize 按兑现脚本中公钥的顺序组装签名，生成完整交易并记录签名前后的hash映射
+//P2SH输入生成 OP_0 <sig>... <redeemScript>，P2WSH输入生成见证 <> <sig>... <witnessScript>
+func (b *MeltTxBuilder) Finalize(p *MeltPsbt) (*wire.MsgTx, error) {
+	for i := range p.Packet.Inputs {
+		input := &p.Packet.Inputs[i]
+		sigs, err := p.collectSigs(i, input)
+		if err != nil {
+			return nil, err
+		}
+
+		if isWitnessInput(input) {
+			witness := append([][]byte{nil}, sigs...)
+			witness = append(witness, input.WitnessScript)
+			input.FinalScriptWitness, err = serializeWitness(witness)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		builder := txscript.NewScriptBuilder().AddOp(txscript.OP_0)
+		for _, sig := range sigs {
+			builder.AddData(sig)
+		}
+		input.FinalScriptSig, err = builder.AddData(input.RedeemScript).Script()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := psbt.Extract(p.Packet)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.watcher.RecordSignedTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+//collectSigs 按兑现脚本中公钥的顺序取m个有效签名
+func (p *MeltPsbt) collectSigs(index int, input *psbt.PInput) ([][]byte, error) {
+	script := signScript(input)
+	_, numSigs, err := txscript.CalcMultiSigStats(script)
+	if err != nil {
+		return nil, err
+	}
+	pubKeys, err := txscript.PushedData(script)
+	if err != nil {
+		return nil, err
+	}
+
+	var sigs [][]byte
+	for _, pubKey := range pubKeys {
+		if len(sigs) >= numSigs {
+			break
+		}
+		for _, partialSig := range input.PartialSigs {
+			if bytes.Equal(partialSig.PubKey, pubKey) && p.verifyPartialSig(index, partialSig) {
+				sigs = append(sigs, partialSig.Signature)
+				break
+			}
+		}
+	}
+	if len(sigs) < numSigs {
+		return nil, fmt.Errorf("input %d need %d signatures, got %d", index, numSigs, len(sigs))
+	}
+	return sigs, nil
+}
+
+func (p *MeltPsbt) verifyPartialSig(index int, partialSig *psbt.PartialSig) bool {
+	input := p.Packet.Inputs[index]
+	if len(partialSig.Signature) == 0 ||
+		txscript.SigHashType(partialSig.Signature[len(partialSig.Signature)-1]) != input.SighashType {
+		return false
+	}
+
+	sig, err := btcec.ParseDERSignature(partialSig.Signature[:len(partialSig.Signature)-1], btcec.S256())
+	if err != nil {
+		return false
+	}
+	pubKey, err := btcec.ParsePubKey(partialSig.PubKey, btcec.S256())
+	if err != nil {
+		return false
+	}
+	txOut, err := spentOutput(p.Packet, index)
+	if err != nil {
+		return false
+	}
+
+	var hash []byte
+	if isWitnessInput(&input) {
+		hash, err = coinmanager.CalcWitnessSignatureHash(input.WitnessScript, input.SighashType, p.Packet.UnsignedTx, index,
+			txOut.Value)
+	} else {
+		hash, err = coinmanager.CalcSignatureHash(input.RedeemScript, input.SighashType, p.Packet.UnsignedTx, index,
+			txOut.Value, p.coinType)
+	}
+	if err != nil {
+		return false
+	}
+	return sig.Verify(hash, pubKey)
+}
+
+//signScript 被签名的多签脚本，P2WSH输入为见证脚本，P2SH输入为兑现脚本
+func signScript(input *psbt.PInput) []byte {
+	if isWitnessInput(input) {
+		return input.WitnessScript
+	}
+	return input.RedeemScript
+}
+
+func isWitnessInput(input *psbt.PInput) bool {
+	return len(input.WitnessScript) > 0
+}
+
+//spentOutput 输入花费的utxo，P2WSH输入取自WitnessUtxo，P2SH输入取自NonWitnessUtxo中outpoint对应的输出
+func spentOutput(packet *psbt.Packet, index int) (*wire.TxOut, error) {
+	input := &packet.Inputs[index]
+	if isWitnessInput(input) {
+		if input.WitnessUtxo == nil {
+			return nil, fmt.Errorf("input %d missing witness utxo", index)
+		}
+		return input.WitnessUtxo, nil
+	}
+
+	if input.NonWitnessUtxo == nil || input.WitnessUtxo != nil {
+		return nil, fmt.Errorf("input %d missing non-witness utxo", index)
+	}
+	outPoint := packet.UnsignedTx.TxIn[index].PreviousOutPoint
+	if input.NonWitnessUtxo.TxHash() != outPoint.Hash || int(outPoint.Index) >= len(input.NonWitnessUtxo.TxOut) {
+		return nil, fmt.Errorf("input %d non-witness utxo mismatch with previous outpoint", index)
+	}
+	return input.NonWitnessUtxo.TxOut[outPoint.Index], nil
+}
+
+//matchPkScript 兑现脚本的hash是否与输入的锁定脚本一致，P2WSH为sha256，P2SH为hash160
+func matchPkScript(input *psbt.PInput, pkScript []byte) bool {
+	var builder *txscript.ScriptBuilder
+	if isWitnessInput(input) {
+		witnessHash := sha256.Sum256(input.WitnessScript)
+		builder = txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(witnessHash[:])
+	} else {
+		builder = txscript.NewScriptBuilder().AddOp(txscript.OP_HASH160).AddData(btcutil.Hash160(input.RedeemScript)).
+			AddOp(txscript.OP_EQUAL)
+	}
+	script, err := builder.Script()
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(script, pkScript)
+}
+
+func serializeWitness(witness [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	err := wire.WriteVarInt(&buf, 0, uint64(len(witness)))
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range witness {
+		err = wire.WriteVarBytes(&buf, 0, item)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func containsPubKey(redeemScript []byte, pubKey []byte) bool {
+	pushes, err := txscript.PushedData(redeemScript)
+	if err != nil {
+		return false
+	}
+	for _, push := range pushes {
+		if bytes.Equal(push, pubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPartialSig(input *psbt.PInput, pubKey []byte) bool {
+	for _, partialSig := range input.PartialSigs {
+		if bytes.Equal(partialSig.PubKey, pubKey) {
+			return true
+		}
+	}
+	return false
+}
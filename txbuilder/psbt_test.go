@@ -0,0 +1,277 @@
+package txbuilder
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/JimmyHongjichuan/btc_watcher/dbop"
+	"github.com/JimmyHongjichuan/btc_watcher/mortgagewatcher"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/psbt"
+	"github.com/spf13/viper"
+)
+
+const (
+	//testRedeemScript 2-of-2多签兑现脚本，公钥为私钥1和2对应的G和2G
+	testRedeemScript     = "52210279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f817982102c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee552ae"
+	testRecipientAddress = "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"
+)
+
+//newTestMeltTxBuilder 创建监听testRedeemScript多签地址的构造实例，addressType为p2sh或p2wsh
+//多签地址有两个100000聪的已确认utxo，utxo预先写入临时目录的leveldb，监听实例创建时从leveldb中load
+//不连接全节点，utxo所在的交易从本地查询
+func newTestMeltTxBuilder(t *testing.T, addressType string) (*MeltTxBuilder, *mortgagewatcher.MortgageWatcher) {
+	dbPath := t.TempDir()
+	settings := map[string]interface{}{
+		"net_param":           "mainnet",
+		"LEVELDB.db_backend":  dbop.BackendLevelDB,
+		"LEVELDB.btc_db_path": dbPath,
+		"BTC.load_mode":       "leveldb",
+		"BTC.dust_threshold":  546,
+	}
+	for key, value := range settings {
+		old := viper.Get(key)
+		viper.Set(key, value)
+		t.Cleanup(func() {
+			viper.Set(key, old)
+		})
+	}
+
+	redeemScript, _ := hex.DecodeString(testRedeemScript)
+	address, err := coinmanager.NewFederationAddress(redeemScript, "btc", addressType)
+	if err != nil {
+		t.Fatalf("federation address: %v", err)
+	}
+	pkScript, _ := coinmanager.PayToAddrScript(address, "btc")
+
+	db, err := dbop.OpenDatabase(dbop.BackendLevelDB, dbPath)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	prevTxs := make(map[string]*wire.MsgTx)
+	for seed := byte(1); seed <= 2; seed++ {
+		prevTx := wire.NewMsgTx(wire.TxVersion)
+		prevTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{seed}, 0), nil, nil))
+		prevTx.AddTxOut(wire.NewTxOut(100000, pkScript))
+		txid := prevTx.TxHash().String()
+		prevTxs[txid] = prevTx
+
+		data, _ := json.Marshal(&coinmanager.UtxoInfo{
+			Address:     address,
+			Txid:        txid,
+			Value:       100000,
+			SpendType:   1,
+			BlockHeight: 100,
+		})
+		db.Put([]byte("btc_utxo_"+txid+"_0"), data)
+	}
+	db.Close()
+
+	watcher, err := mortgagewatcher.NewMortgageWatcher("btc", 0, address, redeemScript, 60)
+	if err != nil {
+		t.Fatalf("create mortgage watcher: %v", err)
+	}
+	t.Cleanup(watcher.Stop)
+
+	b := NewMeltTxBuilder(watcher, 10)
+	b.fetchTx = func(txid string) (*wire.MsgTx, error) {
+		prevTx, ok := prevTxs[txid]
+		if !ok {
+			return nil, errors.New("tx not found")
+		}
+		return prevTx.Copy(), nil
+	}
+	return b, watcher
+}
+
+//newTestMeltTx 构造支付150000聪的熔币交易，两个utxo都被选中并锁定
+func newTestMeltTx(t *testing.T, b *MeltTxBuilder) *MeltTx {
+	meltTx, err := b.BuildMeltTx([]*mortgagewatcher.AddressInfo{{Address: testRecipientAddress, Amount: 150000}})
+	if err != nil {
+		t.Fatalf("build melt tx: %v", err)
+	}
+	if len(meltTx.Tx.TxIn) != 2 {
+		t.Fatalf("got %d inputs, want 2", len(meltTx.Tx.TxIn))
+	}
+	return meltTx
+}
+
+func testPrivKey(n byte) *btcec.PrivateKey {
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), []byte{n})
+	return key
+}
+
+//exchangeMeltPsbt 导出后由另一成员按本地熔币交易导入
+func exchangeMeltPsbt(t *testing.T, b *MeltTxBuilder, p *MeltPsbt, meltTx *MeltTx) *MeltPsbt {
+	data, err := p.Export()
+	if err != nil {
+		t.Fatalf("export psbt: %v", err)
+	}
+	imported, err := b.ImportMeltPsbt(data, meltTx)
+	if err != nil {
+		t.Fatalf("import psbt: %v", err)
+	}
+	return imported
+}
+
+func TestMeltPsbtSignAndFinalize(t *testing.T) {
+	for _, addressType := range []string{coinmanager.FederationAddressP2SH, coinmanager.FederationAddressP2WSH} {
+		t.Run(addressType, func(t *testing.T) {
+			testMeltPsbtSignAndFinalize(t, addressType)
+		})
+	}
+}
+
+func testMeltPsbtSignAndFinalize(t *testing.T, addressType string) {
+	b, watcher := newTestMeltTxBuilder(t, addressType)
+	meltTx := newTestMeltTx(t, b)
+
+	p, err := b.NewMeltPsbt(meltTx)
+	if err != nil {
+		t.Fatalf("new psbt: %v", err)
+	}
+	if p.HashBeforeSign() != meltTx.HashBeforeSign {
+		t.Errorf("got hash before sign %s, want %s", p.HashBeforeSign(), meltTx.HashBeforeSign)
+	}
+	//BIP174: 非见证输入记录完整的前序交易，P2WSH输入只记录花费的输出
+	for i, input := range p.Packet.Inputs {
+		witness := addressType == coinmanager.FederationAddressP2WSH
+		if (input.WitnessUtxo != nil) != witness || (input.NonWitnessUtxo != nil) == witness {
+			t.Errorf("input %d: got witness utxo %v non-witness utxo %v", i, input.WitnessUtxo != nil, input.NonWitnessUtxo != nil)
+		}
+	}
+
+	//两个成员各自导入后用自己的私钥签名
+	tests := []struct {
+		name     string
+		key      *btcec.PrivateKey
+		expected int
+	}{
+		{"first member", testPrivKey(1), 2},
+		{"sign again", testPrivKey(1), 0},
+		{"not member", testPrivKey(3), 0},
+	}
+	for _, test := range tests {
+		if signed, err := p.Sign(test.key); err != nil || signed != test.expected {
+			t.Errorf("%s: got %d signed err %v, want %d", test.name, signed, err, test.expected)
+		}
+	}
+	if p.IsReady() {
+		t.Fatal("psbt ready with one of two signatures")
+	}
+	if _, err := b.Finalize(p); err == nil {
+		t.Fatal("expected error finalizing psbt without enough signatures")
+	}
+
+	other := exchangeMeltPsbt(t, b, p, meltTx)
+	other.Packet.Inputs[0].PartialSigs = nil
+	other.Packet.Inputs[1].PartialSigs = nil
+	if signed, err := other.Sign(testPrivKey(2)); err != nil || signed != 2 {
+		t.Fatalf("got %d signed err %v for second member", signed, err)
+	}
+
+	//合并另一成员的签名，无效的签名被忽略
+	invalid := exchangeMeltPsbt(t, b, other, meltTx)
+	sig := invalid.Packet.Inputs[0].PartialSigs[0].Signature
+	sig[10] ^= 0xff
+	if err := p.Combine(invalid); err != nil {
+		t.Fatalf("combine invalid psbt: %v", err)
+	}
+	if len(p.Packet.Inputs[0].PartialSigs) != 1 || len(p.Packet.Inputs[1].PartialSigs) != 2 {
+		t.Errorf("got %d and %d partial sigs after combining invalid signature, want 1 and 2",
+			len(p.Packet.Inputs[0].PartialSigs), len(p.Packet.Inputs[1].PartialSigs))
+	}
+	if err := p.Combine(exchangeMeltPsbt(t, b, other, meltTx)); err != nil {
+		t.Fatalf("combine psbt: %v", err)
+	}
+	if !p.IsReady() {
+		t.Fatal("psbt not ready after combining signatures")
+	}
+
+	tx, err := b.Finalize(p)
+	if err != nil {
+		t.Fatalf("finalize psbt: %v", err)
+	}
+	for i, utxo := range meltTx.Utxos {
+		pkScript, _ := coinmanager.PayToAddrScript(utxo.Address, "btc")
+		engine, err := txscript.NewEngine(pkScript, tx, i, txscript.StandardVerifyFlags, nil, nil, utxo.Value)
+		if err == nil {
+			err = engine.Execute()
+		}
+		if err != nil {
+			t.Errorf("input %d: verify signature script: %v", i, err)
+		}
+	}
+	if hash, err := watcher.GetHashAfterSign(meltTx.HashBeforeSign); err != nil || hash != tx.TxHash().String() {
+		t.Errorf("got hash after sign %s err %v, want %s", hash, err, tx.TxHash().String())
+	}
+}
+
+func TestImportMeltPsbtRejects(t *testing.T) {
+	b, _ := newTestMeltTxBuilder(t, coinmanager.FederationAddressP2SH)
+	meltTx := newTestMeltTx(t, b)
+	//兑现脚本换成1-of-1多签
+	otherScript, _ := hex.DecodeString("51210279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f8179851ae")
+
+	tests := []struct {
+		name   string
+		modify func(packet *psbt.Packet)
+	}{
+		{"tampered output", func(packet *psbt.Packet) { packet.UnsignedTx.TxOut[0].Value -= 1000 }},
+		{"sighash type", func(packet *psbt.Packet) { packet.Inputs[0].SighashType = txscript.SigHashNone }},
+		{"missing redeem script", func(packet *psbt.Packet) { packet.Inputs[0].RedeemScript = nil }},
+		{"redeem script", func(packet *psbt.Packet) { packet.Inputs[1].RedeemScript = otherScript }},
+		{"utxo value", func(packet *psbt.Packet) { packet.Inputs[1].NonWitnessUtxo.TxOut[0].Value++ }},
+		{"missing utxo", func(packet *psbt.Packet) { packet.Inputs[0].NonWitnessUtxo = nil }},
+		{"witness utxo", func(packet *psbt.Packet) {
+			packet.Inputs[0].WitnessUtxo = packet.Inputs[0].NonWitnessUtxo.TxOut[0]
+			packet.Inputs[0].NonWitnessUtxo = nil
+		}},
+	}
+
+	for _, test := range tests {
+		p, err := b.NewMeltPsbt(meltTx)
+		if err != nil {
+			t.Fatalf("%s: new psbt: %v", test.name, err)
+		}
+		test.modify(p.Packet)
+		data, err := p.Export()
+		if err != nil {
+			t.Fatalf("%s: export psbt: %v", test.name, err)
+		}
+		if _, err := b.ImportMeltPsbt(data, meltTx); err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+
+	p, _ := b.NewMeltPsbt(meltTx)
+	data, _ := p.Export()
+	if _, err := b.ImportMeltPsbt(data, nil); err == nil {
+		t.Error("expected error importing without local melt tx")
+	}
+	b.watcher.UnlockUtxo(getUtxoIDs(meltTx.Utxos[:1]))
+	if _, err := b.ImportMeltPsbt(data, meltTx); err == nil {
+		t.Error("expected error importing psbt spending unlocked utxo")
+	}
+}
+
+func TestMeltPsbtSignTampered(t *testing.T) {
+	b, _ := newTestMeltTxBuilder(t, coinmanager.FederationAddressP2SH)
+	meltTx := newTestMeltTx(t, b)
+	p, err := b.NewMeltPsbt(meltTx)
+	if err != nil {
+		t.Fatalf("new psbt: %v", err)
+	}
+
+	//导入后被修改的交易不签名
+	p.Packet.UnsignedTx.TxOut[0].PkScript = []byte{txscript.OP_TRUE}
+	if signed, err := p.Sign(testPrivKey(1)); err == nil || signed != 0 {
+		t.Errorf("got %d signed err %v for tampered psbt", signed, err)
+	}
+}
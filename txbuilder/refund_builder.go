@@ -0,0 +1,70 @@
+package txbuilder
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/JimmyHongjichuan/btc_watcher/coinmanager"
+	"github.com/JimmyHongjichuan/btc_watcher/mortgagewatcher"
+	"github.com/btcsuite/btcd/wire"
+	log "github.com/inconshreveable/log15"
+)
+
+//BuildRefundTx 使用退款队列中转入的utxo构造退回发送方地址的交易，手续费从退款金额中扣除
+//签名流程与熔币交易相同，退款交易确认后MortgageWatcher自动将退款标记为完成
+func (b *MeltTxBuilder) BuildRefundTx(scTxid string) (*MeltTx, error) {
+	refund := b.watcher.GetRefund(scTxid)
+	if refund == nil {
+		return nil, errors.New("refund not found: " + scTxid)
+	}
+	if refund.Status != mortgagewatcher.RefundStatusPending {
+		return nil, errors.New("refund already finished: " + scTxid)
+	}
+	if refund.SenderAddress == "" {
+		return nil, errors.New("sender address unknown, set refund address first: " + scTxid)
+	}
+
+	coinType := b.watcher.GetCoinType()
+	pkScript, err := coinmanager.PayToAddrScript(refund.SenderAddress, coinType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid refund address %s: %v", refund.SenderAddress, err)
+	}
+
+	err = b.watcher.LockUtxo(refund.Utxos)
+	if err != nil {
+		return nil, err
+	}
+
+	var utxos []*coinmanager.UtxoInfo
+	for _, utxoID := range refund.Utxos {
+		utxo := b.watcher.GetUtxo(utxoID)
+		if utxo == nil {
+			b.watcher.UnlockUtxo(refund.Utxos)
+			return nil, fmt.Errorf("refund utxo %s not found", utxoID)
+		}
+		utxos = append(utxos, utxo)
+	}
+	spendInfos, err := b.getSpendInfos(utxos)
+	if err != nil {
+		b.watcher.UnlockUtxo(refund.Utxos)
+		return nil, err
+	}
+
+	output := wire.NewTxOut(0, pkScript)
+	fee := b.feeRate * estimateVSize(spendInfos, []*wire.TxOut{output}, nil)
+	output.Value = sumUtxoValue(utxos) - fee
+	if output.Value < b.watcher.GetDustThreshold() {
+		b.watcher.UnlockUtxo(refund.Utxos)
+		return nil, fmt.Errorf("refund amount %d below dust threshold after fee %d", output.Value, fee)
+	}
+
+	refundTx, err := b.buildTx(utxos, spendInfos, []*wire.TxOut{output}, nil)
+	if err != nil {
+		b.watcher.UnlockUtxo(refund.Utxos)
+		return nil, err
+	}
+
+	log.Info("build refund tx", "scTxid", scTxid, "hash_before_sign", refundTx.HashBeforeSign, "to", refund.SenderAddress,
+		"amount", output.Value, "fee", refundTx.Fee, "coinType", coinType)
+	return refundTx, nil
+}